@@ -8,6 +8,8 @@ import (
 )
 
 var configPath string // Variable to store the configuration file path
+var updateLock bool   // Ignore the versions pinned in the lockfile
+var applyGroup string // Only apply to the hosts of this group
 
 // applyCmd represents the apply command
 var applyCmd = &cobra.Command{
@@ -26,7 +28,10 @@ to the user about the progress of the application process.`,
 			logger.Errorf("Failed to load steward config from %s: %v", configPath, err)
 			return err
 		}
-		logger.Infof("Debug %s", config)
+		if err := common.ValidateConfigFile(configPath, config); err != nil {
+			logger.Errorf("Invalid steward config %s: %v", configPath, err)
+			return err
+		}
 
 		// Merge common parameters into host-specific configurations
 		mergedConfig, err := common.MergeCommonToHosts(config)
@@ -34,26 +39,45 @@ to the user about the progress of the application process.`,
 			logger.Errorf("Error merging common parameters: %v\n", err)
 			return err
 		}
+		allHosts := mergedConfig.Hosts
+		if applyGroup != "" {
+			mergedConfig, err = common.HostsInGroup(mergedConfig, applyGroup)
+			if err != nil {
+				logger.Errorf("Error selecting hosts: %v", err)
+				return err
+			}
+		}
 		logger.Infof("Steward config loaded successfully from %s", configPath)
-		logger.Infof("Merged Config %s", mergedConfig)
 
-		// Apply the configuration
-		updatedConfig := run.ApplyConfigWithProgress(mergedConfig)
-		logger.Infof("Applied configuration... %s", updatedConfig)
-		if updatedConfig == nil {
-			logger.Errorf("Failed to apply configuration")
+		// Load the lockfile which pins package versions of previous runs
+		lockPath := common.LockFilePath(configPath)
+		lock, err := common.LoadLockFile(lockPath)
+		if err != nil {
+			logger.Errorf("Failed to load lockfile from %s: %v", lockPath, err)
 			return err
 		}
+
+		// Apply the configuration
+		updatedLock := run.ApplyConfigWithProgress(mergedConfig, lock, updateLock)
 		logger.Infof("Configuration applied successfully")
-		logger.Debugf("Updated configuration: %v", updatedConfig)
+		logger.Debugf("Updated lockfile: %v", updatedLock)
+
+		// Hosts outside the selected group keep their lock
+		for _, host := range allHosts {
+			if updatedLock.Host(host.Host) == nil {
+				if hostLock := lock.Host(host.Host); hostLock != nil {
+					updatedLock.SetHost(host.Host, hostLock)
+				}
+			}
+		}
 
-		// Update the configuration file with updatedConfig
-		err = common.UpdateConfigFile(configPath, updatedConfig)
+		// Record the resolved versions and template hashes in the lockfile
+		err = common.WriteLockFile(lockPath, updatedLock)
 		if err != nil {
-			logger.Errorf("Failed to update config file at %s: %v", configPath, err)
+			logger.Errorf("Failed to write lockfile at %s: %v", lockPath, err)
 			return err
 		}
-		logger.Infof("Configuration file updated successfully at %s", configPath)
+		logger.Infof("Lockfile updated successfully at %s", lockPath)
 		return nil
 	},
 }
@@ -63,4 +87,6 @@ func init() {
 
 	// Add a flag for specifying the configuration file path
 	applyCmd.Flags().StringVarP(&configPath, "config", "c", "", "Path to the configuration file")
+	applyCmd.Flags().BoolVarP(&updateLock, "update", "u", false, "Ignore versions pinned in the lockfile and resolve packages again")
+	applyCmd.Flags().StringVarP(&applyGroup, "group", "g", "", "Only apply the configuration to the hosts of this group")
 }
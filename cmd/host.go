@@ -1,9 +1,16 @@
 package cmd
 
 import (
+    "encoding/json"
     "fmt"
+    "os"
+    "text/tabwriter"
+
     "github.com/spf13/cobra"
+    "golang.org/x/crypto/ssh"
     "steward/pkg/common"
+    "steward/pkg/exec"
+    "steward/pkg/facts"
 )
 
 // hostCmd represents the host command
@@ -30,7 +37,7 @@ var addHostCmd = &cobra.Command{
 			return fmt.Errorf("Error: Either password or SSH key must be provided")
 		}
 
-        config, err := common.LoadConfig("steward-config/config.yaml")
+        config, err := common.LoadRawConfig("steward-config/config.yaml")
         if err != nil {
             return fmt.Errorf("Failed to load configuration: %v", err)
         }
@@ -69,7 +76,7 @@ var updateHostCmd = &cobra.Command{
             return fmt.Errorf("Error: Host is required")
         }
 
-        config, err := common.LoadConfig("steward-config/config.yaml")
+        config, err := common.LoadRawConfig("steward-config/config.yaml")
         if err != nil {
             // logger.Errorf("Failed to load configuration: %v", err)
             return fmt.Errorf("Failed to load configuration: %v", err)
@@ -122,7 +129,7 @@ var deleteHostCmd = &cobra.Command{
             return fmt.Errorf("Error: Host is required")
         }
 
-        config, err := common.LoadConfig("steward-config/config.yaml")
+        config, err := common.LoadRawConfig("steward-config/config.yaml")
         if err != nil {
             // logger.Errorf("Failed to load configuration: %v", err)
             return fmt.Errorf("Failed to load configuration: %v", err)
@@ -158,6 +165,110 @@ var deleteHostCmd = &cobra.Command{
     },
 }
 
+// factsHostCmd represents the facts subcommand
+var factsHostCmd = &cobra.Command{
+    Use:   "facts",
+    Short: "Detect and show the OS and package manager of hosts",
+    RunE: func(cmd *cobra.Command, args []string) error {
+        path, _ := cmd.Flags().GetString("config")
+        host, _ := cmd.Flags().GetString("host")
+        output, _ := cmd.Flags().GetString("output")
+
+        if output != "table" && output != "json" {
+            return fmt.Errorf("Error: Unsupported output format %s", output)
+        }
+
+        config, err := common.LoadConfig(path)
+        if err != nil {
+            return fmt.Errorf("Failed to load configuration: %v", err)
+        }
+
+        hostFacts := make(map[string]*common.Facts)
+        var hosts []string
+        for _, h := range config.Hosts {
+            if host != "" && h.Host != host {
+                continue
+            }
+            sshClient, err := exec.SetupSSHClient(h.SSHOptions())
+            if err != nil {
+                return fmt.Errorf("Failed to connect to host %s: %v", h.Host, err)
+            }
+            detected, err := facts.Gather(sshClient)
+            sshClient.Close()
+            if err != nil {
+                return fmt.Errorf("Failed to detect facts of host %s: %v", h.Host, err)
+            }
+            hostFacts[h.Host] = detected
+            hosts = append(hosts, h.Host)
+        }
+
+        if host != "" && len(hosts) == 0 {
+            return fmt.Errorf("Host %s not found", host)
+        }
+
+        if output == "json" {
+            encoder := json.NewEncoder(os.Stdout)
+            encoder.SetIndent("", "  ")
+            return encoder.Encode(hostFacts)
+        }
+
+        writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+        fmt.Fprintf(writer, "HOST\tHOSTNAME\tDISTRO\tVERSION\tARCH\tMANAGER\n")
+        for _, h := range hosts {
+            f := hostFacts[h]
+            fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\n", h, f.Hostname, f.Distro, f.Version, f.Arch, f.DefaultManager)
+        }
+        return writer.Flush()
+    },
+}
+
+// trustHostCmd represents the trust subcommand
+var trustHostCmd = &cobra.Command{
+    Use:   "trust",
+    Short: "Trust the current SSH host key of a host",
+    Long: `Trust the current SSH host key of a host. This command connects to the host, records the
+key it presents in ~/.steward/known_hosts and replaces the keys recorded for the host before.
+Use it to accept a changed host key, after checking the fingerprint with --fingerprint.`,
+    RunE: func(cmd *cobra.Command, args []string) error {
+        path, _ := cmd.Flags().GetString("config")
+        host, _ := cmd.Flags().GetString("host")
+        fingerprint, _ := cmd.Flags().GetString("fingerprint")
+
+        if host == "" {
+            return fmt.Errorf("Error: Host is required")
+        }
+
+        config, err := common.LoadConfig(path)
+        if err != nil {
+            return fmt.Errorf("Failed to load configuration: %v", err)
+        }
+
+        for _, h := range config.Hosts {
+            if h.Host != host {
+                continue
+            }
+            key, address, err := exec.ScanHostKey(h.SSHOptions())
+            if err != nil {
+                return err
+            }
+            if fingerprint != "" && ssh.FingerprintSHA256(key) != fingerprint {
+                return fmt.Errorf("Host key of %s is %s, expected %s", address, ssh.FingerprintSHA256(key), fingerprint)
+            }
+
+            trustFile := exec.DefaultTrustFile()
+            if err := exec.TrustHostKey(trustFile, address, key); err != nil {
+                return err
+            }
+            if h.HostKey != "" {
+                logger.Warnf("Host %s pins host_key %s, which is checked instead of %s", host, h.HostKey, trustFile)
+            }
+            fmt.Printf("Trusted host key %s of %s in %s\n", ssh.FingerprintSHA256(key), address, trustFile)
+            return nil
+        }
+        return fmt.Errorf("Host %s not found", host)
+    },
+}
+
 func init() {
     rootCmd.AddCommand(hostCmd)
 
@@ -165,6 +276,8 @@ func init() {
     hostCmd.AddCommand(addHostCmd)
     hostCmd.AddCommand(updateHostCmd)
     hostCmd.AddCommand(deleteHostCmd)
+    hostCmd.AddCommand(factsHostCmd)
+    hostCmd.AddCommand(trustHostCmd)
 
     // Add flags for the subcommands
     addHostCmd.Flags().StringP("host", "H", "", "Host address (required)")
@@ -178,4 +291,12 @@ func init() {
     updateHostCmd.Flags().StringP("key", "k", "", "New SSH key for the host")
 
     deleteHostCmd.Flags().StringP("host", "H", "", "Host address (required)")
-}
\ No newline at end of file
+
+    factsHostCmd.Flags().StringP("config", "c", "./config.yaml", "Path to the configuration file")
+    factsHostCmd.Flags().StringP("host", "H", "", "Only show facts of this host")
+    factsHostCmd.Flags().StringP("output", "o", "table", "Output format: table or json")
+
+    trustHostCmd.Flags().StringP("config", "c", "./config.yaml", "Path to the configuration file")
+    trustHostCmd.Flags().StringP("host", "H", "", "Host to trust (required)")
+    trustHostCmd.Flags().String("fingerprint", "", "Only trust the key with this SHA256: fingerprint")
+}
@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"steward/pkg/common"
+	"steward/pkg/run"
+
+	"github.com/spf13/cobra"
+)
+
+var planOutput string // Output format of the plan
+
+// planCmd represents the plan command
+var planCmd = &cobra.Command{
+	Use:   "plan",
+	Short: "Show the changes apply would make without applying them",
+	Long: `Show the changes apply would make without applying them. This command connects
+to each host, compares installed packages and remote files with the configuration
+and prints the packages to install, upgrade or remove, the files to change and
+the commands which will run.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if planOutput != "table" && planOutput != "json" {
+			return fmt.Errorf("unsupported output format %s, use table or json", planOutput)
+		}
+
+		// Load the configuration file
+		if configPath == "" {
+			configPath = "./config.yaml"
+		}
+		config, err := common.LoadConfig(configPath)
+		if err != nil {
+			logger.Errorf("Failed to load steward config from %s: %v", configPath, err)
+			return err
+		}
+		if err := common.ValidateConfigFile(configPath, config); err != nil {
+			logger.Errorf("Invalid steward config %s: %v", configPath, err)
+			return err
+		}
+
+		// Merge common parameters into host-specific configurations
+		mergedConfig, err := common.MergeCommonToHosts(config)
+		if err != nil {
+			logger.Errorf("Error merging common parameters: %v\n", err)
+			return err
+		}
+
+		lockPath := common.LockFilePath(configPath)
+		lock, err := common.LoadLockFile(lockPath)
+		if err != nil {
+			logger.Errorf("Failed to load lockfile from %s: %v", lockPath, err)
+			return err
+		}
+
+		plans := run.PlanConfig(mergedConfig, lock, updateLock)
+		if planOutput == "json" {
+			err = run.PrintPlanJSON(os.Stdout, plans)
+		} else {
+			err = run.PrintPlan(os.Stdout, plans)
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, plan := range plans {
+			if plan.Error != "" {
+				return fmt.Errorf("failed to plan host %s: %s", plan.Host, plan.Error)
+			}
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(planCmd)
+
+	planCmd.Flags().StringVarP(&configPath, "config", "c", "", "Path to the configuration file")
+	planCmd.Flags().BoolVarP(&updateLock, "update", "u", false, "Ignore versions pinned in the lockfile")
+	planCmd.Flags().StringVarP(&planOutput, "output", "o", "table", "Output format: table or json")
+}
@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"os"
+
+	"steward/pkg/common"
+	"steward/pkg/run"
+
+	"github.com/spf13/cobra"
+)
+
+var renderHost string     // Only render templates of this host
+var renderTemplate string // Only render the template with this name
+var renderOutDir string   // Directory to write the rendered templates to
+var renderDiffDir string  // Directory of a previous render to diff against
+
+// renderCmd represents the render command
+var renderCmd = &cobra.Command{
+	Use:   "render",
+	Short: "Render configuration templates locally without connecting to hosts",
+	Long: `Render configuration templates locally without connecting to hosts. This command
+loads and merges the configuration and renders each configuration template for each
+host. Templates are printed to stdout, or written to <out-dir>/<host>/<remote_file>
+with --out-dir. Use --diff with the directory of a previous render to show what changed.
+Host facts are not detected, templates see empty facts.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// Load the configuration file
+		if configPath == "" {
+			configPath = "./config.yaml"
+		}
+		config, err := common.LoadConfig(configPath)
+		if err != nil {
+			logger.Errorf("Failed to load steward config from %s: %v", configPath, err)
+			return err
+		}
+		if err := common.ValidateConfigFile(configPath, config); err != nil {
+			logger.Errorf("Invalid steward config %s: %v", configPath, err)
+			return err
+		}
+
+		// Merge common parameters into host-specific configurations
+		mergedConfig, err := common.MergeCommonToHosts(config)
+		if err != nil {
+			logger.Errorf("Error merging common parameters: %v\n", err)
+			return err
+		}
+
+		rendered, err := run.RenderConfig(mergedConfig, renderHost, renderTemplate)
+		if err != nil {
+			return err
+		}
+
+		if renderDiffDir != "" {
+			if _, err := run.DiffRendered(os.Stdout, renderDiffDir, rendered, renderHost, renderTemplate); err != nil {
+				return err
+			}
+		}
+		if renderOutDir != "" {
+			return run.WriteRendered(renderOutDir, rendered)
+		}
+		if renderDiffDir == "" {
+			return run.PrintRendered(os.Stdout, rendered)
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(renderCmd)
+
+	renderCmd.Flags().StringVarP(&configPath, "config", "c", "", "Path to the configuration file")
+	renderCmd.Flags().StringVarP(&renderHost, "host", "H", "", "Only render templates of this host")
+	renderCmd.Flags().StringVarP(&renderTemplate, "template", "t", "", "Only render the template with this name")
+	renderCmd.Flags().StringVarP(&renderOutDir, "out-dir", "d", "", "Write rendered templates to this directory instead of stdout")
+	renderCmd.Flags().StringVar(&renderDiffDir, "diff", "", "Show the diff against a previous render in this directory")
+}
@@ -0,0 +1,135 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"steward/pkg/common"
+
+	"github.com/spf13/cobra"
+)
+
+// secretCmd represents the secret command
+var secretCmd = &cobra.Command{
+	Use:   "secret",
+	Short: "Manage the encrypted secrets file",
+	Long: `Manage the encrypted secrets file configured as secrets.file in the configuration.
+Secrets are referenced as ${secret:name} in the configuration. The passphrase of the file
+is read from STEWARD_SECRETS_PASSPHRASE or printed by secrets.passphrase_command.`,
+}
+
+// setSecretCmd represents the secret set subcommand
+var setSecretCmd = &cobra.Command{
+	Use:   "set NAME",
+	Short: "Encrypt a secret read from stdin into the secrets file",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		value, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && value == "" {
+			return fmt.Errorf("failed to read the secret from stdin: %v", err)
+		}
+		value = strings.TrimRight(value, "\r\n")
+		if value == "" {
+			return fmt.Errorf("secret %s is empty", args[0])
+		}
+
+		return updateSecrets(func(secrets map[string]string) error {
+			secrets[args[0]] = value
+			return nil
+		})
+	},
+}
+
+// deleteSecretCmd represents the secret delete subcommand
+var deleteSecretCmd = &cobra.Command{
+	Use:   "delete NAME",
+	Short: "Delete a secret from the secrets file",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return updateSecrets(func(secrets map[string]string) error {
+			if _, ok := secrets[args[0]]; !ok {
+				return fmt.Errorf("secret %s not found", args[0])
+			}
+			delete(secrets, args[0])
+			return nil
+		})
+	},
+}
+
+// listSecretCmd represents the secret list subcommand
+var listSecretCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the names of the secrets in the secrets file",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config, passphrase, err := loadSecretsSettings()
+		if err != nil {
+			return err
+		}
+		secrets, err := common.LoadSecretsFile(config.File, passphrase)
+		if err != nil {
+			return err
+		}
+
+		names := make([]string, 0, len(secrets))
+		for name := range secrets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Println(name)
+		}
+		return nil
+	},
+}
+
+// loadSecretsSettings returns the secrets section of the configuration and the
+// passphrase of its secrets file
+func loadSecretsSettings() (common.Secrets, string, error) {
+	if configPath == "" {
+		configPath = "./config.yaml"
+	}
+	config, err := common.LoadSecretsConfig(configPath)
+	if err != nil {
+		return common.Secrets{}, "", fmt.Errorf("failed to load configuration: %v", err)
+	}
+	if config.File == "" {
+		return common.Secrets{}, "", fmt.Errorf("no secrets file configured in %s, set secrets.file", configPath)
+	}
+	passphrase, err := common.SecretsPassphrase(config)
+	if err != nil {
+		return common.Secrets{}, "", err
+	}
+	return config, passphrase, nil
+}
+
+// updateSecrets decrypts the secrets file, applies update and encrypts it again
+func updateSecrets(update func(secrets map[string]string) error) error {
+	config, passphrase, err := loadSecretsSettings()
+	if err != nil {
+		return err
+	}
+	secrets, err := common.LoadSecretsFile(config.File, passphrase)
+	if err != nil {
+		return err
+	}
+	if err := update(secrets); err != nil {
+		return err
+	}
+	if err := common.WriteSecretsFile(config.File, secrets, passphrase); err != nil {
+		return err
+	}
+	logger.Infof("Secrets file %s updated", config.File)
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(secretCmd)
+	secretCmd.AddCommand(setSecretCmd)
+	secretCmd.AddCommand(deleteSecretCmd)
+	secretCmd.AddCommand(listSecretCmd)
+
+	secretCmd.PersistentFlags().StringVarP(&configPath, "config", "c", "", "Path to the configuration file")
+}
@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"fmt"
+
+	"steward/pkg/common"
+
+	"github.com/spf13/cobra"
+)
+
+// validateCmd represents the validate command
+var validateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Validate the configuration file",
+	Long: `Validate the configuration file without connecting to hosts. This command loads the
+configuration with its includes and reports all problems at once, each with the file,
+line and column it comes from. apply, plan and render run the same validation.`,
+	// Problems are printed one per line, usage would only hide them
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if configPath == "" {
+			configPath = "./config.yaml"
+		}
+		config, err := common.LoadConfig(configPath)
+		if err != nil {
+			logger.Errorf("Failed to load steward config from %s: %v", configPath, err)
+			return err
+		}
+
+		if err := common.ValidateConfigFile(configPath, config); err != nil {
+			if errs, ok := err.(common.ValidationErrors); ok {
+				for _, problem := range errs {
+					fmt.Println(problem.Error())
+				}
+				return fmt.Errorf("%s has %d problems", configPath, len(errs))
+			}
+			return err
+		}
+		fmt.Printf("%s is valid\n", configPath)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(validateCmd)
+
+	validateCmd.Flags().StringVarP(&configPath, "config", "c", "", "Path to the configuration file")
+}
@@ -4,6 +4,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
+	"reflect"
+
+	"steward/pkg/exec"
+	"steward/utils"
 
 	"gopkg.in/yaml.v3"
 )
@@ -14,11 +19,23 @@ type Application struct {
 	External []ExternalApp `yaml:"external" json:"external"`
 }
 
+// Package states supported by the state field of applications
+const (
+	StatePresent = "present" // Install the package if it is missing, the default
+	StateAbsent  = "absent"  // Remove the package if it is installed
+	StateLatest  = "latest"  // Install or upgrade the package to the latest version
+)
+
 // CoreApp represents a core application with name, manager, and version
 type CoreApp struct {
 	Name    string `yaml:"name" json:"name"`
 	Manager string `yaml:"manager" json:"manager"`
 	Version string `yaml:"version" json:"version"`
+	State   string `yaml:"state,omitempty" json:"state,omitempty"`
+	// Purge removes configuration files as well when the state is absent
+	Purge bool `yaml:"purge,omitempty" json:"purge,omitempty"`
+	// set records the fields written in the config file
+	set fieldSet
 }
 
 // ExternalApp represents an external application with GPG key, repo, and packages
@@ -28,6 +45,11 @@ type ExternalApp struct {
 	Repo      string `yaml:"repo" json:"repo"`
 	Manager   string `yaml:"manager" json:"manager"`
 	Version   string `yaml:"version" json:"version"`
+	State     string `yaml:"state,omitempty" json:"state,omitempty"`
+	// Purge removes configuration files as well when the state is absent
+	Purge bool `yaml:"purge,omitempty" json:"purge,omitempty"`
+	// set records the fields written in the config file
+	set fieldSet
 }
 
 // ConfigurationTemplate represents a configuration template
@@ -38,6 +60,18 @@ type ConfigurationTemplate struct {
 	RemoteFile   string      `yaml:"remote_file" json:"remote_file"`
 	Sudo         bool        `yaml:"sudo" json:"sudo"`
 	Data         interface{} `yaml:"data" json:"data"`
+	// Owner, Group and Mode (octal, like "0640") of the remote file, unchanged when empty
+	Owner string `yaml:"owner,omitempty" json:"owner,omitempty"`
+	Group string `yaml:"group,omitempty" json:"group,omitempty"`
+	Mode  string `yaml:"mode,omitempty" json:"mode,omitempty"`
+	// Backup keeps a timestamped copy of the remote file before it is replaced
+	Backup bool `yaml:"backup,omitempty" json:"backup,omitempty"`
+	// Validate checks the uploaded file before it replaces the remote file, %s is the path of the uploaded file
+	Validate string `yaml:"validate,omitempty" json:"validate,omitempty"`
+	// Notify names commands which run at the end of the host run when this template changed
+	Notify []string `yaml:"notify,omitempty" json:"notify,omitempty"`
+	// set records the fields written in the config file
+	set fieldSet
 }
 
 // Command represents a custom command to execute
@@ -46,6 +80,8 @@ type Command struct {
 	Command        string `yaml:"command" json:"command"`
 	ExpectedOutput string `yaml:"expected_output" json:"expected_output"`
 	Sudo           bool   `yaml:"sudo" json:"sudo"`
+	// set records the fields written in the config file
+	set fieldSet
 }
 
 // Host represents a host configuration
@@ -58,20 +94,199 @@ type Host struct {
 	Application   Application             `yaml:"application" json:"application"`
 	Configuration []ConfigurationTemplate `yaml:"configuration" json:"configuration"`
 	Commands      []Command               `yaml:"command" json:"command"`
+	// Groups the host belongs to, merged in order after common and before the host
+	Groups []string `yaml:"groups,omitempty" json:"groups,omitempty"`
+	// Exclude removes inherited entries from the host
+	Exclude Exclude `yaml:"exclude,omitempty" json:"exclude,omitempty"`
+	// BecomeMethod is sudo, su, doas or none, sudo when empty
+	BecomeMethod string `yaml:"become_method,omitempty" json:"become_method,omitempty"`
+	// BecomeUser is the user sudo commands, templates and packages run as, root when empty
+	BecomeUser string `yaml:"become_user,omitempty" json:"become_user,omitempty"`
+	// BecomePassword authenticates the become method, the SSH password is used when empty
+	BecomePassword string `yaml:"become_password,omitempty" json:"become_password,omitempty"`
+	// HostKey pins the SSH host key as SHA256: fingerprint or public key, known_hosts are not used then
+	HostKey string `yaml:"host_key,omitempty" json:"host_key,omitempty"`
+	// HostKeyChecking is strict, tofu or off, tofu when empty
+	HostKeyChecking string `yaml:"host_key_checking,omitempty" json:"host_key_checking,omitempty"`
+	// SSHKeyPassphrase decrypts an encrypted ssh_key, it is prompted for when empty and the key is not in ssh-agent
+	SSHKeyPassphrase string `yaml:"ssh_key_passphrase,omitempty" json:"ssh_key_passphrase,omitempty"`
+	// Facts are detected from the remote host when it is connected, they are never persisted
+	Facts *Facts `yaml:"-" json:"-"`
+}
+
+// Become returns how commands gain the privileges of the become user on the
+// host. Commands run directly when the SSH user already is the become user.
+func (h Host) Become() exec.Become {
+	become := exec.Become{
+		Method:   h.BecomeMethod,
+		User:     h.BecomeUser,
+		Password: h.BecomePassword,
+	}
+	if become.Password == "" {
+		become.Password = h.Password
+	}
+	if become.User == "" {
+		become.User = "root"
+	}
+	if h.User == become.User {
+		become.Method = exec.BecomeNone
+	}
+	return become
+}
+
+// HostKeyPolicy returns how the SSH host key of the host is verified
+func (h Host) HostKeyPolicy() exec.HostKeyPolicy {
+	return exec.HostKeyPolicy{
+		Checking: h.HostKeyChecking,
+		HostKey:  h.HostKey,
+	}
+}
+
+// SSHOptions returns how the host is connected to. Settings which are not
+// configured are resolved from ~/.ssh/config.
+func (h Host) SSHOptions() exec.SSHOptions {
+	return exec.SSHOptions{
+		Host:          h.Host,
+		Port:          h.Port,
+		User:          h.User,
+		Password:      h.Password,
+		KeyPath:       h.SSHKey,
+		KeyPassphrase: h.SSHKeyPassphrase,
+		HostKeys:      h.HostKeyPolicy(),
+	}
+}
+
+// Exclude names entries inherited from common or groups which a host leaves out
+type Exclude struct {
+	// Application names core or external applications
+	Application   []string `yaml:"application,omitempty" json:"application,omitempty"`
+	Configuration []string `yaml:"configuration,omitempty" json:"configuration,omitempty"`
+	Commands      []string `yaml:"command,omitempty" json:"command,omitempty"`
+}
+
+// Facts describes the operating system detected on a remote host
+type Facts struct {
+	Hostname       string   `yaml:"hostname" json:"hostname"`
+	Arch           string   `yaml:"arch" json:"arch"`
+	Distro         string   `yaml:"distro" json:"distro"`
+	DistroLike     []string `yaml:"distro_like" json:"distro_like"`
+	Version        string   `yaml:"version" json:"version"`
+	PrettyName     string   `yaml:"pretty_name" json:"pretty_name"`
+	Managers       []string `yaml:"managers" json:"managers"`
+	DefaultManager string   `yaml:"default_manager" json:"default_manager"`
+}
+
+// Group holds the applications, configuration templates and commands shared by
+// a set of hosts. The common section is the group every host belongs to.
+type Group struct {
+	Application   Application             `yaml:"application" json:"application"`
+	Configuration []ConfigurationTemplate `yaml:"configuration" json:"configuration"`
+	Commands      []Command               `yaml:"command" json:"command"`
 }
 
 // Config represents the structure of the configuration file
 type Config struct {
-	Common struct {
-		Application   Application             `yaml:"application" json:"application"`
-		Configuration []ConfigurationTemplate `yaml:"configuration" json:"configuration"`
-		Commands      []Command               `yaml:"command" json:"command"`
-	} `yaml:"common" json:"common"`
-	Hosts []Host `yaml:"hosts" json:"hosts"`
+	// Include lists configuration files merged before this file, relative to this file
+	Include []string `yaml:"include,omitempty" json:"include,omitempty"`
+	// Vars are referenced as ${name} in the configuration
+	Vars map[string]interface{} `yaml:"vars,omitempty" json:"vars,omitempty"`
+	// Secrets configures where ${secret:name} references are resolved from
+	Secrets Secrets `yaml:"secrets,omitempty" json:"secrets,omitempty"`
+	Common  Group   `yaml:"common" json:"common"`
+	// Groups are named groups like control-plane or workers which hosts belong to
+	Groups map[string]Group `yaml:"groups,omitempty" json:"groups,omitempty"`
+	Hosts  []Host           `yaml:"hosts" json:"hosts"`
 }
 
-// LoadConfig loads a configuration file (YAML or JSON) into the Config struct
+// LoadConfig loads a configuration file (YAML or JSON) into the Config struct.
+// Included files are merged in order before the file itself, then ${var},
+// ${env:NAME} and ${secret:name} references are resolved. Resolved secrets and
+// host passwords and key passphrases are redacted from all logs.
 func LoadConfig(filePath string) (*Config, error) {
+	config, err := loadConfigWithIncludes(filePath, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := InterpolateConfig(config); err != nil {
+		return nil, fmt.Errorf("failed to resolve variables in %s: %w", filePath, err)
+	}
+	for _, host := range config.Hosts {
+		utils.RegisterSecret(host.Password)
+		utils.RegisterSecret(host.BecomePassword)
+		utils.RegisterSecret(host.SSHKeyPassphrase)
+	}
+	return config, nil
+}
+
+// loadConfigWithIncludes loads a configuration file merged with its includes.
+// stack holds the files including this one, to detect include cycles.
+func loadConfigWithIncludes(filePath string, stack []string) (*Config, error) {
+	absPath, err := filepath.Abs(filePath)
+	if err != nil {
+		return nil, err
+	}
+	for _, including := range stack {
+		if including == absPath {
+			return nil, fmt.Errorf("config file %s includes itself", filePath)
+		}
+	}
+	stack = append(stack, absPath)
+
+	config, err := LoadRawConfig(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if config.Secrets.File != "" && !filepath.IsAbs(config.Secrets.File) {
+		config.Secrets.File = filepath.Join(filepath.Dir(filePath), config.Secrets.File)
+	}
+
+	merged := &Config{}
+	for _, include := range config.Include {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(filePath), include)
+		}
+		included, err := loadConfigWithIncludes(include, stack)
+		if err != nil {
+			return nil, fmt.Errorf("failed to include %s: %w", include, err)
+		}
+		mergeConfig(merged, included)
+	}
+	mergeConfig(merged, config)
+	return merged, nil
+}
+
+// mergeConfig merges src into dst. Vars and secrets of src override those of
+// dst, lists of src are appended to the lists of dst.
+func mergeConfig(dst *Config, src *Config) {
+	if len(src.Vars) > 0 && dst.Vars == nil {
+		dst.Vars = make(map[string]interface{})
+	}
+	for name, value := range src.Vars {
+		dst.Vars[name] = value
+	}
+	dst.Secrets = mergeSecrets(dst.Secrets, src.Secrets)
+
+	dst.Common.Application.Core = append(dst.Common.Application.Core, src.Common.Application.Core...)
+	dst.Common.Application.External = append(dst.Common.Application.External, src.Common.Application.External...)
+	dst.Common.Configuration = append(dst.Common.Configuration, src.Common.Configuration...)
+	dst.Common.Commands = append(dst.Common.Commands, src.Common.Commands...)
+	if len(src.Groups) > 0 && dst.Groups == nil {
+		dst.Groups = make(map[string]Group)
+	}
+	for name, group := range src.Groups {
+		merged := dst.Groups[name]
+		merged.Application.Core = append(merged.Application.Core, group.Application.Core...)
+		merged.Application.External = append(merged.Application.External, group.Application.External...)
+		merged.Configuration = append(merged.Configuration, group.Configuration...)
+		merged.Commands = append(merged.Commands, group.Commands...)
+		dst.Groups[name] = merged
+	}
+	dst.Hosts = append(dst.Hosts, src.Hosts...)
+}
+
+// LoadRawConfig loads a single configuration file as it is written, without
+// merging its includes or resolving variables. Use it to edit the file.
+func LoadRawConfig(filePath string) (*Config, error) {
 	// Open the file
 	file, err := os.Open(filePath)
 	if err != nil {
@@ -98,7 +313,9 @@ func LoadConfig(filePath string) (*Config, error) {
 	return &config, nil
 }
 
-// This function overwrites the existing file with the new data
+// UpdateConfigFile writes the configuration next to the configuration file,
+// to filePath with a .lock suffix. Resolved versions are not written here,
+// apply records them in the lockfile.
 func UpdateConfigFile(filePath string, config *Config) error {
 	// Open the file for writing
 	file, err := os.Create(filePath + ".lock")
@@ -126,22 +343,6 @@ func UpdateConfigFile(filePath string, config *Config) error {
 	return nil
 }
 
-// ValidateConfig validates the configuration file
-func ValidateConfig(config *Config) error {
-	// Implement validation logic here
-	// For example, check if required fields are present and valid
-	for _, host := range config.Hosts {
-		if host.Host == "" {
-			return fmt.Errorf("host is required")
-		}
-		if host.User == "" {
-			return fmt.Errorf("user is required for host %s", host.Host)
-		}
-	}
-
-	return nil
-}
-
 // isYAML checks if the file is a YAML file based on its extension
 func isYAML(filePath string) bool {
 	return len(filePath) > 5 && (filePath[len(filePath)-5:] == ".yaml" || filePath[len(filePath)-4:] == ".yml")
@@ -152,84 +353,187 @@ func isJSON(filePath string) bool {
 	return len(filePath) > 5 && filePath[len(filePath)-5:] == ".json"
 }
 
-// MergeCommonToHosts merges the common parameters into each host-specific configuration
-// and removes the common section from the configuration.
+// MergeCommonToHosts merges the common parameters and the groups of each host
+// into each host-specific configuration, and removes the common section and
+// the groups from the configuration. Entries are merged by name with the
+// precedence common, then the groups of the host in order, then the host:
+//
+//   - fields set in a higher layer override the fields of the same entry in a
+//     lower layer, unset fields are inherited
+//   - template data maps are merged deeply, other data values are replaced
+//   - entries with a new name are appended, so common entries come first
+//   - entries named in the exclude list of the host are removed
 func MergeCommonToHosts(config *Config) (*Config, error) {
 	// Create a copy of the input config to avoid modifying it directly
 	updatedConfig := *config
 	updatedConfig.Hosts = make([]Host, len(config.Hosts))
 
 	for i, host := range config.Hosts {
+		// Layers in precedence order, the host itself is the last layer
+		layers := []Group{config.Common}
+		for _, name := range host.Groups {
+			group, ok := config.Groups[name]
+			if !ok {
+				return nil, fmt.Errorf("host %s belongs to undefined group %s", host.Host, name)
+			}
+			layers = append(layers, group)
+		}
+		layers = append(layers, Group{
+			Application:   host.Application,
+			Configuration: host.Configuration,
+			Commands:      host.Commands,
+		})
+
 		// Create a copy of the host to avoid modifying the original
 		updatedHost := host
+		updatedHost.Application = Application{}
+		updatedHost.Configuration = nil
+		updatedHost.Commands = nil
+		for _, layer := range layers {
+			updatedHost.Application.Core = mergeNamed(updatedHost.Application.Core, layer.Application.Core, func(app CoreApp) string { return app.Name })
+			updatedHost.Application.External = mergeNamed(updatedHost.Application.External, layer.Application.External, func(app ExternalApp) string { return app.Name })
+			updatedHost.Configuration = mergeNamed(updatedHost.Configuration, layer.Configuration, func(template ConfigurationTemplate) string { return template.Name })
+			updatedHost.Commands = mergeNamed(updatedHost.Commands, layer.Commands, func(command Command) string { return command.Name })
+		}
 
-		// Merge common application core packages
-		for _, value := range config.Common.Application.Core {
-			found := false
-			for _, hostCore := range updatedHost.Application.Core {
-				if hostCore.Name == value.Name {
-					found = true
-					break
-				}
-			}
-			if !found {
-				updatedHost.Application.Core = append(updatedHost.Application.Core, value)
-			}
+		if err := excludeEntries(&updatedHost); err != nil {
+			return nil, err
 		}
 
-		// Merge or add common external applications
-		for _, commonExternal := range config.Common.Application.External {
-			found := false
-			for _, hostExternal := range updatedHost.Application.External {
-				if hostExternal.Name == commonExternal.Name {
-					found = true
-					break
-				}
-			}
-			if !found {
-				// Add the common external application as a new entry
-				updatedHost.Application.External = append(updatedHost.Application.External, commonExternal)
+		// Add the updated host to the new config
+		updatedConfig.Hosts[i] = updatedHost
+	}
+
+	// Remove the common section and the groups, they are merged into the hosts
+	updatedConfig.Common = Group{}
+	updatedConfig.Groups = nil
+
+	return &updatedConfig, nil
+}
+
+// mergeNamed merges the entries of a higher layer into the entries of lower
+// layers. An entry is merged into the entry with the same name in place,
+// entries with a new name are appended.
+func mergeNamed[T any](entries []T, layer []T, name func(T) string) []T {
+	merged := make([]T, len(entries), len(entries)+len(layer))
+	copy(merged, entries)
+	for _, entry := range layer {
+		found := false
+		for i := range merged {
+			if name(merged[i]) == name(entry) {
+				merged[i] = overrideFields(merged[i], entry)
+				found = true
+				break
 			}
 		}
+		if !found {
+			merged = append(merged, entry)
+		}
+	}
+	return merged
+}
 
-		// Merge common configuration templates
-		for _, commonConfig := range config.Common.Configuration {
-			found := false
-			for _, hostConfig := range updatedHost.Configuration {
-				if hostConfig.Name == commonConfig.Name {
-					found = true
-					break
-				}
-			}
-			if !found {
-				updatedHost.Configuration = append(updatedHost.Configuration, commonConfig)
-			}
+// overrideFields returns base with the fields which are set in override.
+// Fields written in the config file are set even when they are false or
+// empty. Maps held in interface fields, like template data, are merged deeply.
+func overrideFields[T any](base T, override T) T {
+	var explicit fieldSet
+	if entry, ok := any(override).(explicitEntry); ok {
+		explicit = entry.explicitFields()
+	}
+	result := reflect.ValueOf(&base).Elem()
+	fields := reflect.ValueOf(override)
+	for i := 0; i < fields.NumField(); i++ {
+		field := fields.Field(i)
+		if !fields.Type().Field(i).IsExported() || (field.IsZero() && !explicit.has(i)) {
+			continue
+		}
+		if field.Kind() == reflect.Interface && !field.IsZero() && !result.Field(i).IsZero() {
+			field = reflect.ValueOf(deepMerge(result.Field(i).Interface(), field.Interface()))
 		}
+		result.Field(i).Set(field)
+	}
+	return base
+}
 
-		// Merge common commands
-		for _, commonCommand := range config.Common.Commands {
-			found := false
-			for _, hostCommand := range updatedHost.Commands {
-				if hostCommand.Name == commonCommand.Name {
-					found = true
-					break
-				}
-			}
-			if !found {
-				updatedHost.Commands = append(updatedHost.Commands, commonCommand)
-			}
+// deepMerge merges override into base when both are maps, recursively.
+// Otherwise, including lists, override replaces base. base is not modified.
+func deepMerge(base interface{}, override interface{}) interface{} {
+	baseMap, ok := base.(map[string]interface{})
+	if !ok {
+		return override
+	}
+	overrideMap, ok := override.(map[string]interface{})
+	if !ok {
+		return override
+	}
+
+	merged := make(map[string]interface{}, len(baseMap)+len(overrideMap))
+	for key, value := range baseMap {
+		merged[key] = value
+	}
+	for key, value := range overrideMap {
+		if baseValue, ok := merged[key]; ok {
+			value = deepMerge(baseValue, value)
 		}
+		merged[key] = value
+	}
+	return merged
+}
 
-		// Add the updated host to the new config
-		updatedConfig.Hosts[i] = updatedHost
+// excludeEntries removes the entries named in the exclude list of a merged host
+func excludeEntries(host *Host) error {
+	for _, name := range host.Exclude.Application {
+		core := removeNamed(host.Application.Core, name, func(app CoreApp) string { return app.Name })
+		external := removeNamed(host.Application.External, name, func(app ExternalApp) string { return app.Name })
+		if len(core) == len(host.Application.Core) && len(external) == len(host.Application.External) {
+			return fmt.Errorf("host %s excludes undefined application %s", host.Host, name)
+		}
+		host.Application.Core, host.Application.External = core, external
+	}
+	for _, name := range host.Exclude.Configuration {
+		configuration := removeNamed(host.Configuration, name, func(template ConfigurationTemplate) string { return template.Name })
+		if len(configuration) == len(host.Configuration) {
+			return fmt.Errorf("host %s excludes undefined configuration %s", host.Host, name)
+		}
+		host.Configuration = configuration
 	}
+	for _, name := range host.Exclude.Commands {
+		commands := removeNamed(host.Commands, name, func(command Command) string { return command.Name })
+		if len(commands) == len(host.Commands) {
+			return fmt.Errorf("host %s excludes undefined command %s", host.Host, name)
+		}
+		host.Commands = commands
+	}
+	return nil
+}
 
-	// Remove the common section by resetting it to an empty struct
-	updatedConfig.Common = struct {
-		Application   Application             `yaml:"application" json:"application"`
-		Configuration []ConfigurationTemplate `yaml:"configuration" json:"configuration"`
-		Commands      []Command               `yaml:"command" json:"command"`
-	}{}
+// removeNamed returns the entries without the entries with the given name
+func removeNamed[T any](entries []T, name string, entryName func(T) string) []T {
+	var kept []T
+	for _, entry := range entries {
+		if entryName(entry) != name {
+			kept = append(kept, entry)
+		}
+	}
+	return kept
+}
 
+// HostsInGroup returns a copy of a merged configuration restricted to the
+// hosts belonging to a group
+func HostsInGroup(config *Config, group string) (*Config, error) {
+	updatedConfig := *config
+	updatedConfig.Hosts = nil
+	for _, host := range config.Hosts {
+		for _, name := range host.Groups {
+			if name == group {
+				updatedConfig.Hosts = append(updatedConfig.Hosts, host)
+				break
+			}
+		}
+	}
+	if len(updatedConfig.Hosts) == 0 {
+		return nil, fmt.Errorf("no host belongs to group %s", group)
+	}
 	return &updatedConfig, nil
 }
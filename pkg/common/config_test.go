@@ -1,8 +1,14 @@
 package common
 
 import (
+	"fmt"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+
+	"steward/pkg/exec"
 )
 
 func TestLoadConfigYAML(t *testing.T) {
@@ -78,3 +84,752 @@ hosts:
 		t.Errorf("Expected host external application name 'cri-o', got '%s'", config.Hosts[0].Application.External[0].Name)
 	}
 }
+
+func TestLoadConfigPackageState(t *testing.T) {
+	yamlContent := `
+hosts:
+  - host: "192.168.100.14"
+    user: "admin"
+    application:
+      core:
+        - name: "nginx"
+          state: "absent"
+          purge: true
+        - name: "curl"
+          state: "latest"
+        - name: "gpg"
+`
+	tmpFile, err := os.CreateTemp("", "config-*.yaml")
+	if err != nil {
+		t.Fatalf("Failed to create temporary file: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write([]byte(yamlContent)); err != nil {
+		t.Fatalf("Failed to write to temporary file: %v", err)
+	}
+	tmpFile.Close()
+
+	config, err := LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to load YAML config: %v", err)
+	}
+
+	core := config.Hosts[0].Application.Core
+	if core[0].State != StateAbsent || !core[0].Purge {
+		t.Errorf("Expected nginx to be absent and purged, got state '%s' purge %v", core[0].State, core[0].Purge)
+	}
+	if core[1].State != StateLatest {
+		t.Errorf("Expected curl state '%s', got '%s'", StateLatest, core[1].State)
+	}
+	if core[2].State != "" {
+		t.Errorf("Expected gpg state to be empty, got '%s'", core[2].State)
+	}
+}
+
+// writeConfigFile writes a configuration file into dir
+func writeConfigFile(t *testing.T, dir string, name string, content string) string {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write config file %s: %v", name, err)
+	}
+	return path
+}
+
+func TestLoadConfigVars(t *testing.T) {
+	t.Setenv("STEWARD_TEST_PASSWORD", "s3cret")
+
+	path := writeConfigFile(t, t.TempDir(), "config.yaml", `
+vars:
+  k8s_version: "v1.32"
+  k8s_repo: "https://pkgs.k8s.io/core:/stable:/${k8s_version}/deb/"
+  vip: "192.168.100.10"
+  backends:
+    - name: web1
+      address: 192.168.100.14
+common:
+  application:
+    external:
+      - name: kubeadm
+        repo: "${k8s_repo}"
+        gpg_key_url: "${k8s_repo}Release.key"
+  configuration:
+    - name: haproxy
+      template_file: haproxy.tmpl
+      data:
+        vip: "${vip}"
+        backends: "${backends}"
+        literal: "$${vip}"
+hosts:
+  - host: "${vip}"
+    user: admin
+    password: "${env:STEWARD_TEST_PASSWORD}"
+`)
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	external := config.Common.Application.External[0]
+	if external.Repo != "https://pkgs.k8s.io/core:/stable:/v1.32/deb/" {
+		t.Errorf("Unexpected repo '%s'", external.Repo)
+	}
+	if external.GPGKeyURL != "https://pkgs.k8s.io/core:/stable:/v1.32/deb/Release.key" {
+		t.Errorf("Unexpected gpg key url '%s'", external.GPGKeyURL)
+	}
+	if config.Hosts[0].Host != "192.168.100.10" || config.Hosts[0].Password != "s3cret" {
+		t.Errorf("Unexpected host '%s' password '%s'", config.Hosts[0].Host, config.Hosts[0].Password)
+	}
+
+	data := config.Common.Configuration[0].Data.(map[string]interface{})
+	if data["vip"] != "192.168.100.10" {
+		t.Errorf("Unexpected vip '%v'", data["vip"])
+	}
+	if backends, ok := data["backends"].([]interface{}); !ok || len(backends) != 1 {
+		t.Errorf("Expected backends to be the list var, got %#v", data["backends"])
+	}
+	if data["literal"] != "${vip}" {
+		t.Errorf("Expected escaped reference to stay literal, got '%v'", data["literal"])
+	}
+
+	// Editing commands load the file as written
+	raw, err := LoadRawConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to load raw config: %v", err)
+	}
+	if raw.Hosts[0].Password != "${env:STEWARD_TEST_PASSWORD}" {
+		t.Errorf("Expected raw config to keep references, got '%s'", raw.Hosts[0].Password)
+	}
+}
+
+func TestLoadConfigVarsInGroups(t *testing.T) {
+	t.Setenv("STEWARD_TEST_GROUP_TOKEN", "t0ken")
+	path := writeConfigFile(t, t.TempDir(), "config.yaml", `
+vars:
+  k8s: "1.32.0"
+secrets:
+  env:
+    join_token: STEWARD_TEST_GROUP_TOKEN
+groups:
+  workers:
+    application:
+      core:
+        - name: kubelet
+          version: "${k8s}"
+    command:
+      - name: join
+        command: "kubeadm join --token ${secret:join_token}"
+hosts:
+  - host: "192.168.100.10"
+    groups: [workers]
+`)
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	group := config.Groups["workers"]
+	if version := group.Application.Core[0].Version; version != "1.32.0" {
+		t.Errorf("Expected the var in the group to be resolved, got '%s'", version)
+	}
+	if command := group.Commands[0].Command; command != "kubeadm join --token t0ken" {
+		t.Errorf("Expected the secret in the group to be resolved, got '%s'", command)
+	}
+
+	merged, err := MergeCommonToHosts(config)
+	if err != nil {
+		t.Fatalf("MergeCommonToHosts failed: %v", err)
+	}
+	if version := merged.Hosts[0].Application.Core[0].Version; version != "1.32.0" {
+		t.Errorf("Expected the resolved version on the host, got '%s'", version)
+	}
+}
+
+func TestLoadConfigVarsInCommands(t *testing.T) {
+	path := writeConfigFile(t, t.TempDir(), "config.yaml", `
+vars:
+  service: haproxy
+common:
+  configuration:
+    - name: haproxy
+      template_file: haproxy.tmpl
+      validate: "${service} -c -f %s && test -d ${TMPDIR}"
+  command:
+    - name: backup
+      command: "cp /etc/${service}.cfg ${HOME}/backup-$${service}"
+hosts:
+  - host: "192.168.100.10"
+`)
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if command := config.Common.Commands[0].Command; command != "cp /etc/haproxy.cfg ${HOME}/backup-${service}" {
+		t.Errorf("Expected shell variables to be kept, got '%s'", command)
+	}
+	if validate := config.Common.Configuration[0].Validate; validate != "haproxy -c -f %s && test -d ${TMPDIR}" {
+		t.Errorf("Expected shell variables to be kept, got '%s'", validate)
+	}
+}
+
+func TestLoadConfigVarsErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"undefined variable", "hosts:\n  - host: \"${missing}\"\n"},
+		{"unset environment variable", "hosts:\n  - host: \"${env:STEWARD_TEST_UNSET}\"\n"},
+		{"unset environment variable in a command", "common:\n  command:\n    - name: a\n      command: \"echo ${env:STEWARD_TEST_UNSET}\"\n"},
+		{"reference cycle", "vars:\n  a: \"${b}\"\n  b: \"${a}\"\n"},
+		{"list inside a string", "vars:\n  peers: [a, b]\nhosts:\n  - host: \"peers ${peers}\"\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeConfigFile(t, t.TempDir(), "config.yaml", tt.content)
+			if _, err := LoadConfig(path); err == nil {
+				t.Errorf("Expected error")
+			}
+		})
+	}
+}
+
+func TestLoadConfigInclude(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "hosts"), 0755); err != nil {
+		t.Fatalf("Failed to create dir: %v", err)
+	}
+	writeConfigFile(t, dir, "common.yaml", `
+vars:
+  user: admin
+  version: "1.0"
+common:
+  application:
+    core:
+      - name: curl
+`)
+	writeConfigFile(t, filepath.Join(dir, "hosts"), "lb.json", `{
+  "hosts": [{"host": "192.168.100.14", "user": "${user}"}]
+}`)
+	path := writeConfigFile(t, dir, "config.yaml", `
+include:
+  - common.yaml
+  - hosts/lb.json
+vars:
+  version: "2.0"
+common:
+  application:
+    core:
+      - name: nginx
+        version: "${version}"
+hosts:
+  - host: 192.168.100.42
+    user: "${user}"
+`)
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	core := config.Common.Application.Core
+	if len(core) != 2 || core[0].Name != "curl" || core[1].Name != "nginx" {
+		t.Fatalf("Expected included packages first, got %v", core)
+	}
+	if core[1].Version != "2.0" {
+		t.Errorf("Expected vars of the including file to win, got '%s'", core[1].Version)
+	}
+	if len(config.Hosts) != 2 || config.Hosts[0].Host != "192.168.100.14" || config.Hosts[1].Host != "192.168.100.42" {
+		t.Fatalf("Expected hosts in include order, got %v", config.Hosts)
+	}
+	if config.Hosts[0].User != "admin" {
+		t.Errorf("Expected vars to resolve in included files, got '%s'", config.Hosts[0].User)
+	}
+
+	writeConfigFile(t, dir, "loop.yaml", "include:\n  - loop.yaml\n")
+	if _, err := LoadConfig(filepath.Join(dir, "loop.yaml")); err == nil {
+		t.Errorf("Expected error for a config including itself")
+	}
+}
+
+func TestMergeCommonToHostsGroups(t *testing.T) {
+	config := &Config{
+		Common: Group{
+			Application: Application{Core: []CoreApp{{Name: "curl"}, {Name: "containerd", Version: "1.6"}}},
+			Commands:    []Command{{Name: "hostname", Command: "hostname"}},
+		},
+		Groups: map[string]Group{
+			"control-plane": {
+				Application: Application{Core: []CoreApp{{Name: "containerd", Version: "1.7"}, {Name: "kubeadm"}}},
+				Commands:    []Command{{Name: "init", Command: "kubeadm init"}},
+			},
+			"lb": {
+				Application:   Application{Core: []CoreApp{{Name: "haproxy"}, {Name: "containerd", Version: "1.7.2"}}},
+				Configuration: []ConfigurationTemplate{{Name: "haproxy", RemoteFile: "/etc/haproxy/haproxy.cfg"}},
+			},
+		},
+		Hosts: []Host{
+			{Host: "10.0.0.1", Groups: []string{"control-plane", "lb"}, Application: Application{Core: []CoreApp{{Name: "kubeadm", Version: "1.32"}}}},
+			{Host: "10.0.0.2", Groups: []string{"lb"}, Commands: []Command{{Name: "hostname", Command: "hostname -f"}}},
+			{Host: "10.0.0.3"},
+		},
+	}
+
+	merged, err := MergeCommonToHosts(config)
+	if err != nil {
+		t.Fatalf("MergeCommonToHosts failed: %v", err)
+	}
+	if len(merged.Common.Application.Core) != 0 || merged.Groups != nil {
+		t.Errorf("Expected common and groups to be removed after merge")
+	}
+
+	// Common, then groups in order, then the host
+	core := merged.Hosts[0].Application.Core
+	expected := []CoreApp{{Name: "curl"}, {Name: "containerd", Version: "1.7.2"}, {Name: "kubeadm", Version: "1.32"}, {Name: "haproxy"}}
+	if len(core) != len(expected) {
+		t.Fatalf("Expected %d core packages, got %v", len(expected), core)
+	}
+	for i := range expected {
+		if core[i].Name != expected[i].Name || core[i].Version != expected[i].Version {
+			t.Errorf("Expected package %d to be %v, got %v", i, expected[i], core[i])
+		}
+	}
+	commands := merged.Hosts[0].Commands
+	if len(commands) != 2 || commands[0].Name != "hostname" || commands[1].Name != "init" {
+		t.Errorf("Expected common then group commands, got %v", commands)
+	}
+
+	if commands := merged.Hosts[1].Commands; len(commands) != 1 || commands[0].Command != "hostname -f" {
+		t.Errorf("Expected the host command to override the common command, got %v", commands)
+	}
+	if templates := merged.Hosts[1].Configuration; len(templates) != 1 || templates[0].Name != "haproxy" {
+		t.Errorf("Expected the lb template on 10.0.0.2, got %v", templates)
+	}
+	if core := merged.Hosts[2].Application.Core; len(core) != 2 || core[1].Version != "1.6" {
+		t.Errorf("Expected only common packages on 10.0.0.3, got %v", core)
+	}
+
+	// The input config is left untouched
+	if len(config.Hosts[0].Application.Core) != 1 || len(config.Groups["lb"].Application.Core) != 2 {
+		t.Errorf("Expected MergeCommonToHosts not to modify its input")
+	}
+
+	config.Hosts[2].Groups = []string{"workers"}
+	if _, err := MergeCommonToHosts(config); err == nil {
+		t.Errorf("Expected error for an undefined group")
+	}
+}
+
+func TestHostsInGroup(t *testing.T) {
+	config := &Config{Hosts: []Host{
+		{Host: "10.0.0.1", Groups: []string{"control-plane", "lb"}},
+		{Host: "10.0.0.2", Groups: []string{"workers"}},
+		{Host: "10.0.0.3", Groups: []string{"lb"}},
+	}}
+
+	selected, err := HostsInGroup(config, "lb")
+	if err != nil {
+		t.Fatalf("HostsInGroup failed: %v", err)
+	}
+	if len(selected.Hosts) != 2 || selected.Hosts[0].Host != "10.0.0.1" || selected.Hosts[1].Host != "10.0.0.3" {
+		t.Errorf("Expected the lb hosts, got %v", selected.Hosts)
+	}
+	if len(config.Hosts) != 3 {
+		t.Errorf("Expected HostsInGroup not to modify its input")
+	}
+
+	if _, err := HostsInGroup(config, "storage"); err == nil {
+		t.Errorf("Expected error for a group without hosts")
+	}
+}
+
+func TestMergeCommonToHostsFieldOverrides(t *testing.T) {
+	config := &Config{
+		Common: Group{
+			Application: Application{
+				Core: []CoreApp{{Name: "containerd", Manager: "apt", Version: "1.6"}},
+				External: []ExternalApp{{
+					Name:      "kubeadm",
+					GPGKeyURL: "https://pkgs.k8s.io/core:/stable:/v1.32/deb/Release.key",
+					Repo:      "https://pkgs.k8s.io/core:/stable:/v1.32/deb/",
+					Manager:   "apt",
+				}},
+			},
+			Commands: []Command{{Name: "reload", Command: "systemctl reload haproxy", ExpectedOutput: "", Sudo: true}},
+		},
+		Hosts: []Host{{
+			Host: "10.0.0.1",
+			Application: Application{
+				Core:     []CoreApp{{Name: "containerd", Version: "1.7"}},
+				External: []ExternalApp{{Name: "kubeadm", Version: "1.32.0", State: StateLatest}},
+			},
+			Commands: []Command{{Name: "reload", ExpectedOutput: "ok"}},
+		}},
+	}
+
+	merged, err := MergeCommonToHosts(config)
+	if err != nil {
+		t.Fatalf("MergeCommonToHosts failed: %v", err)
+	}
+	host := merged.Hosts[0]
+
+	core := host.Application.Core[0]
+	if core.Manager != "apt" || core.Version != "1.7" {
+		t.Errorf("Expected inherited manager and overridden version, got %+v", core)
+	}
+
+	external := host.Application.External[0]
+	if external.Repo != config.Common.Application.External[0].Repo || external.GPGKeyURL == "" {
+		t.Errorf("Expected inherited repository, got %+v", external)
+	}
+	if external.Version != "1.32.0" || external.State != StateLatest {
+		t.Errorf("Expected overridden version and state, got %+v", external)
+	}
+
+	command := host.Commands[0]
+	if command.Command != "systemctl reload haproxy" || !command.Sudo || command.ExpectedOutput != "ok" {
+		t.Errorf("Expected inherited command with overridden expected output, got %+v", command)
+	}
+}
+
+func TestMergeCommonToHostsExplicitZeroValues(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+	}{
+		{"yaml", "config.yaml", `
+common:
+  application:
+    core:
+      - name: containerd
+        version: "1.6"
+        state: absent
+        purge: true
+  configuration:
+    - name: haproxy
+      template_file: haproxy.tmpl
+      sudo: true
+      backup: true
+  command:
+    - name: reload
+      command: systemctl reload haproxy
+      sudo: true
+hosts:
+  - host: 10.0.0.1
+    application:
+      core:
+        - name: containerd
+          version: ""
+          purge: false
+    configuration:
+      - name: haproxy
+        backup: false
+    command:
+      - name: reload
+        sudo: false
+`},
+		{"json", "config.json", `{
+  "common": {
+    "application": {"core": [{"name": "containerd", "version": "1.6", "state": "absent", "purge": true}]},
+    "configuration": [{"name": "haproxy", "template_file": "haproxy.tmpl", "sudo": true, "backup": true}],
+    "command": [{"name": "reload", "command": "systemctl reload haproxy", "sudo": true}]
+  },
+  "hosts": [{
+    "host": "10.0.0.1",
+    "application": {"core": [{"name": "containerd", "version": "", "purge": false}]},
+    "configuration": [{"name": "haproxy", "backup": false}],
+    "command": [{"name": "reload", "sudo": false}]
+  }]
+}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeConfigFile(t, t.TempDir(), tt.file, tt.content)
+			config, err := LoadConfig(path)
+			if err != nil {
+				t.Fatalf("Failed to load config: %v", err)
+			}
+			merged, err := MergeCommonToHosts(config)
+			if err != nil {
+				t.Fatalf("MergeCommonToHosts failed: %v", err)
+			}
+			host := merged.Hosts[0]
+
+			if core := host.Application.Core[0]; core.Version != "" || core.Purge || core.State != StateAbsent {
+				t.Errorf("Expected cleared version and purge with inherited state, got %+v", core)
+			}
+			if template := host.Configuration[0]; template.Backup || !template.Sudo || template.TemplateFile != "haproxy.tmpl" {
+				t.Errorf("Expected disabled backup with inherited sudo, got %+v", template)
+			}
+			if command := host.Commands[0]; command.Sudo || command.Command != "systemctl reload haproxy" {
+				t.Errorf("Expected disabled sudo with inherited command, got %+v", command)
+			}
+		})
+	}
+}
+
+func TestUpdateConfigFileKeepsInheritedFields(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+	}{
+		{"yaml", "config.yaml", `
+common:
+  configuration:
+    - name: keepalived
+      template_file: keepalived.tmpl
+      output_file: out/keepalived.conf
+      remote_file: /etc/keepalived/keepalived.conf
+      sudo: true
+      data:
+        priority: 100
+hosts:
+  - host: 10.0.0.1
+    configuration:
+      - name: keepalived
+        data:
+          priority: 90
+  - host: 10.0.0.2
+    application:
+      core:
+        - name: containerd
+          purge: false
+`},
+		{"json", "config.json", `{
+  "common": {
+    "configuration": [{"name": "keepalived", "template_file": "keepalived.tmpl", "output_file": "out/keepalived.conf",
+      "remote_file": "/etc/keepalived/keepalived.conf", "sudo": true, "data": {"priority": 100}}]
+  },
+  "hosts": [
+    {"host": "10.0.0.1", "configuration": [{"name": "keepalived", "data": {"priority": 90}}]},
+    {"host": "10.0.0.2", "application": {"core": [{"name": "containerd", "purge": false}]}}
+  ]
+}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := writeConfigFile(t, dir, tt.file, tt.content)
+			raw, err := LoadRawConfig(path)
+			if err != nil {
+				t.Fatalf("Failed to load raw config: %v", err)
+			}
+			if err := UpdateConfigFile(path, raw); err != nil {
+				t.Fatalf("UpdateConfigFile failed: %v", err)
+			}
+
+			// Load the written config like the original file
+			written, err := os.ReadFile(path + ".lock")
+			if err != nil {
+				t.Fatalf("Failed to read written config: %v", err)
+			}
+			if strings.Contains(string(written), "template_file\": \"\"") || strings.Contains(string(written), "template_file: \"\"") {
+				t.Errorf("Expected unset fields to be left out, got %s", written)
+			}
+			config, err := LoadConfig(writeConfigFile(t, t.TempDir(), tt.file, string(written)))
+			if err != nil {
+				t.Fatalf("Failed to load written config: %v", err)
+			}
+			merged, err := MergeCommonToHosts(config)
+			if err != nil {
+				t.Fatalf("MergeCommonToHosts failed: %v", err)
+			}
+
+			template := merged.Hosts[0].Configuration[0]
+			if template.TemplateFile != "keepalived.tmpl" || template.RemoteFile != "/etc/keepalived/keepalived.conf" || !template.Sudo {
+				t.Errorf("Expected inherited template fields, got %+v", template)
+			}
+			if priority := template.Data.(map[string]interface{})["priority"]; fmt.Sprint(priority) != "90" {
+				t.Errorf("Expected overridden priority 90, got %v", priority)
+			}
+			if !strings.Contains(string(written), "purge: false") && !strings.Contains(string(written), `"purge":false`) {
+				t.Errorf("Expected the explicit purge: false to be kept, got %s", written)
+			}
+		})
+	}
+}
+
+func TestMergeCommonToHostsDeepMergesData(t *testing.T) {
+	config := &Config{
+		Common: Group{
+			Configuration: []ConfigurationTemplate{{
+				Name:         "keepalived",
+				TemplateFile: "template/keepalived.tmpl",
+				RemoteFile:   "/etc/keepalived/keepalived.conf",
+				Sudo:         true,
+				Notify:       []string{"reload-keepalived"},
+				Data: map[string]interface{}{
+					"state":     "BACKUP",
+					"priority":  100,
+					"interface": "eth0",
+					"auth":      map[string]interface{}{"type": "PASS", "pass": "secret"},
+					"peers":     []interface{}{"10.0.0.1", "10.0.0.2"},
+				},
+			}},
+		},
+		Groups: map[string]Group{
+			"lb": {Configuration: []ConfigurationTemplate{{
+				Name: "keepalived",
+				Data: map[string]interface{}{"interface": "ens3"},
+			}}},
+		},
+		Hosts: []Host{{
+			Host:   "10.0.0.1",
+			Groups: []string{"lb"},
+			Configuration: []ConfigurationTemplate{{
+				Name: "keepalived",
+				Mode: "0600",
+				Data: map[string]interface{}{
+					"state":    "MASTER",
+					"priority": 150,
+					"auth":     map[string]interface{}{"pass": "other"},
+					"peers":    []interface{}{"10.0.0.2"},
+				},
+			}},
+		}},
+	}
+
+	merged, err := MergeCommonToHosts(config)
+	if err != nil {
+		t.Fatalf("MergeCommonToHosts failed: %v", err)
+	}
+
+	template := merged.Hosts[0].Configuration[0]
+	if template.TemplateFile != "template/keepalived.tmpl" || !template.Sudo || template.Mode != "0600" || len(template.Notify) != 1 {
+		t.Errorf("Expected inherited template fields with overridden mode, got %+v", template)
+	}
+
+	data := template.Data.(map[string]interface{})
+	if data["state"] != "MASTER" || data["priority"] != 150 {
+		t.Errorf("Expected overridden state and priority, got %v", data)
+	}
+	if data["interface"] != "ens3" {
+		t.Errorf("Expected interface from the group, got %v", data["interface"])
+	}
+	auth := data["auth"].(map[string]interface{})
+	if auth["type"] != "PASS" || auth["pass"] != "other" {
+		t.Errorf("Expected nested maps to merge deeply, got %v", auth)
+	}
+	if peers := data["peers"].([]interface{}); len(peers) != 1 || peers[0] != "10.0.0.2" {
+		t.Errorf("Expected lists to be replaced, got %v", peers)
+	}
+
+	// Common data is shared by all hosts and must not be modified by the merge
+	commonData := config.Common.Configuration[0].Data.(map[string]interface{})
+	if commonData["state"] != "BACKUP" || commonData["auth"].(map[string]interface{})["pass"] != "secret" {
+		t.Errorf("Expected common data to be left untouched, got %v", commonData)
+	}
+}
+
+func TestMergeCommonToHostsDataTypes(t *testing.T) {
+	tests := []struct {
+		name     string
+		base     interface{}
+		override interface{}
+		expected interface{}
+	}{
+		{"scalar replaces scalar", "a", "b", "b"},
+		{"map replaces scalar", "a", map[string]interface{}{"k": "v"}, map[string]interface{}{"k": "v"}},
+		{"scalar replaces map", map[string]interface{}{"k": "v"}, "b", "b"},
+		{"unset override inherits", map[string]interface{}{"k": "v"}, nil, map[string]interface{}{"k": "v"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{
+				Common: Group{Configuration: []ConfigurationTemplate{{Name: "motd", Data: tt.base}}},
+				Hosts:  []Host{{Host: "10.0.0.1", Configuration: []ConfigurationTemplate{{Name: "motd", Data: tt.override}}}},
+			}
+			merged, err := MergeCommonToHosts(config)
+			if err != nil {
+				t.Fatalf("MergeCommonToHosts failed: %v", err)
+			}
+			if data := merged.Hosts[0].Configuration[0].Data; !reflect.DeepEqual(data, tt.expected) {
+				t.Errorf("Expected data %v, got %v", tt.expected, data)
+			}
+		})
+	}
+}
+
+func TestMergeCommonToHostsExclude(t *testing.T) {
+	config := &Config{
+		Common: Group{
+			Application: Application{
+				Core:     []CoreApp{{Name: "curl"}, {Name: "nginx"}},
+				External: []ExternalApp{{Name: "docker-ce"}},
+			},
+			Configuration: []ConfigurationTemplate{{Name: "motd"}, {Name: "nginx"}},
+			Commands:      []Command{{Name: "hostname"}, {Name: "reload-nginx"}},
+		},
+		Hosts: []Host{
+			{
+				Host: "10.0.0.1",
+				Exclude: Exclude{
+					Application:   []string{"nginx", "docker-ce"},
+					Configuration: []string{"nginx"},
+					Commands:      []string{"reload-nginx"},
+				},
+			},
+			{Host: "10.0.0.2"},
+		},
+	}
+
+	merged, err := MergeCommonToHosts(config)
+	if err != nil {
+		t.Fatalf("MergeCommonToHosts failed: %v", err)
+	}
+
+	host := merged.Hosts[0]
+	if len(host.Application.Core) != 1 || host.Application.Core[0].Name != "curl" {
+		t.Errorf("Expected only curl, got %v", host.Application.Core)
+	}
+	if len(host.Application.External) != 0 {
+		t.Errorf("Expected external application to be excluded, got %v", host.Application.External)
+	}
+	if len(host.Configuration) != 1 || host.Configuration[0].Name != "motd" {
+		t.Errorf("Expected only motd, got %v", host.Configuration)
+	}
+	if len(host.Commands) != 1 || host.Commands[0].Name != "hostname" {
+		t.Errorf("Expected only hostname, got %v", host.Commands)
+	}
+
+	other := merged.Hosts[1]
+	if len(other.Application.Core) != 2 || len(other.Configuration) != 2 || len(other.Commands) != 2 {
+		t.Errorf("Expected other hosts to keep all entries, got %+v", other)
+	}
+
+	for _, exclude := range []Exclude{
+		{Application: []string{"apache2"}},
+		{Configuration: []string{"haproxy"}},
+		{Commands: []string{"reboot"}},
+	} {
+		config.Hosts[0].Exclude = exclude
+		if _, err := MergeCommonToHosts(config); err == nil {
+			t.Errorf("Expected error for excluding an undefined entry %+v", exclude)
+		}
+	}
+}
+
+func TestHostBecome(t *testing.T) {
+	tests := []struct {
+		name     string
+		host     Host
+		expected exec.Become
+	}{
+		{"sudo with the SSH password", Host{User: "admin", Password: "s3cret"}, exec.Become{User: "root", Password: "s3cret"}},
+		{"become password for key based hosts", Host{User: "admin", SSHKey: "id_ed25519", BecomePassword: "sudo-pass"}, exec.Become{User: "root", Password: "sudo-pass"}},
+		{"su to another user", Host{User: "admin", Password: "s3cret", BecomeMethod: "su", BecomeUser: "postgres", BecomePassword: "pg"}, exec.Become{Method: "su", User: "postgres", Password: "pg"}},
+		{"root runs directly", Host{User: "root", Password: "s3cret", BecomeMethod: "doas"}, exec.Become{Method: "none", User: "root", Password: "s3cret"}},
+	}
+	for _, tt := range tests {
+		if got := tt.host.Become(); got != tt.expected {
+			t.Errorf("%s: expected %+v, got %+v", tt.name, tt.expected, got)
+		}
+	}
+}
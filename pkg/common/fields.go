@@ -0,0 +1,278 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// fieldSet records by index which fields of an entry are written in the
+// config file, so an explicit false or empty value overrides the value of a
+// lower layer when entries are merged
+type fieldSet uint64
+
+// has reports whether the field with index i is written in the config file
+func (s fieldSet) has(i int) bool {
+	return i < 64 && s&(1<<i) != 0
+}
+
+// explicitEntry is an entry which records the fields written in the config file
+type explicitEntry interface {
+	explicitFields() fieldSet
+}
+
+func (a CoreApp) explicitFields() fieldSet               { return a.set }
+func (a ExternalApp) explicitFields() fieldSet           { return a.set }
+func (t ConfigurationTemplate) explicitFields() fieldSet { return t.set }
+func (c Command) explicitFields() fieldSet               { return c.set }
+
+// UnmarshalYAML decodes a core application and records its fields
+func (a *CoreApp) UnmarshalYAML(node *yaml.Node) error {
+	type plain CoreApp
+	if err := node.Decode((*plain)(a)); err != nil {
+		return err
+	}
+	a.set = fieldsOf(reflect.TypeOf(*a), "yaml", yamlKeys(node))
+	return nil
+}
+
+// UnmarshalJSON decodes a core application and records its fields
+func (a *CoreApp) UnmarshalJSON(data []byte) error {
+	type plain CoreApp
+	if err := json.Unmarshal(data, (*plain)(a)); err != nil {
+		return err
+	}
+	keys, err := jsonKeys(data)
+	a.set = fieldsOf(reflect.TypeOf(*a), "json", keys)
+	return err
+}
+
+// UnmarshalYAML decodes an external application and records its fields
+func (a *ExternalApp) UnmarshalYAML(node *yaml.Node) error {
+	type plain ExternalApp
+	if err := node.Decode((*plain)(a)); err != nil {
+		return err
+	}
+	a.set = fieldsOf(reflect.TypeOf(*a), "yaml", yamlKeys(node))
+	return nil
+}
+
+// UnmarshalJSON decodes an external application and records its fields
+func (a *ExternalApp) UnmarshalJSON(data []byte) error {
+	type plain ExternalApp
+	if err := json.Unmarshal(data, (*plain)(a)); err != nil {
+		return err
+	}
+	keys, err := jsonKeys(data)
+	a.set = fieldsOf(reflect.TypeOf(*a), "json", keys)
+	return err
+}
+
+// UnmarshalYAML decodes a configuration template and records its fields
+func (t *ConfigurationTemplate) UnmarshalYAML(node *yaml.Node) error {
+	type plain ConfigurationTemplate
+	if err := node.Decode((*plain)(t)); err != nil {
+		return err
+	}
+	t.set = fieldsOf(reflect.TypeOf(*t), "yaml", yamlKeys(node))
+	return nil
+}
+
+// UnmarshalJSON decodes a configuration template and records its fields
+func (t *ConfigurationTemplate) UnmarshalJSON(data []byte) error {
+	type plain ConfigurationTemplate
+	if err := json.Unmarshal(data, (*plain)(t)); err != nil {
+		return err
+	}
+	keys, err := jsonKeys(data)
+	t.set = fieldsOf(reflect.TypeOf(*t), "json", keys)
+	return err
+}
+
+// UnmarshalYAML decodes a command and records its fields
+func (c *Command) UnmarshalYAML(node *yaml.Node) error {
+	type plain Command
+	if err := node.Decode((*plain)(c)); err != nil {
+		return err
+	}
+	c.set = fieldsOf(reflect.TypeOf(*c), "yaml", yamlKeys(node))
+	return nil
+}
+
+// UnmarshalJSON decodes a command and records its fields
+func (c *Command) UnmarshalJSON(data []byte) error {
+	type plain Command
+	if err := json.Unmarshal(data, (*plain)(c)); err != nil {
+		return err
+	}
+	keys, err := jsonKeys(data)
+	c.set = fieldsOf(reflect.TypeOf(*c), "json", keys)
+	return err
+}
+
+// MarshalYAML encodes the fields of a core application which are written in
+// the config file or set
+func (a CoreApp) MarshalYAML() (interface{}, error) {
+	return marshalFieldsYAML(reflect.ValueOf(a), a.set)
+}
+
+// MarshalJSON encodes the fields of a core application which are written in
+// the config file or set
+func (a CoreApp) MarshalJSON() ([]byte, error) {
+	return marshalFieldsJSON(reflect.ValueOf(a), a.set)
+}
+
+// MarshalYAML encodes the fields of an external application which are written
+// in the config file or set
+func (a ExternalApp) MarshalYAML() (interface{}, error) {
+	return marshalFieldsYAML(reflect.ValueOf(a), a.set)
+}
+
+// MarshalJSON encodes the fields of an external application which are written
+// in the config file or set
+func (a ExternalApp) MarshalJSON() ([]byte, error) {
+	return marshalFieldsJSON(reflect.ValueOf(a), a.set)
+}
+
+// MarshalYAML encodes the fields of a configuration template which are
+// written in the config file or set
+func (t ConfigurationTemplate) MarshalYAML() (interface{}, error) {
+	return marshalFieldsYAML(reflect.ValueOf(t), t.set)
+}
+
+// MarshalJSON encodes the fields of a configuration template which are
+// written in the config file or set
+func (t ConfigurationTemplate) MarshalJSON() ([]byte, error) {
+	return marshalFieldsJSON(reflect.ValueOf(t), t.set)
+}
+
+// MarshalYAML encodes the fields of a command which are written in the config
+// file or set
+func (c Command) MarshalYAML() (interface{}, error) {
+	return marshalFieldsYAML(reflect.ValueOf(c), c.set)
+}
+
+// MarshalJSON encodes the fields of a command which are written in the config
+// file or set
+func (c Command) MarshalJSON() ([]byte, error) {
+	return marshalFieldsJSON(reflect.ValueOf(c), c.set)
+}
+
+// encodedFields calls encode with the tag name and value of the fields of an
+// entry which are written in the config file or not empty. Unset empty fields
+// are left out, so they are inherited again when the file is loaded.
+func encodedFields(v reflect.Value, set fieldSet, tag string, encode func(name string, value interface{}) error) error {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get(tag), ",")
+		if !field.IsExported() || name == "" || name == "-" {
+			continue
+		}
+		if v.Field(i).IsZero() && !set.has(i) {
+			continue
+		}
+		if err := encode(name, v.Field(i).Interface()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// marshalFieldsYAML encodes the written or set fields of an entry as a YAML mapping
+func marshalFieldsYAML(v reflect.Value, set fieldSet) (*yaml.Node, error) {
+	node := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	err := encodedFields(v, set, "yaml", func(name string, value interface{}) error {
+		valueNode := &yaml.Node{}
+		if err := valueNode.Encode(value); err != nil {
+			return err
+		}
+		node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: name}, valueNode)
+		return nil
+	})
+	return node, err
+}
+
+// marshalFieldsJSON encodes the written or set fields of an entry as a JSON object
+func marshalFieldsJSON(v reflect.Value, set fieldSet) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	err := encodedFields(v, set, "json", func(name string, value interface{}) error {
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(name)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(data)
+		return nil
+	})
+	buf.WriteByte('}')
+	return buf.Bytes(), err
+}
+
+// fieldsOf returns the fields of a struct type whose tag names are among keys
+func fieldsOf(t reflect.Type, tag string, keys []string) fieldSet {
+	var set fieldSet
+	for i := 0; i < t.NumField() && i < 64; i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get(tag), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		for _, key := range keys {
+			if key == name {
+				set |= 1 << i
+				break
+			}
+		}
+	}
+	return set
+}
+
+// yamlKeys returns the keys of a YAML mapping, including the keys merged with <<
+func yamlKeys(node *yaml.Node) []string {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	var keys []string
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if key.Tag == "!!merge" {
+			if value.Kind == yaml.SequenceNode {
+				for _, merged := range value.Content {
+					keys = append(keys, yamlKeys(merged)...)
+				}
+			} else {
+				keys = append(keys, yamlKeys(value)...)
+			}
+			continue
+		}
+		keys = append(keys, key.Value)
+	}
+	return keys
+}
+
+// jsonKeys returns the keys of a JSON object
+func jsonKeys(data []byte) ([]string, error) {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
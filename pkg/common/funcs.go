@@ -0,0 +1,187 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"text/template"
+
+	"steward/pkg/exec"
+
+	"gopkg.in/yaml.v3"
+)
+
+// TemplateFuncs returns the functions available in configuration templates.
+// Names and argument order follow sprig, so the value is always the last
+// argument and functions can be used in pipelines like {{ .port | default 80 }}.
+func TemplateFuncs() template.FuncMap {
+	return template.FuncMap{
+		// Defaults and checks
+		"default":  defaultValue,
+		"empty":    empty,
+		"coalesce": coalesce,
+		"required": required,
+		"get":      get,
+		"hasKey":   hasKey,
+
+		// Strings
+		"upper":      strings.ToUpper,
+		"lower":      strings.ToLower,
+		"trim":       strings.TrimSpace,
+		"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+		"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+		"replace":    func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+		"contains":   func(substr, s string) bool { return strings.Contains(s, substr) },
+		"hasPrefix":  func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+		"hasSuffix":  func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+		"quote":      func(v interface{}) string { return fmt.Sprintf("%q", toString(v)) },
+		"squote":     func(v interface{}) string { return exec.ShellQuote(toString(v)) },
+		"indent":     indent,
+		"nindent":    func(spaces int, s string) string { return "\n" + indent(spaces, s) },
+
+		// Lists
+		"join":  join,
+		"split": func(sep, s string) []string { return strings.Split(s, sep) },
+		"list":  func(values ...interface{}) []interface{} { return values },
+
+		// Encoding
+		"toYaml":    toYaml,
+		"toJson":    toJson,
+		"b64enc":    func(v interface{}) string { return base64.StdEncoding.EncodeToString([]byte(toString(v))) },
+		"b64dec":    b64dec,
+		"sha256sum": func(v interface{}) string { return sha256Hex(toString(v)) },
+	}
+}
+
+// defaultValue returns value, or def when value is empty
+func defaultValue(def interface{}, value ...interface{}) interface{} {
+	if len(value) == 0 || empty(value[0]) {
+		return def
+	}
+	return value[0]
+}
+
+// empty reports whether a value is nil, zero or has no elements
+func empty(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	default:
+		return v.IsZero()
+	}
+}
+
+// coalesce returns the first value which is not empty
+func coalesce(values ...interface{}) interface{} {
+	for _, value := range values {
+		if !empty(value) {
+			return value
+		}
+	}
+	return nil
+}
+
+// required fails rendering with message when value is empty
+func required(message string, value interface{}) (interface{}, error) {
+	if empty(value) {
+		return nil, errors.New(message)
+	}
+	return value, nil
+}
+
+// get returns the value of a map key, or nil when the key is missing. Unlike
+// .key it does not fail on missing keys, so optional keys can have a default.
+func get(m interface{}, key string) interface{} {
+	v := reflect.ValueOf(m)
+	if v.Kind() != reflect.Map || v.Type().Key().Kind() != reflect.String {
+		return nil
+	}
+	value := v.MapIndex(reflect.ValueOf(key).Convert(v.Type().Key()))
+	if !value.IsValid() {
+		return nil
+	}
+	return value.Interface()
+}
+
+// hasKey reports whether a map has a key
+func hasKey(m interface{}, key string) bool {
+	v := reflect.ValueOf(m)
+	if v.Kind() != reflect.Map || v.Type().Key().Kind() != reflect.String {
+		return false
+	}
+	return v.MapIndex(reflect.ValueOf(key).Convert(v.Type().Key())).IsValid()
+}
+
+// indent prefixes every line of s with the given number of spaces
+func indent(spaces int, s string) string {
+	pad := strings.Repeat(" ", spaces)
+	return pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+}
+
+// join joins the elements of a list with sep, elements are formatted with fmt
+func join(sep string, list interface{}) (string, error) {
+	v := reflect.ValueOf(list)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return "", fmt.Errorf("join: expected a list, got %T", list)
+	}
+	parts := make([]string, v.Len())
+	for i := range parts {
+		parts[i] = toString(v.Index(i).Interface())
+	}
+	return strings.Join(parts, sep), nil
+}
+
+// toYaml encodes a value as YAML without the trailing newline
+func toYaml(value interface{}) (string, error) {
+	data, err := yaml.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(data), "\n"), nil
+}
+
+// toJson encodes a value as compact JSON
+func toJson(value interface{}) (string, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// b64dec decodes a standard base64 string
+func b64dec(s string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// sha256Hex returns the hex encoded SHA-256 of a string
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// toString formats a value for string functions, nil is the empty string
+func toString(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	if s, ok := value.(string); ok {
+		return s
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,129 @@
+package common
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+// renderString renders a template string with the template functions
+func renderString(text string, data interface{}) (string, error) {
+	tmpl, err := template.New("test").Funcs(TemplateFuncs()).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		return "", err
+	}
+	return rendered.String(), nil
+}
+
+func TestTemplateFuncs(t *testing.T) {
+	data := map[string]interface{}{
+		"name":    "haproxy",
+		"empty":   "",
+		"port":    6443,
+		"zero":    0,
+		"peers":   []interface{}{"10.0.0.1", "10.0.0.2"},
+		"labels":  map[string]interface{}{"tier": "control-plane"},
+		"encoded": "aGFwcm94eQ==",
+	}
+
+	tests := []struct {
+		name     string
+		template string
+		expected string
+	}{
+		{"default on empty", `{{ .empty | default "none" }}`, "none"},
+		{"default keeps value", `{{ .name | default "none" }}`, "haproxy"},
+		{"default on zero", `{{ .zero | default 8080 }}`, "8080"},
+		{"default with get on missing key", `{{ get . "missing" | default "fallback" }}`, "fallback"},
+		{"hasKey", `{{ hasKey . "name" }} {{ hasKey . "missing" }}`, "true false"},
+		{"empty", `{{ empty .empty }} {{ empty .peers }}`, "true false"},
+		{"coalesce", `{{ coalesce .empty .zero .name }}`, "haproxy"},
+		{"required passes", `{{ required "name is required" .name }}`, "haproxy"},
+		{"upper", `{{ .name | upper }}`, "HAPROXY"},
+		{"lower", `{{ "HAProxy" | lower }}`, "haproxy"},
+		{"trim", `{{ "  x  " | trim }}`, "x"},
+		{"trimPrefix", `{{ "v1.32" | trimPrefix "v" }}`, "1.32"},
+		{"trimSuffix", `{{ "kubelet.conf" | trimSuffix ".conf" }}`, "kubelet"},
+		{"replace", `{{ "a-b-c" | replace "-" "." }}`, "a.b.c"},
+		{"contains", `{{ .name | contains "prox" }}`, "true"},
+		{"hasPrefix", `{{ .name | hasPrefix "ha" }}`, "true"},
+		{"hasSuffix", `{{ .name | hasSuffix "ha" }}`, "false"},
+		{"quote", `{{ .port | quote }} {{ .name | squote }}`, `"6443" 'haproxy'`},
+		{"squote escapes quotes", `{{ "it's" | squote }}`, `'it'\''s'`},
+		{"join", `{{ .peers | join "," }}`, "10.0.0.1,10.0.0.2"},
+		{"split", `{{ index (split "," "a,b") 1 }}`, "b"},
+		{"list", `{{ list 1 "a" | join "-" }}`, "1-a"},
+		{"indent", `{{ "a\nb" | indent 2 }}`, "  a\n  b"},
+		{"nindent", `x:{{ "a" | nindent 4 }}`, "x:\n    a"},
+		{"toYaml", `{{ .labels | toYaml }}`, "tier: control-plane"},
+		{"toJson", `{{ .peers | toJson }}`, `["10.0.0.1","10.0.0.2"]`},
+		{"b64enc", `{{ .name | b64enc }}`, "aGFwcm94eQ=="},
+		{"b64dec", `{{ .encoded | b64dec }}`, "haproxy"},
+		{"sha256sum", `{{ "" | sha256sum }}`, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rendered, err := renderString(tt.template, data)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if rendered != tt.expected {
+				t.Errorf("Expected '%s', got '%s'", tt.expected, rendered)
+			}
+		})
+	}
+}
+
+func TestTemplateFuncsErrors(t *testing.T) {
+	data := map[string]interface{}{"empty": "", "name": "haproxy"}
+
+	tests := []struct {
+		name     string
+		template string
+		contains string
+	}{
+		{"required on empty", `{{ required "virtual_ip is required" .empty }}`, "virtual_ip is required"},
+		{"missing key", `{{ .nmae }}`, `map has no entry for key "nmae"`},
+		{"join on non list", `{{ .name | join "," }}`, "expected a list"},
+		{"b64dec invalid", `{{ "%%%" | b64dec }}`, "illegal base64"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := renderString(tt.template, data)
+			if err == nil {
+				t.Fatalf("Expected error containing '%s'", tt.contains)
+			}
+			if !strings.Contains(err.Error(), tt.contains) {
+				t.Errorf("Expected error containing '%s', got '%v'", tt.contains, err)
+			}
+		})
+	}
+}
+
+func TestRenderTemplateMissingKey(t *testing.T) {
+	templateFile := filepath.Join(t.TempDir(), "kubelet_template")
+	if err := os.WriteFile(templateFile, []byte("KUBELET_EXTRA_ARGS=--node-ip={{ .ip }}"), 0644); err != nil {
+		t.Fatalf("Failed to create template file: %v", err)
+	}
+
+	if _, err := RenderTemplate(templateFile, map[string]interface{}{"ipp": "10.0.0.1"}); err == nil {
+		t.Errorf("Expected error for a missing key")
+	}
+
+	rendered, err := RenderTemplate(templateFile, map[string]interface{}{"ip": "10.0.0.1"})
+	if err != nil {
+		t.Fatalf("RenderTemplate failed: %v", err)
+	}
+	if string(rendered) != "KUBELET_EXTRA_ARGS=--node-ip=10.0.0.1" {
+		t.Errorf("Unexpected rendered template '%s'", string(rendered))
+	}
+}
@@ -1,6 +1,7 @@
 package common
 
 import (
+	"bytes"
 	"encoding/json"
 	"io/ioutil"
 	"os"
@@ -17,11 +18,7 @@ var logger = utils.SetupLogging(false)
 func GenerateStewardConfig(configPath string) error {
 	// Define the configuration structure
 	config := Config{
-		Common: struct {
-			Application   Application             `yaml:"application" json:"application"`
-			Configuration []ConfigurationTemplate `yaml:"configuration" json:"configuration"`
-			Commands      []Command               `yaml:"command" json:"command"`
-		}{
+		Common: Group{
 			Application: Application{
 				Core: []CoreApp{
 					{
@@ -54,7 +51,7 @@ func GenerateStewardConfig(configPath string) error {
 						Version:   "",
 					},
 					{
-						Name:      "kubernetes",
+						Name:      "kubelet",
 						GPGKeyURL: "https://pkgs.k8s.io/core:/stable:/v1.32/deb/Release.key",
 						Repo:      "https://pkgs.k8s.io/core:/stable:/v1.32/deb/",
 						Manager:   "apt",
@@ -169,33 +166,46 @@ func GenerateStewardConfig(configPath string) error {
 // GenerateConfig generates a configuration file based on the provided template and data
 func GenerateConfig(templatePath string, outputPath string, data interface{}) error {
 
-	// Read the template file
-	templateData, err := ioutil.ReadFile(templatePath)
+	// Render the template
+	rendered, err := RenderTemplate(templatePath, data)
 	if err != nil {
 		return err
 	}
 
-	// Parse the template
-	tmpl, err := template.New("config").Parse(string(templateData))
+	// Create the output file, per-host output files live in their own directory
+	if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+		return err
+	}
+	err = os.WriteFile(outputPath, rendered, 0644)
 	if err != nil {
 		return err
 	}
 
-	// Create the output file
-	file, err := os.Create(outputPath)
+	logger.Infof("Config file generated at: %s", outputPath) // Corrected log format
+	return nil
+}
+
+// RenderTemplate renders a template file with the provided data into memory
+func RenderTemplate(templatePath string, data interface{}) ([]byte, error) {
+	// Read the template file
+	templateData, err := ioutil.ReadFile(templatePath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse the template, missing keys fail rendering instead of rendering "<no value>"
+	tmpl, err := template.New(filepath.Base(templatePath)).Funcs(TemplateFuncs()).Option("missingkey=error").Parse(string(templateData))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer file.Close()
 
 	// Execute the template with the provided data
-	err = tmpl.Execute(file, data)
+	var rendered bytes.Buffer
+	err = tmpl.Execute(&rendered, data)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	logger.Infof("Config file generated at: %s", outputPath) // Corrected log format
-	return nil
+	return rendered.Bytes(), nil
 }
 
 func writeYAMLFile(filePath string, data interface{}) error {
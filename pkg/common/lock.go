@@ -0,0 +1,160 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// LockFileName is the name of the lockfile written next to the configuration file
+const LockFileName = "steward.lock"
+
+// lockFileVersion is the version of the lockfile format. Version 1 keyed
+// packages by name alone.
+const lockFileVersion = 2
+
+// LockFile records what apply resolved on each host, like go.sum or package-lock.json.
+// It is written by steward and is never merged into the user authored configuration.
+type LockFile struct {
+	Version int                  `yaml:"version" json:"version"`
+	Hosts   map[string]*HostLock `yaml:"hosts" json:"hosts"`
+}
+
+// HostLock records the resolved packages and rendered templates of a host.
+// Packages are keyed by manager and name, like apt/firefox, as the same name
+// can be installed through several managers.
+type HostLock struct {
+	Packages  map[string]PackageLock  `yaml:"packages,omitempty" json:"packages,omitempty"`
+	Templates map[string]TemplateLock `yaml:"templates,omitempty" json:"templates,omitempty"`
+}
+
+// PackageLock records the resolved version and origin of an installed package
+type PackageLock struct {
+	Manager        string `yaml:"manager" json:"manager"`
+	Version        string `yaml:"version" json:"version"`
+	Repo           string `yaml:"repo,omitempty" json:"repo,omitempty"`
+	KeyFingerprint string `yaml:"key_fingerprint,omitempty" json:"key_fingerprint,omitempty"`
+}
+
+// TemplateLock records the hash of a rendered configuration template
+type TemplateLock struct {
+	RemoteFile string `yaml:"remote_file" json:"remote_file"`
+	SHA256     string `yaml:"sha256" json:"sha256"`
+}
+
+// NewLockFile creates an empty lockfile
+func NewLockFile() *LockFile {
+	return &LockFile{Version: lockFileVersion, Hosts: make(map[string]*HostLock)}
+}
+
+// NewHostLock creates an empty lock of a host
+func NewHostLock() *HostLock {
+	return &HostLock{
+		Packages:  make(map[string]PackageLock),
+		Templates: make(map[string]TemplateLock),
+	}
+}
+
+// LockFilePath returns the path of the lockfile belonging to a configuration file
+func LockFilePath(configPath string) string {
+	return filepath.Join(filepath.Dir(configPath), LockFileName)
+}
+
+// LoadLockFile loads a lockfile. A missing lockfile is returned as an empty lockfile.
+func LoadLockFile(filePath string) (*LockFile, error) {
+	data, err := os.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return NewLockFile(), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lockfile: %w", err)
+	}
+
+	lock := NewLockFile()
+	if err := yaml.Unmarshal(data, lock); err != nil {
+		return nil, fmt.Errorf("failed to parse lockfile: %w", err)
+	}
+	if lock.Version > lockFileVersion {
+		return nil, fmt.Errorf("unsupported lockfile version %d", lock.Version)
+	}
+	if lock.Hosts == nil {
+		lock.Hosts = make(map[string]*HostLock)
+	}
+	if lock.Version < 2 {
+		for _, hostLock := range lock.Hosts {
+			hostLock.keyPackagesByManager()
+		}
+	}
+	return lock, nil
+}
+
+// keyPackagesByManager rekeys the packages of a version 1 lockfile, which are
+// keyed by name alone
+func (h *HostLock) keyPackagesByManager() {
+	packages := make(map[string]PackageLock, len(h.Packages))
+	for name, pkg := range h.Packages {
+		packages[PackageLockKey(pkg.Manager, name)] = pkg
+	}
+	h.Packages = packages
+}
+
+// WriteLockFile writes the lockfile, hosts and packages are sorted by name
+func WriteLockFile(filePath string, lock *LockFile) error {
+	lock.Version = lockFileVersion
+	return writeYAMLFile(filePath, lock)
+}
+
+// Host returns the lock of a host, or nil when the host is not locked
+func (l *LockFile) Host(host string) *HostLock {
+	if l == nil {
+		return nil
+	}
+	return l.Hosts[host]
+}
+
+// SetHost replaces the lock of a host
+func (l *LockFile) SetHost(host string, hostLock *HostLock) {
+	l.Hosts[host] = hostLock
+}
+
+// PackageLockKey returns the key of a package in the lock of a host
+func PackageLockKey(manager string, name string) string {
+	return manager + "/" + name
+}
+
+// SetPackage records the resolved version of a package installed with pkg.Manager
+func (h *HostLock) SetPackage(name string, pkg PackageLock) {
+	h.Packages[PackageLockKey(pkg.Manager, name)] = pkg
+}
+
+// LockedVersion returns the version a package was locked to on a host with the given manager
+func (h *HostLock) LockedVersion(name string, manager string) (string, bool) {
+	if h == nil {
+		return "", false
+	}
+	pkg, ok := h.Packages[PackageLockKey(manager, name)]
+	if !ok || pkg.Version == "" {
+		return "", false
+	}
+	return pkg.Version, true
+}
+
+// HashFile returns the hex encoded SHA-256 of a local file
+func HashFile(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
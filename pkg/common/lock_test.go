@@ -0,0 +1,112 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadLockFileMissing(t *testing.T) {
+	lock, err := LoadLockFile(filepath.Join(t.TempDir(), LockFileName))
+	if err != nil {
+		t.Fatalf("Expected a missing lockfile to load, got error: %v", err)
+	}
+	if len(lock.Hosts) != 0 {
+		t.Errorf("Expected an empty lockfile, got %d hosts", len(lock.Hosts))
+	}
+}
+
+func TestWriteAndLoadLockFile(t *testing.T) {
+	lockPath := filepath.Join(t.TempDir(), LockFileName)
+
+	lock := NewLockFile()
+	hostLock := NewHostLock()
+	hostLock.SetPackage("kubeadm", PackageLock{
+		Manager:        "apt",
+		Version:        "1.32.0-1.1",
+		Repo:           "https://pkgs.k8s.io/core:/stable:/v1.32/deb/",
+		KeyFingerprint: "DE15B14486CD377B9E876E1A234654DA9A296436",
+	})
+	hostLock.SetPackage("firefox", PackageLock{Manager: "apt", Version: "128.0-1"})
+	hostLock.SetPackage("firefox", PackageLock{Manager: "snap", Version: "latest/stable"})
+	hostLock.Templates["haproxy"] = TemplateLock{RemoteFile: "/etc/haproxy/haproxy.cfg", SHA256: "abc"}
+	lock.SetHost("192.168.100.14", hostLock)
+
+	if err := WriteLockFile(lockPath, lock); err != nil {
+		t.Fatalf("Failed to write lockfile: %v", err)
+	}
+
+	// Passwords and the configuration itself must never end up in the lockfile
+	data, err := os.ReadFile(lockPath)
+	if err != nil {
+		t.Fatalf("Failed to read lockfile: %v", err)
+	}
+	if strings.Contains(string(data), "password") {
+		t.Errorf("Lockfile should not contain passwords:\n%s", data)
+	}
+
+	loaded, err := LoadLockFile(lockPath)
+	if err != nil {
+		t.Fatalf("Failed to load lockfile: %v", err)
+	}
+
+	version, ok := loaded.Host("192.168.100.14").LockedVersion("kubeadm", "apt")
+	if !ok || version != "1.32.0-1.1" {
+		t.Errorf("Expected locked version '1.32.0-1.1', got '%s' (%v)", version, ok)
+	}
+	if _, ok := loaded.Host("192.168.100.14").LockedVersion("kubeadm", "snap"); ok {
+		t.Errorf("Expected no locked version for a different manager")
+	}
+	if _, ok := loaded.Host("192.168.100.42").LockedVersion("kubeadm", "apt"); ok {
+		t.Errorf("Expected no locked version for an unknown host")
+	}
+	for manager, expected := range map[string]string{"apt": "128.0-1", "snap": "latest/stable"} {
+		if version, ok := loaded.Host("192.168.100.14").LockedVersion("firefox", manager); !ok || version != expected {
+			t.Errorf("Expected firefox locked to '%s' with %s, got '%s' (%v)", expected, manager, version, ok)
+		}
+	}
+	if loaded.Host("192.168.100.14").Templates["haproxy"].SHA256 != "abc" {
+		t.Errorf("Expected template hash 'abc', got '%s'", loaded.Host("192.168.100.14").Templates["haproxy"].SHA256)
+	}
+}
+
+func TestLoadLockFileVersion1(t *testing.T) {
+	lockPath := filepath.Join(t.TempDir(), LockFileName)
+	content := `version: 1
+hosts:
+  192.168.100.14:
+    packages:
+      kubeadm:
+        manager: apt
+        version: 1.32.0-1.1
+`
+	if err := os.WriteFile(lockPath, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write lockfile: %v", err)
+	}
+
+	lock, err := LoadLockFile(lockPath)
+	if err != nil {
+		t.Fatalf("Failed to load lockfile: %v", err)
+	}
+	version, ok := lock.Host("192.168.100.14").LockedVersion("kubeadm", "apt")
+	if !ok || version != "1.32.0-1.1" {
+		t.Errorf("Expected the version 1 lock to be keyed by manager, got '%s' (%v)", version, ok)
+	}
+}
+
+func TestHashFile(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "file.txt")
+	if err := os.WriteFile(filePath, []byte("hello\n"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	hash, err := HashFile(filePath)
+	if err != nil {
+		t.Fatalf("Failed to hash file: %v", err)
+	}
+	expected := "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03"
+	if hash != expected {
+		t.Errorf("Expected hash '%s', got '%s'", expected, hash)
+	}
+}
@@ -0,0 +1,295 @@
+package common
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"steward/utils"
+
+	"golang.org/x/crypto/scrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// secretPrefix marks references to secrets, like ${secret:lb1}
+const secretPrefix = "secret:"
+
+// SecretsPassphraseEnv is the environment variable holding the passphrase of
+// the secrets file when no passphrase_command is configured
+const SecretsPassphraseEnv = "STEWARD_SECRETS_PASSPHRASE"
+
+// secretsFileHeader is the first line of an encrypted secrets file, it is
+// authenticated with the encrypted secrets
+const secretsFileHeader = "steward-secrets v1"
+
+// scrypt parameters deriving the secrets file key from the passphrase
+const (
+	scryptN       = 1 << 15
+	scryptR       = 8
+	scryptP       = 1
+	secretsKeyLen = 32
+	saltLen       = 16
+)
+
+// Secrets configures where ${secret:name} references are resolved from. A name
+// is looked up in command, then env, then the encrypted secrets file.
+type Secrets struct {
+	// File is the encrypted secrets file written by steward secret set, relative to the config file
+	File string `yaml:"file,omitempty" json:"file,omitempty"`
+	// PassphraseCommand prints the passphrase of the secrets file, STEWARD_SECRETS_PASSPHRASE is used when empty
+	PassphraseCommand string `yaml:"passphrase_command,omitempty" json:"passphrase_command,omitempty"`
+	// Env maps secret names to the environment variables holding them
+	Env map[string]string `yaml:"env,omitempty" json:"env,omitempty"`
+	// Command maps secret names to local commands printing them
+	Command map[string]string `yaml:"command,omitempty" json:"command,omitempty"`
+}
+
+// mergeSecrets merges the secrets section of src over the one of dst. The
+// file and passphrase command of src replace those of dst, names are merged.
+func mergeSecrets(dst Secrets, src Secrets) Secrets {
+	if src.File != "" {
+		dst.File = src.File
+	}
+	if src.PassphraseCommand != "" {
+		dst.PassphraseCommand = src.PassphraseCommand
+	}
+	dst.Env = mergeStrings(dst.Env, src.Env)
+	dst.Command = mergeStrings(dst.Command, src.Command)
+	return dst
+}
+
+// mergeStrings returns the entries of dst overridden by the entries of src
+func mergeStrings(dst map[string]string, src map[string]string) map[string]string {
+	if len(src) == 0 {
+		return dst
+	}
+	merged := make(map[string]string, len(dst)+len(src))
+	for name, value := range dst {
+		merged[name] = value
+	}
+	for name, value := range src {
+		merged[name] = value
+	}
+	return merged
+}
+
+// secretStore resolves secrets, the secrets file is decrypted once when the
+// first secret is looked up in it
+type secretStore struct {
+	config Secrets
+	file   map[string]string
+}
+
+// newSecretStore creates a secret store for the secrets section of a configuration
+func newSecretStore(config Secrets) *secretStore {
+	return &secretStore{config: config}
+}
+
+// lookup returns the value of a secret and redacts it from all logs. Errors
+// never include secret values.
+func (s *secretStore) lookup(name string) (string, error) {
+	value, err := s.resolve(name)
+	if err != nil {
+		return "", fmt.Errorf("secret %s: %w", name, err)
+	}
+	utils.RegisterSecret(value)
+	return value, nil
+}
+
+func (s *secretStore) resolve(name string) (string, error) {
+	if command, ok := s.config.Command[name]; ok {
+		return runSecretCommand(command)
+	}
+	if envName, ok := s.config.Env[name]; ok {
+		value, ok := os.LookupEnv(envName)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", envName)
+		}
+		return value, nil
+	}
+	if s.config.File == "" {
+		return "", fmt.Errorf("undefined secret, configure it in the secrets section")
+	}
+
+	if s.file == nil {
+		passphrase, err := SecretsPassphrase(s.config)
+		if err != nil {
+			return "", err
+		}
+		s.file, err = LoadSecretsFile(s.config.File, passphrase)
+		if err != nil {
+			return "", err
+		}
+	}
+	value, ok := s.file[name]
+	if !ok {
+		return "", fmt.Errorf("not found in %s", s.config.File)
+	}
+	return value, nil
+}
+
+// runSecretCommand runs a local command printing a secret. A trailing newline
+// is not part of the secret.
+func runSecretCommand(command string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("command %q failed: %v: %s", command, err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimRight(string(output), "\r\n"), nil
+}
+
+// SecretsPassphrase returns the passphrase of the secrets file from the
+// passphrase command, or from STEWARD_SECRETS_PASSPHRASE
+func SecretsPassphrase(config Secrets) (string, error) {
+	var passphrase string
+	if config.PassphraseCommand != "" {
+		output, err := runSecretCommand(config.PassphraseCommand)
+		if err != nil {
+			return "", fmt.Errorf("failed to get the secrets passphrase: %w", err)
+		}
+		passphrase = output
+	} else {
+		passphrase = os.Getenv(SecretsPassphraseEnv)
+	}
+	if passphrase == "" {
+		return "", fmt.Errorf("no passphrase for secrets file %s, set %s or secrets.passphrase_command", config.File, SecretsPassphraseEnv)
+	}
+	utils.RegisterSecret(passphrase)
+	return passphrase, nil
+}
+
+// LoadSecretsConfig returns the secrets section of a configuration file merged
+// with its includes, without resolving any reference
+func LoadSecretsConfig(filePath string) (Secrets, error) {
+	config, err := loadConfigWithIncludes(filePath, nil)
+	if err != nil {
+		return Secrets{}, err
+	}
+	return config.Secrets, nil
+}
+
+// LoadSecretsFile decrypts a secrets file. A missing file holds no secrets.
+func LoadSecretsFile(filePath string, passphrase string) (map[string]string, error) {
+	data, err := os.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secrets file: %w", err)
+	}
+	secrets, err := DecryptSecrets(data, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt secrets file %s: %w", filePath, err)
+	}
+	for _, value := range secrets {
+		utils.RegisterSecret(value)
+	}
+	return secrets, nil
+}
+
+// WriteSecretsFile encrypts secrets to a file readable only by its owner. The
+// file is replaced atomically, so a failed write keeps the previous secrets.
+func WriteSecretsFile(filePath string, secrets map[string]string, passphrase string) error {
+	data, err := EncryptSecrets(secrets, passphrase)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), "."+filepath.Base(filePath)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write secrets file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write secrets file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write secrets file: %w", err)
+	}
+	return os.Rename(tmp.Name(), filePath)
+}
+
+// EncryptSecrets encrypts secrets with AES-256-GCM and a key derived from the
+// passphrase with scrypt
+func EncryptSecrets(secrets map[string]string, passphrase string) ([]byte, error) {
+	plaintext, err := yaml.Marshal(secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	gcm, err := secretsCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	sealed := append(salt, nonce...)
+	sealed = gcm.Seal(sealed, nonce, plaintext, []byte(secretsFileHeader))
+	return []byte(secretsFileHeader + "\n" + base64.StdEncoding.EncodeToString(sealed) + "\n"), nil
+}
+
+// DecryptSecrets decrypts secrets encrypted with EncryptSecrets
+func DecryptSecrets(data []byte, passphrase string) (map[string]string, error) {
+	header, encoded, _ := strings.Cut(string(data), "\n")
+	if header != secretsFileHeader {
+		return nil, fmt.Errorf("not a steward secrets file")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("corrupt secrets file: %w", err)
+	}
+	if len(sealed) < saltLen {
+		return nil, fmt.Errorf("corrupt secrets file")
+	}
+
+	salt := sealed[:saltLen]
+	gcm, err := secretsCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < saltLen+gcm.NonceSize() {
+		return nil, fmt.Errorf("corrupt secrets file")
+	}
+	nonce := sealed[saltLen : saltLen+gcm.NonceSize()]
+	plaintext, err := gcm.Open(nil, nonce, sealed[saltLen+gcm.NonceSize():], []byte(secretsFileHeader))
+	if err != nil {
+		return nil, fmt.Errorf("wrong passphrase or corrupt secrets file")
+	}
+
+	secrets := make(map[string]string)
+	if err := yaml.Unmarshal(plaintext, &secrets); err != nil {
+		return nil, fmt.Errorf("corrupt secrets file: %w", err)
+	}
+	return secrets, nil
+}
+
+// secretsCipher derives the key of the secrets file from the passphrase and salt
+func secretsCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, secretsKeyLen)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
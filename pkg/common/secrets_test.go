@@ -0,0 +1,149 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEncryptDecryptSecrets(t *testing.T) {
+	secrets := map[string]string{"lb1": "s3cret", "lb2": "with\nnewline"}
+
+	data, err := EncryptSecrets(secrets, "passphrase")
+	if err != nil {
+		t.Fatalf("Failed to encrypt secrets: %v", err)
+	}
+	if strings.Contains(string(data), "s3cret") {
+		t.Errorf("Expected encrypted secrets, got %s", data)
+	}
+
+	decrypted, err := DecryptSecrets(data, "passphrase")
+	if err != nil {
+		t.Fatalf("Failed to decrypt secrets: %v", err)
+	}
+	if len(decrypted) != 2 || decrypted["lb1"] != "s3cret" || decrypted["lb2"] != "with\nnewline" {
+		t.Errorf("Expected %v, got %v", secrets, decrypted)
+	}
+
+	if _, err := DecryptSecrets(data, "wrong"); err == nil {
+		t.Errorf("Expected error for a wrong passphrase")
+	}
+	tampered := []byte(strings.Replace(string(data), "v1", "v2", 1))
+	if _, err := DecryptSecrets(tampered, "passphrase"); err == nil {
+		t.Errorf("Expected error for a tampered header")
+	}
+}
+
+func TestWriteSecretsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.enc")
+
+	secrets, err := LoadSecretsFile(path, "passphrase")
+	if err != nil || len(secrets) != 0 {
+		t.Fatalf("Expected no secrets for a missing file, got %v, %v", secrets, err)
+	}
+
+	if err := WriteSecretsFile(path, map[string]string{"lb1": "s3cret"}, "passphrase"); err != nil {
+		t.Fatalf("Failed to write secrets file: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Failed to stat secrets file: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected mode 0600, got %o", info.Mode().Perm())
+	}
+
+	secrets, err = LoadSecretsFile(path, "passphrase")
+	if err != nil {
+		t.Fatalf("Failed to load secrets file: %v", err)
+	}
+	if secrets["lb1"] != "s3cret" {
+		t.Errorf("Expected secret s3cret, got %q", secrets["lb1"])
+	}
+}
+
+func TestLoadConfigSecrets(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(SecretsPassphraseEnv, "passphrase")
+	t.Setenv("STEWARD_TEST_LB2", "from-env")
+	if err := WriteSecretsFile(filepath.Join(dir, "secrets.enc"), map[string]string{"lb1": "from-file"}, "passphrase"); err != nil {
+		t.Fatalf("Failed to write secrets file: %v", err)
+	}
+
+	path := writeConfigFile(t, dir, "config.yaml", `
+secrets:
+  file: secrets.enc
+  env:
+    lb2: STEWARD_TEST_LB2
+  command:
+    lb3: echo from-command
+vars:
+  auth: "${secret:lb1}"
+hosts:
+  - host: 192.168.100.11
+    user: ubuntu
+    password: ${secret:lb1}
+  - host: 192.168.100.12
+    user: ubuntu
+    password: ${secret:lb2}
+  - host: 192.168.100.13
+    user: ubuntu
+    password: ${secret:lb3}
+    configuration:
+      - name: keepalived
+        data:
+          auth_pass: "pass-${auth}"
+`)
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	expected := []string{"from-file", "from-env", "from-command"}
+	for i, password := range expected {
+		if config.Hosts[i].Password != password {
+			t.Errorf("Expected password %s, got %s", password, config.Hosts[i].Password)
+		}
+	}
+	data := config.Hosts[2].Configuration[0].Data.(map[string]interface{})
+	if data["auth_pass"] != "pass-from-file" {
+		t.Errorf("Expected secret in template data, got %v", data["auth_pass"])
+	}
+
+	raw, err := LoadRawConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to load raw config: %v", err)
+	}
+	if raw.Hosts[0].Password != "${secret:lb1}" {
+		t.Errorf("Expected raw config to keep the secret reference, got %s", raw.Hosts[0].Password)
+	}
+}
+
+func TestLoadConfigSecretsErrors(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		secrets string
+		message string
+	}{
+		{"undefined", "", "undefined secret"},
+		{"env", "secrets:\n  env:\n    lb1: STEWARD_TEST_UNSET\n", "STEWARD_TEST_UNSET is not set"},
+		{"command", "secrets:\n  command:\n    lb1: exit 3\n", "failed"},
+		{"passphrase", "secrets:\n  file: secrets.enc\n", SecretsPassphraseEnv},
+	}
+
+	t.Setenv(SecretsPassphraseEnv, "")
+	for _, tt := range tests {
+		path := writeConfigFile(t, dir, tt.name+".yaml", tt.secrets+`
+hosts:
+  - host: 192.168.100.11
+    user: ubuntu
+    password: ${secret:lb1}
+`)
+		_, err := LoadConfig(path)
+		if err == nil || !strings.Contains(err.Error(), tt.message) {
+			t.Errorf("%s: expected error containing %q, got %v", tt.name, tt.message, err)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package common
+
+import (
+	"path/filepath"
+)
+
+// TemplateHost is the view of a host which templates are rendered with. It
+// leaves out passwords, keys and other credentials, so rendered files never
+// contain them.
+type TemplateHost struct {
+	Host   string   `yaml:"host" json:"host"`
+	Port   string   `yaml:"port" json:"port"`
+	User   string   `yaml:"user" json:"user"`
+	Groups []string `yaml:"groups,omitempty" json:"groups,omitempty"`
+	Facts  *Facts   `yaml:"facts,omitempty" json:"facts,omitempty"`
+}
+
+// newTemplateHost returns the template view of a host
+func newTemplateHost(host Host) TemplateHost {
+	return TemplateHost{
+		Host:   host.Host,
+		Port:   host.Port,
+		User:   host.User,
+		Groups: host.Groups,
+		Facts:  host.Facts,
+	}
+}
+
+// NewTemplateContext builds the data a configuration template is rendered with
+// on a host. The context exposes the template data as .Data, the target host as
+// .Host, its detected facts as .Facts and all configured hosts as .Inventory.
+// Hosts are exposed as TemplateHost, without their credentials. Keys of the
+// template data are also kept at the top level, so templates which only use
+// their data, like {{.backends}}, keep working.
+func NewTemplateContext(data interface{}, host Host, inventory []Host) map[string]interface{} {
+	context := make(map[string]interface{})
+	if values, ok := data.(map[string]interface{}); ok {
+		for key, value := range values {
+			context[key] = value
+		}
+	}
+
+	context["Data"] = data
+	context["Host"] = newTemplateHost(host)
+	context["Facts"] = host.Facts
+	hosts := make([]TemplateHost, 0, len(inventory))
+	for _, inventoryHost := range inventory {
+		hosts = append(hosts, newTemplateHost(inventoryHost))
+	}
+	context["Inventory"] = hosts
+	return context
+}
+
+// HostOutputFile returns the path a template is rendered to for a host. Each
+// host gets its own directory next to the configured output file, so hosts
+// rendering the same template never write the same file.
+func HostOutputFile(outputFile string, host string) string {
+	return filepath.Join(filepath.Dir(outputFile), host, filepath.Base(outputFile))
+}
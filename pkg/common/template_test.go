@@ -0,0 +1,82 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRenderTemplateWithContext(t *testing.T) {
+	tempDir := t.TempDir()
+	templateFile := filepath.Join(tempDir, "keepalived.cfg")
+	content := `{{.Facts.Hostname}} {{.Host.Host}} {{.Data.state}} {{.state}}
+{{- range .Inventory}}{{if ne .Host $.Host.Host}} {{.Host}}{{end}}{{end}}`
+	if err := os.WriteFile(templateFile, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to create template file: %v", err)
+	}
+
+	inventory := []Host{{Host: "10.0.0.1"}, {Host: "10.0.0.2"}, {Host: "10.0.0.3"}}
+	host := inventory[1]
+	host.Facts = &Facts{Hostname: "lb2"}
+	data := map[string]interface{}{"state": "BACKUP"}
+
+	rendered, err := RenderTemplate(templateFile, NewTemplateContext(data, host, inventory))
+	if err != nil {
+		t.Fatalf("RenderTemplate failed: %v", err)
+	}
+
+	expected := "lb2 10.0.0.2 BACKUP BACKUP 10.0.0.1 10.0.0.3"
+	if string(rendered) != expected {
+		t.Errorf("Expected '%s', got '%s'", expected, string(rendered))
+	}
+}
+
+func TestNewTemplateContextReservedKeys(t *testing.T) {
+	data := map[string]interface{}{"Host": "from data", "port": 8080}
+	context := NewTemplateContext(data, Host{Host: "10.0.0.1"}, nil)
+
+	if host, ok := context["Host"].(TemplateHost); !ok || host.Host != "10.0.0.1" {
+		t.Errorf("Expected .Host to be the target host, got %v", context["Host"])
+	}
+	if context["port"] != 8080 {
+		t.Errorf("Expected data keys at the top level, got %v", context["port"])
+	}
+}
+
+func TestTemplateContextLeavesOutCredentials(t *testing.T) {
+	tempDir := t.TempDir()
+	templateFile := filepath.Join(tempDir, "inventory.json")
+	if err := os.WriteFile(templateFile, []byte(`{{ .Host | toJson }} {{ .Inventory | toYaml }}`), 0644); err != nil {
+		t.Fatalf("Failed to create template file: %v", err)
+	}
+
+	host := Host{
+		Host:             "10.0.0.1",
+		User:             "admin",
+		Password:         "ssh-s3cret",
+		SSHKey:           "/home/admin/.ssh/id_ed25519",
+		SSHKeyPassphrase: "key-s3cret",
+		BecomePassword:   "sudo-s3cret",
+		Groups:           []string{"lb"},
+	}
+	rendered, err := RenderTemplate(templateFile, NewTemplateContext(nil, host, []Host{host}))
+	if err != nil {
+		t.Fatalf("RenderTemplate failed: %v", err)
+	}
+	for _, secret := range []string{"s3cret", "id_ed25519"} {
+		if strings.Contains(string(rendered), secret) {
+			t.Errorf("Expected rendered hosts without credentials, got %s", rendered)
+		}
+	}
+	if !strings.Contains(string(rendered), `"groups":["lb"]`) {
+		t.Errorf("Expected host groups in the rendered host, got %s", rendered)
+	}
+}
+
+func TestHostOutputFile(t *testing.T) {
+	expected := filepath.Join("output", "10.0.0.1", "haproxy.cfg")
+	if path := HostOutputFile("./output/haproxy.cfg", "10.0.0.1"); path != expected {
+		t.Errorf("Expected '%s', got '%s'", expected, path)
+	}
+}
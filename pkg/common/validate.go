@@ -0,0 +1,391 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"steward/pkg/exec"
+	"steward/pkg/pkgman"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ValidationError is a problem found in a configuration. Path locates the
+// value like hosts[0].application.core[1].manager, File, Line and Column are
+// set when the configuration was validated from its files.
+type ValidationError struct {
+	File    string `json:"file,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func (e ValidationError) Error() string {
+	if e.File != "" {
+		return fmt.Sprintf("%s:%d:%d: %s: %s", e.File, e.Line, e.Column, e.Path, e.Message)
+	}
+	return fmt.Sprintf("%s: %s", e.Path, e.Message)
+}
+
+// ValidationErrors are all problems found in a configuration
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return fmt.Sprintf("invalid configuration, %d problems:\n%s", len(e), strings.Join(messages, "\n"))
+}
+
+// validator collects the problems found in a configuration
+type validator struct {
+	errors ValidationErrors
+}
+
+func (v *validator) addf(path string, format string, args ...interface{}) {
+	v.errors = append(v.errors, ValidationError{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// ValidateConfig validates a loaded configuration before it is merged, and
+// returns all problems as ValidationErrors, or nil when it is valid
+func ValidateConfig(config *Config) error {
+	v := &validator{}
+
+	v.group("common", config.Common)
+	groupNames := make([]string, 0, len(config.Groups))
+	for name := range config.Groups {
+		groupNames = append(groupNames, name)
+	}
+	sort.Strings(groupNames)
+	for _, name := range groupNames {
+		v.group("groups."+name, config.Groups[name])
+	}
+
+	addresses := make(map[string]int)
+	for i, host := range config.Hosts {
+		path := fmt.Sprintf("hosts[%d]", i)
+		v.host(path, host, config.Groups)
+
+		if host.Host != "" {
+			if first, ok := addresses[host.Host]; ok {
+				v.addf(path+".host", "duplicate host %s, already defined by hosts[%d]", host.Host, first)
+			} else {
+				addresses[host.Host] = i
+			}
+		}
+	}
+
+	// Problems which only show once common and groups are merged into the hosts
+	if len(v.errors) == 0 {
+		merged, err := MergeCommonToHosts(config)
+		if err != nil {
+			v.addf("hosts", "%v", err)
+		} else {
+			for i, host := range merged.Hosts {
+				v.mergedHost(fmt.Sprintf("hosts[%d]", i), host)
+			}
+		}
+	}
+
+	if len(v.errors) > 0 {
+		return v.errors
+	}
+	return nil
+}
+
+// host validates the connection settings and entries of a host
+func (v *validator) host(path string, host Host, groups map[string]Group) {
+	if host.Host == "" {
+		v.addf(path, "host is required")
+	} else if err := exec.CheckSSHAuth(host.SSHOptions()); err != nil {
+		v.addf(path, "%v", err)
+	}
+	if host.Port != "" {
+		if port, err := strconv.Atoi(host.Port); err != nil || port < 1 || port > 65535 {
+			v.addf(path+".port", "invalid port %q, expected a number between 1 and 65535", host.Port)
+		}
+	}
+	if host.HostKeyChecking != "" && !slices.Contains(exec.HostKeyCheckingModes, host.HostKeyChecking) {
+		v.addf(path+".host_key_checking", "unknown host key checking %q, supported are %s", host.HostKeyChecking, strings.Join(exec.HostKeyCheckingModes, ", "))
+	}
+	if host.HostKey != "" {
+		if err := exec.ValidateHostKey(host.HostKey); err != nil {
+			v.addf(path+".host_key", "%v", err)
+		}
+	}
+	switch host.BecomeMethod {
+	case "", exec.BecomeSudo, exec.BecomeDoas, exec.BecomeNone:
+	case exec.BecomeSu:
+		if host.BecomePassword == "" && host.Password == "" && host.Become().Method != exec.BecomeNone {
+			v.addf(path+".become_method", "su requires become_password or password")
+		}
+	default:
+		v.addf(path+".become_method", "unknown become method %q, supported are %s", host.BecomeMethod, strings.Join(exec.BecomeMethods, ", "))
+	}
+	for i, name := range host.Groups {
+		if _, ok := groups[name]; !ok {
+			v.addf(fmt.Sprintf("%s.groups[%d]", path, i), "undefined group %s", name)
+		}
+	}
+
+	v.group(path, Group{
+		Application:   host.Application,
+		Configuration: host.Configuration,
+		Commands:      host.Commands,
+	})
+}
+
+// group validates the applications, templates and commands of common, a group or a host
+func (v *validator) group(path string, group Group) {
+	names := make(map[string]string)
+	duplicate := func(entryPath string, kind string, name string) {
+		if name == "" {
+			return
+		}
+		key := kind + "/" + name
+		if first, ok := names[key]; ok {
+			v.addf(entryPath+".name", "duplicate %s %s, already defined at %s", kind, name, first)
+			return
+		}
+		names[key] = entryPath
+	}
+
+	for i, app := range group.Application.Core {
+		entryPath := fmt.Sprintf("%s.application.core[%d]", path, i)
+		duplicate(entryPath, "application", app.Name)
+		v.app(entryPath, app.Name, app.Manager, app.State)
+	}
+	for i, app := range group.Application.External {
+		entryPath := fmt.Sprintf("%s.application.external[%d]", path, i)
+		duplicate(entryPath, "application", app.Name)
+		v.app(entryPath, app.Name, app.Manager, app.State)
+		if app.GPGKeyURL != "" && app.Repo == "" {
+			v.addf(entryPath, "repo is required when gpg_key_url is set")
+		}
+	}
+	for i, template := range group.Configuration {
+		entryPath := fmt.Sprintf("%s.configuration[%d]", path, i)
+		duplicate(entryPath, "configuration", template.Name)
+		v.template(entryPath, template)
+	}
+	for i, command := range group.Commands {
+		entryPath := fmt.Sprintf("%s.command[%d]", path, i)
+		duplicate(entryPath, "command", command.Name)
+		if command.Name == "" {
+			v.addf(entryPath, "name is required")
+		}
+	}
+}
+
+// app validates a core or external application
+func (v *validator) app(path string, name string, manager string, state string) {
+	if name == "" {
+		v.addf(path, "name is required")
+	}
+	if manager != "" && !pkgman.IsSupported(manager) {
+		v.addf(path+".manager", "unknown package manager %q, supported are %s", manager, strings.Join(pkgman.SupportedManagers(), ", "))
+	}
+	switch state {
+	case "", StatePresent, StateAbsent, StateLatest:
+	default:
+		v.addf(path+".state", "unknown state %q, expected %s, %s or %s", state, StatePresent, StateAbsent, StateLatest)
+	}
+}
+
+// template validates a configuration template. Fields inherited from common
+// or groups may be missing on a host, they are checked after the merge.
+func (v *validator) template(path string, template ConfigurationTemplate) {
+	if template.Name == "" {
+		v.addf(path, "name is required")
+	}
+	if template.TemplateFile != "" {
+		if _, err := os.Stat(template.TemplateFile); err != nil {
+			v.addf(path+".template_file", "template file %s does not exist", template.TemplateFile)
+		}
+	}
+	if template.RemoteFile != "" && !filepath.IsAbs(template.RemoteFile) {
+		v.addf(path+".remote_file", "remote file %s must be an absolute path", template.RemoteFile)
+	}
+	if template.Mode != "" {
+		if _, err := exec.ParseMode(template.Mode); err != nil {
+			v.addf(path+".mode", "%v", err)
+		}
+	}
+	if template.Validate != "" && !strings.Contains(template.Validate, "%s") {
+		v.addf(path+".validate", "validate command must contain %%s for the file to validate")
+	}
+}
+
+// mergedHost validates a host once common and groups are merged into it.
+// Entries of a kind are merged by name, but core and external applications
+// are merged separately, so the same name may come from both lists of
+// different layers.
+func (v *validator) mergedHost(path string, host Host) {
+	core := make(map[string]bool)
+	for _, app := range host.Application.Core {
+		core[app.Name] = true
+	}
+	for _, app := range host.Application.External {
+		if core[app.Name] {
+			v.addf(path, "application %s is both a core and an external application", app.Name)
+		}
+	}
+
+	commands := make(map[string]bool)
+	for _, command := range host.Commands {
+		commands[command.Name] = true
+	}
+
+	remoteFiles := make(map[string]string)
+	for _, template := range host.Configuration {
+		if template.TemplateFile == "" {
+			v.addf(path, "configuration %s has no template_file", template.Name)
+		}
+		if template.OutputFile == "" {
+			v.addf(path, "configuration %s has no output_file", template.Name)
+		}
+		if template.RemoteFile == "" {
+			v.addf(path, "configuration %s has no remote_file", template.Name)
+		} else if first, ok := remoteFiles[template.RemoteFile]; ok {
+			v.addf(path, "configurations %s and %s both write %s", first, template.Name, template.RemoteFile)
+		} else {
+			remoteFiles[template.RemoteFile] = template.Name
+		}
+		for _, name := range template.Notify {
+			if !commands[name] {
+				v.addf(path, "configuration %s notifies undefined command %s", template.Name, name)
+			}
+		}
+	}
+}
+
+// ValidateConfigFile validates a configuration loaded from filePath with
+// LoadConfig. Problems are located in the configuration file or the included
+// file they come from.
+func ValidateConfigFile(filePath string, config *Config) error {
+	err := ValidateConfig(config)
+	errs, ok := err.(ValidationErrors)
+	if !ok {
+		return err
+	}
+
+	index := &sourceIndex{positions: make(map[string]ValidationError), counts: make(map[string]int)}
+	if indexErr := index.file(filePath, nil); indexErr != nil {
+		// Problems are still reported, without their position
+		logger.Warnf("Failed to locate configuration problems in %s: %v", filePath, indexErr)
+		return errs
+	}
+	for i := range errs {
+		position := index.lookup(errs[i].Path)
+		errs[i].File, errs[i].Line, errs[i].Column = position.File, position.Line, position.Column
+	}
+	return errs
+}
+
+// sourceIndex maps the paths of loaded configuration values to their
+// position in the configuration files
+type sourceIndex struct {
+	positions map[string]ValidationError
+	// counts holds the number of entries merged so far into the lists which
+	// LoadConfig appends across included files
+	counts map[string]int
+}
+
+// file indexes a configuration file after its includes, in the order
+// LoadConfig merges them
+func (s *sourceIndex) file(filePath string, stack []string) error {
+	absPath, err := filepath.Abs(filePath)
+	if err != nil {
+		return err
+	}
+	for _, including := range stack {
+		if including == absPath {
+			return fmt.Errorf("config file %s includes itself", filePath)
+		}
+	}
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return err
+	}
+	if len(document.Content) == 0 {
+		return nil
+	}
+	root := document.Content[0]
+
+	// Included files are merged first
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value != "include" {
+			continue
+		}
+		for _, include := range root.Content[i+1].Content {
+			includePath := include.Value
+			if !filepath.IsAbs(includePath) {
+				includePath = filepath.Join(filepath.Dir(filePath), includePath)
+			}
+			if err := s.file(includePath, append(stack, absPath)); err != nil {
+				return err
+			}
+		}
+	}
+
+	counts := make(map[string]int)
+	s.walk(filePath, root, "", counts)
+	for path, count := range counts {
+		s.counts[path] += count
+	}
+	return nil
+}
+
+// walk records the position of node and its children. Lists at the top of
+// sections are appended across files, their indexes are offset by the entries
+// of previous files. counts collects the entries of these lists in this file.
+func (s *sourceIndex) walk(filePath string, node *yaml.Node, path string, counts map[string]int) {
+	s.positions[path] = ValidationError{File: filePath, Line: node.Line, Column: node.Column}
+
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i].Value
+			if path != "" {
+				key = path + "." + key
+			}
+			s.walk(filePath, node.Content[i+1], key, counts)
+		}
+	case yaml.SequenceNode:
+		offset := 0
+		if !strings.Contains(path, "[") {
+			offset = s.counts[path]
+			counts[path] = len(node.Content)
+		}
+		for i, item := range node.Content {
+			s.walk(filePath, item, fmt.Sprintf("%s[%d]", path, offset+i), counts)
+		}
+	}
+}
+
+// lookup returns the position of a path, or of its closest indexed parent
+// when the value is missing from the file
+func (s *sourceIndex) lookup(path string) ValidationError {
+	for {
+		if position, ok := s.positions[path]; ok {
+			return position
+		}
+		cut := strings.LastIndexAny(path, ".[")
+		if cut < 0 {
+			return s.positions[""]
+		}
+		path = path[:cut]
+	}
+}
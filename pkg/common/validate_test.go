@@ -0,0 +1,283 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	isolateSSHAuth(t)
+	templateFile := writeConfigFile(t, dir, "haproxy.cfg", "global\n")
+	writeConfigFile(t, dir, "common.yaml", `
+common:
+  application:
+    core:
+      - name: curl
+        manager: pacman
+`)
+	path := writeConfigFile(t, dir, "config.yaml", `
+include:
+  - common.yaml
+common:
+  application:
+    core:
+      - name: vim
+        manager: apt
+        state: removed
+    external:
+      - name: kubernetes
+        gpg_key_url: https://pkgs.k8s.io/core:/stable:/v1.32/deb/Release.key
+  configuration:
+    - name: haproxy
+      template_file: `+templateFile+`
+      output_file: `+filepath.Join(dir, "output", "haproxy.cfg")+`
+      remote_file: /etc/haproxy/haproxy.cfg
+      mode: "0999"
+    - name: keepalived
+      template_file: `+filepath.Join(dir, "missing.cfg")+`
+      output_file: `+filepath.Join(dir, "output", "keepalived.cfg")+`
+      remote_file: /etc/keepalived/keepalived.conf
+hosts:
+  - host: 192.168.100.11
+    user: ubuntu
+    password: secret
+    port: "70000"
+  - host: 192.168.100.11
+    user: ubuntu
+    groups: [web]
+    command:
+      - name: restart
+        command: systemctl restart haproxy
+      - name: restart
+        command: systemctl restart keepalived
+`)
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	err = ValidateConfigFile(path, config)
+	errs, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("Expected ValidationErrors, got %v", err)
+	}
+
+	expected := []struct {
+		path    string
+		file    string
+		line    int
+		message string
+	}{
+		{"common.application.core[0].manager", "common.yaml", 6, "unknown package manager \"pacman\""},
+		{"common.application.core[1].state", "config.yaml", 9, "unknown state \"removed\""},
+		{"common.application.external[0]", "config.yaml", 11, "repo is required"},
+		{"common.configuration[0].mode", "config.yaml", 18, "invalid"},
+		{"common.configuration[1].template_file", "config.yaml", 20, "does not exist"},
+		{"hosts[0].port", "config.yaml", 27, "invalid port"},
+		{"hosts[1]", "config.yaml", 28, "no SSH authentication"},
+		{"hosts[1].groups[0]", "config.yaml", 30, "undefined group web"},
+		{"hosts[1].command[1].name", "config.yaml", 34, "duplicate command restart"},
+		{"hosts[1].host", "config.yaml", 28, "duplicate host 192.168.100.11"},
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("Expected %d problems, got %d: %v", len(expected), len(errs), errs)
+	}
+	for _, e := range expected {
+		found := false
+		for _, problem := range errs {
+			if problem.Path != e.path || !strings.Contains(problem.Message, e.message) {
+				continue
+			}
+			found = true
+			if filepath.Base(problem.File) != e.file || problem.Line != e.line {
+				t.Errorf("Expected %s at %s:%d, got %s:%d", e.path, e.file, e.line, filepath.Base(problem.File), problem.Line)
+			}
+		}
+		if !found {
+			t.Errorf("Expected problem %s: %s, got %v", e.path, e.message, errs)
+		}
+	}
+}
+
+func TestValidateConfigMergedHosts(t *testing.T) {
+	dir := t.TempDir()
+	templateFile := writeConfigFile(t, dir, "haproxy.cfg", "global\n")
+
+	config := &Config{
+		Common: Group{
+			Configuration: []ConfigurationTemplate{
+				{Name: "haproxy", TemplateFile: templateFile, OutputFile: "out/haproxy.cfg", RemoteFile: "/etc/haproxy/haproxy.cfg", Notify: []string{"reload"}},
+			},
+		},
+		Hosts: []Host{
+			{
+				Host:     "192.168.100.11",
+				User:     "ubuntu",
+				Password: "secret",
+				Configuration: []ConfigurationTemplate{
+					{Name: "haproxy-extra", TemplateFile: templateFile, OutputFile: "out/extra.cfg", RemoteFile: "/etc/haproxy/haproxy.cfg"},
+				},
+			},
+		},
+	}
+
+	err := ValidateConfig(config)
+	errs, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("Expected ValidationErrors, got %v", err)
+	}
+	if len(errs) != 2 {
+		t.Fatalf("Expected 2 problems, got %v", errs)
+	}
+	if !strings.Contains(errs[0].Message, "notifies undefined command reload") {
+		t.Errorf("Expected undefined notify, got %v", errs[0])
+	}
+	if !strings.Contains(errs[1].Message, "both write /etc/haproxy/haproxy.cfg") {
+		t.Errorf("Expected duplicate remote file, got %v", errs[1])
+	}
+
+	config.Hosts[0].Configuration[0].RemoteFile = "/etc/haproxy/extra.cfg"
+	config.Common.Commands = []Command{{Name: "reload", Command: "systemctl reload haproxy"}}
+	if err := ValidateConfig(config); err != nil {
+		t.Errorf("Expected valid config, got %v", err)
+	}
+}
+
+func TestValidateConfigMergedDuplicates(t *testing.T) {
+	config := &Config{
+		Common: Group{
+			Application: Application{Core: []CoreApp{{Name: "containerd", Manager: "apt"}}},
+		},
+		Groups: map[string]Group{
+			"workers": {Application: Application{External: []ExternalApp{{Name: "kubelet", Repo: "https://pkgs.k8s.io/", Manager: "apt"}}}},
+		},
+		Hosts: []Host{
+			{
+				Host:        "192.168.100.11",
+				SSHKey:      "id_ed25519",
+				Application: Application{External: []ExternalApp{{Name: "containerd", Repo: "https://download.docker.com/", Manager: "apt"}}},
+			},
+			{
+				Host:        "192.168.100.12",
+				SSHKey:      "id_ed25519",
+				Groups:      []string{"workers"},
+				Application: Application{Core: []CoreApp{{Name: "kubelet", Manager: "apt"}}},
+			},
+			{
+				Host:        "192.168.100.13",
+				SSHKey:      "id_ed25519",
+				Application: Application{Core: []CoreApp{{Name: "containerd", Version: "1.7"}}},
+			},
+		},
+	}
+
+	err := ValidateConfig(config)
+	errs, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("Expected ValidationErrors, got %v", err)
+	}
+	if len(errs) != 2 {
+		t.Fatalf("Expected 2 problems, got %v", errs)
+	}
+	if errs[0].Path != "hosts[0]" || !strings.Contains(errs[0].Message, "application containerd is both") {
+		t.Errorf("Expected containerd from common and host, got %v", errs[0])
+	}
+	if errs[1].Path != "hosts[1]" || !strings.Contains(errs[1].Message, "application kubelet is both") {
+		t.Errorf("Expected kubelet from group and host, got %v", errs[1])
+	}
+}
+
+func TestValidateConfigSSHAuth(t *testing.T) {
+	home := isolateSSHAuth(t)
+	config := &Config{
+		Hosts: []Host{
+			{Host: "192.168.100.11"},
+			{Host: "192.168.100.12", Password: "s3cret"},
+			{Host: "192.168.100.13", SSHKey: "id_ed25519"},
+			{Host: "lb"},
+		},
+	}
+	writeConfigFile(t, filepath.Join(home, ".ssh"), "lb", "key")
+	writeConfigFile(t, filepath.Join(home, ".ssh"), "config", "Host lb\n  HostName 192.168.100.14\n  IdentityFile ~/.ssh/lb\n")
+
+	err := ValidateConfig(config)
+	errs, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("Expected ValidationErrors, got %v", err)
+	}
+	if len(errs) != 1 || errs[0].Path != "hosts[0]" || !strings.Contains(errs[0].Message, "no SSH authentication") {
+		t.Fatalf("Expected only the host without authentication, got %v", errs)
+	}
+
+	t.Setenv("SSH_AUTH_SOCK", filepath.Join(home, "agent.sock"))
+	if err := ValidateConfig(config); err != nil {
+		t.Errorf("Expected the agent to authenticate, got %v", err)
+	}
+}
+
+// isolateSSHAuth hides the SSH config, keys and agent of the user, it returns
+// the home directory of the test
+func isolateSSHAuth(t *testing.T) string {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("SSH_AUTH_SOCK", "")
+	if err := os.Mkdir(filepath.Join(home, ".ssh"), 0700); err != nil {
+		t.Fatalf("Failed to create .ssh: %v", err)
+	}
+	return home
+}
+
+func TestValidateConfigBecome(t *testing.T) {
+	config := &Config{
+		Hosts: []Host{
+			{Host: "192.168.100.11", User: "admin", SSHKey: "id_ed25519", BecomeMethod: "su"},
+			{Host: "192.168.100.12", User: "admin", SSHKey: "id_ed25519", BecomeMethod: "pbrun"},
+			{Host: "192.168.100.13", User: "root", SSHKey: "id_ed25519", BecomeMethod: "su"},
+			{Host: "192.168.100.14", User: "admin", SSHKey: "id_ed25519", BecomeMethod: "su", BecomePassword: "s3cret"},
+		},
+	}
+
+	err := ValidateConfig(config)
+	errs, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("Expected ValidationErrors, got %v", err)
+	}
+	if len(errs) != 2 {
+		t.Fatalf("Expected 2 problems, got %v", errs)
+	}
+	if errs[0].Path != "hosts[0].become_method" || !strings.Contains(errs[0].Message, "requires become_password") {
+		t.Errorf("Expected su without password, got %v", errs[0])
+	}
+	if errs[1].Path != "hosts[1].become_method" || !strings.Contains(errs[1].Message, "unknown become method") {
+		t.Errorf("Expected unknown become method, got %v", errs[1])
+	}
+}
+
+func TestValidateConfigHostKey(t *testing.T) {
+	config := &Config{
+		Hosts: []Host{
+			{Host: "192.168.100.11", User: "admin", SSHKey: "id_ed25519", HostKeyChecking: "strict"},
+			{Host: "192.168.100.12", User: "admin", SSHKey: "id_ed25519", HostKeyChecking: "yes"},
+			{Host: "192.168.100.13", User: "admin", SSHKey: "id_ed25519", HostKey: "SHA256:uNiVztksCsDhcc0u9e8BujQXVUpKZIDTMczCvj3tD2s"},
+			{Host: "192.168.100.14", User: "admin", SSHKey: "id_ed25519", HostKey: "ed25519 AAAA"},
+		},
+	}
+
+	err := ValidateConfig(config)
+	errs, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("Expected ValidationErrors, got %v", err)
+	}
+	if len(errs) != 2 {
+		t.Fatalf("Expected 2 problems, got %v", errs)
+	}
+	if errs[0].Path != "hosts[1].host_key_checking" {
+		t.Errorf("Expected invalid host_key_checking, got %v", errs[0])
+	}
+	if errs[1].Path != "hosts[3].host_key" {
+		t.Errorf("Expected invalid host_key, got %v", errs[1])
+	}
+}
@@ -0,0 +1,236 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// envPrefix marks references to environment variables, like ${env:HOME}
+const envPrefix = "env:"
+
+// varReference matches ${name} references, $${name} is an escaped literal
+var varReference = regexp.MustCompile(`\$?\$\{([^}]*)\}`)
+
+// shellFields are the struct fields which hold shell commands. References to
+// names which are not vars are left to the shell there, like ${HOME}.
+var shellFields = map[reflect.Type]string{
+	reflect.TypeOf(Command{}):               "Command",
+	reflect.TypeOf(ConfigurationTemplate{}): "Validate",
+}
+
+// interpolator resolves ${var}, ${env:NAME} and ${secret:name} references in configuration values
+type interpolator struct {
+	vars    map[string]interface{}
+	secrets *secretStore
+	// resolved caches vars whose references are resolved
+	resolved map[string]interface{}
+	// resolving holds the vars being resolved, to detect reference cycles
+	resolving map[string]bool
+}
+
+// newInterpolator creates an interpolator for the vars and secrets of a configuration
+func newInterpolator(vars map[string]interface{}, secrets Secrets) *interpolator {
+	return &interpolator{
+		vars:      vars,
+		secrets:   newSecretStore(secrets),
+		resolved:  make(map[string]interface{}),
+		resolving: make(map[string]bool),
+	}
+}
+
+// InterpolateConfig resolves ${var} references to the top-level vars and
+// ${env:NAME} references to environment variables and ${secret:name} references
+// to secrets in every string of the configuration, including template data.
+// $${ is kept as a literal ${. Commands keep ${NAME} references to names which
+// are not vars, so they can use shell variables.
+func InterpolateConfig(config *Config) error {
+	in := newInterpolator(config.Vars, config.Secrets)
+
+	// Resolve all vars first, so unused vars with errors are reported as well
+	for name := range config.Vars {
+		if _, err := in.lookup(name); err != nil {
+			return err
+		}
+	}
+
+	v := reflect.ValueOf(config).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		// vars are resolved above, include lists paths which are already loaded
+		// and secrets configure how secrets are resolved
+		switch v.Type().Field(i).Name {
+		case "Vars", "Include", "Secrets":
+			continue
+		}
+		if err := in.walk(v.Field(i), false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookup returns the value of a var with its own references resolved
+func (in *interpolator) lookup(name string) (interface{}, error) {
+	if strings.HasPrefix(name, secretPrefix) {
+		return in.secrets.lookup(strings.TrimPrefix(name, secretPrefix))
+	}
+	if strings.HasPrefix(name, envPrefix) {
+		envName := strings.TrimPrefix(name, envPrefix)
+		value, ok := os.LookupEnv(envName)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", envName)
+		}
+		return value, nil
+	}
+
+	if value, ok := in.resolved[name]; ok {
+		return value, nil
+	}
+	value, ok := in.vars[name]
+	if !ok {
+		return nil, fmt.Errorf("undefined variable %s", name)
+	}
+	if in.resolving[name] {
+		return nil, fmt.Errorf("variable %s references itself", name)
+	}
+
+	in.resolving[name] = true
+	resolved, err := in.value(value)
+	delete(in.resolving, name)
+	if err != nil {
+		return nil, fmt.Errorf("variable %s: %w", name, err)
+	}
+	in.resolved[name] = resolved
+	return resolved, nil
+}
+
+// value resolves the references in a value decoded from YAML or JSON
+func (in *interpolator) value(value interface{}) (interface{}, error) {
+	switch typed := value.(type) {
+	case string:
+		// A string which is a single reference takes the type of the var, so
+		// lists and maps can be shared as template data
+		if match := varReference.FindStringSubmatch(typed); match != nil && match[0] == typed && !strings.HasPrefix(typed, "$$") {
+			return in.lookup(match[1])
+		}
+		return in.interpolate(typed, false)
+	case map[string]interface{}:
+		resolved := make(map[string]interface{}, len(typed))
+		for key, item := range typed {
+			item, err := in.value(item)
+			if err != nil {
+				return nil, err
+			}
+			resolved[key] = item
+		}
+		return resolved, nil
+	case []interface{}:
+		resolved := make([]interface{}, len(typed))
+		for i, item := range typed {
+			item, err := in.value(item)
+			if err != nil {
+				return nil, err
+			}
+			resolved[i] = item
+		}
+		return resolved, nil
+	default:
+		return value, nil
+	}
+}
+
+// interpolate replaces the references in a string with the string form of
+// their values. A shell string keeps references to names which are not vars.
+func (in *interpolator) interpolate(s string, shell bool) (string, error) {
+	var err error
+	result := varReference.ReplaceAllStringFunc(s, func(reference string) string {
+		if strings.HasPrefix(reference, "$$") {
+			return reference[1:]
+		}
+		name := reference[2 : len(reference)-1]
+		if shell && !in.defines(name) {
+			return reference
+		}
+		value, lookupErr := in.lookup(name)
+		if lookupErr != nil {
+			if err == nil {
+				err = lookupErr
+			}
+			return reference
+		}
+		switch value.(type) {
+		case map[string]interface{}, []interface{}:
+			if err == nil {
+				err = fmt.Errorf("variable %s is a list or map and cannot be used inside %q", name, s)
+			}
+			return reference
+		}
+		return fmt.Sprint(value)
+	})
+	return result, err
+}
+
+// defines reports whether a reference names a var, an environment variable or a secret
+func (in *interpolator) defines(name string) bool {
+	if strings.HasPrefix(name, secretPrefix) || strings.HasPrefix(name, envPrefix) {
+		return true
+	}
+	_, ok := in.vars[name]
+	return ok
+}
+
+// walk resolves the references in the strings of a struct field, recursively.
+// shell tells whether the field holds a shell command.
+func (in *interpolator) walk(v reflect.Value, shell bool) error {
+	switch v.Kind() {
+	case reflect.String:
+		resolved, err := in.interpolate(v.String(), shell)
+		if err != nil {
+			return err
+		}
+		v.SetString(resolved)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if field.IsExported() {
+				if err := in.walk(v.Field(i), shellFields[v.Type()] == field.Name); err != nil {
+					return err
+				}
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if err := in.walk(v.Index(i), shell); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		// Map values are not addressable, they are resolved in a copy
+		for _, key := range v.MapKeys() {
+			item := reflect.New(v.Type().Elem()).Elem()
+			item.Set(v.MapIndex(key))
+			if err := in.walk(item, shell); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, item)
+		}
+	case reflect.Ptr:
+		if !v.IsNil() {
+			return in.walk(v.Elem(), shell)
+		}
+	case reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		resolved, err := in.value(v.Interface())
+		if err != nil {
+			return err
+		}
+		if resolved != nil {
+			v.Set(reflect.ValueOf(resolved))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package diff
+
+import (
+	"fmt"
+	"strings"
+)
+
+// contextLines is the number of unchanged lines shown around each change
+const contextLines = 3
+
+// op is the kind of a line in an edit script
+type op int
+
+const (
+	opEqual op = iota
+	opDelete
+	opInsert
+)
+
+// edit is one line of an edit script
+type edit struct {
+	op   op
+	line string
+	// aLine and bLine are the 0-based positions before this line in a and b
+	aLine int
+	bLine int
+}
+
+// Unified returns the unified diff turning a into b, with a and b named after
+// the files they were read from. The diff is empty when a and b are equal.
+func Unified(aName string, bName string, a string, b string) string {
+	if a == b {
+		return ""
+	}
+
+	edits := lineEdits(splitLines(a), splitLines(b))
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", aName, bName)
+	for _, hunk := range hunks(edits) {
+		writeHunk(&out, edits[hunk[0]:hunk[1]])
+	}
+	return out.String()
+}
+
+// splitLines splits text into lines keeping their line endings, so a missing
+// newline at the end of the file shows up as a change
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// lineEdits computes the shortest edit script from a to b with the longest
+// common subsequence of their lines
+func lineEdits(a []string, b []string) []edit {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var edits []edit
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			edits = append(edits, edit{op: opEqual, line: a[i], aLine: i, bLine: j})
+			i++
+			j++
+		case j < len(b) && (i == len(a) || lcs[i][j+1] >= lcs[i+1][j]):
+			edits = append(edits, edit{op: opInsert, line: b[j], aLine: i, bLine: j})
+			j++
+		default:
+			edits = append(edits, edit{op: opDelete, line: a[i], aLine: i, bLine: j})
+			i++
+		}
+	}
+
+	// Show deletions before insertions within a block of changes
+	for start := 0; start < len(edits); {
+		if edits[start].op == opEqual {
+			start++
+			continue
+		}
+		end := start
+		for end < len(edits) && edits[end].op != opEqual {
+			end++
+		}
+		block := make([]edit, 0, end-start)
+		for _, e := range edits[start:end] {
+			if e.op == opDelete {
+				block = append(block, e)
+			}
+		}
+		for _, e := range edits[start:end] {
+			if e.op == opInsert {
+				block = append(block, e)
+			}
+		}
+		copy(edits[start:end], block)
+		start = end
+	}
+
+	// Positions changed with the order of the lines
+	aLine, bLine := 0, 0
+	for k := range edits {
+		edits[k].aLine, edits[k].bLine = aLine, bLine
+		if edits[k].op != opInsert {
+			aLine++
+		}
+		if edits[k].op != opDelete {
+			bLine++
+		}
+	}
+	return edits
+}
+
+// hunks returns the [start, end) ranges of edits which form a hunk, changes
+// closer than twice the context are merged into one hunk
+func hunks(edits []edit) [][2]int {
+	var ranges [][2]int
+	for i := 0; i < len(edits); i++ {
+		if edits[i].op == opEqual {
+			continue
+		}
+		start := max(i-contextLines, 0)
+		end := i
+		for end < len(edits) {
+			if edits[end].op != opEqual {
+				end++
+				continue
+			}
+			// Look ahead for the next change within the context of both changes
+			next := end
+			for next < len(edits) && edits[next].op == opEqual {
+				next++
+			}
+			if next < len(edits) && next-end <= 2*contextLines {
+				end = next
+				continue
+			}
+			end = min(end+contextLines, len(edits))
+			break
+		}
+		ranges = append(ranges, [2]int{start, end})
+		i = end
+	}
+	return ranges
+}
+
+// writeHunk writes a hunk header and its lines
+func writeHunk(out *strings.Builder, edits []edit) {
+	aStart, bStart := edits[0].aLine, edits[0].bLine
+	aCount, bCount := 0, 0
+	for _, e := range edits {
+		if e.op != opInsert {
+			aCount++
+		}
+		if e.op != opDelete {
+			bCount++
+		}
+	}
+	fmt.Fprintf(out, "@@ -%s +%s @@\n", hunkRange(aStart, aCount), hunkRange(bStart, bCount))
+
+	for _, e := range edits {
+		prefix := " "
+		switch e.op {
+		case opDelete:
+			prefix = "-"
+		case opInsert:
+			prefix = "+"
+		}
+		out.WriteString(prefix)
+		out.WriteString(e.line)
+		if !strings.HasSuffix(e.line, "\n") {
+			out.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
+
+// hunkRange formats the line range of a hunk like diff -u
+func hunkRange(start int, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", start)
+	case 1:
+		return fmt.Sprintf("%d", start+1)
+	default:
+		return fmt.Sprintf("%d,%d", start+1, count)
+	}
+}
@@ -0,0 +1,115 @@
+package diff
+
+import (
+	"testing"
+)
+
+func TestUnifiedEqual(t *testing.T) {
+	if diff := Unified("a", "b", "same\n", "same\n"); diff != "" {
+		t.Errorf("Expected no diff, got '%s'", diff)
+	}
+}
+
+func TestUnified(t *testing.T) {
+	tests := []struct {
+		name     string
+		a        string
+		b        string
+		expected string
+	}{
+		{
+			name: "changed line",
+			a:    "global\n    maxconn 100\ndefaults\n",
+			b:    "global\n    maxconn 200\ndefaults\n",
+			expected: `--- old
++++ new
+@@ -1,3 +1,3 @@
+ global
+-    maxconn 100
++    maxconn 200
+ defaults
+`,
+		},
+		{
+			name: "new file",
+			a:    "",
+			b:    "a\nb\n",
+			expected: `--- old
++++ new
+@@ -0,0 +1,2 @@
++a
++b
+`,
+		},
+		{
+			name: "removed file",
+			a:    "a\n",
+			b:    "",
+			expected: `--- old
++++ new
+@@ -1 +0,0 @@
+-a
+`,
+		},
+		{
+			name: "missing newline at end of file",
+			a:    "a\nb\n",
+			b:    "a\nb",
+			expected: `--- old
++++ new
+@@ -1,2 +1,2 @@
+ a
+-b
++b
+\ No newline at end of file
+`,
+		},
+		{
+			name: "separate hunks",
+			a:    "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n",
+			b:    "one\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\ntwelve\n",
+			expected: `--- old
++++ new
+@@ -1,4 +1,4 @@
+-1
++one
+ 2
+ 3
+ 4
+@@ -9,4 +9,4 @@
+ 9
+ 10
+ 11
+-12
++twelve
+`,
+		},
+		{
+			name: "close changes share a hunk",
+			a:    "1\n2\n3\n4\n5\n6\n7\n8\n",
+			b:    "1\ntwo\n3\n4\n5\n6\nseven\n8\n",
+			expected: `--- old
++++ new
+@@ -1,8 +1,8 @@
+ 1
+-2
++two
+ 3
+ 4
+ 5
+ 6
+-7
++seven
+ 8
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if diff := Unified("old", "new", tt.a, tt.b); diff != tt.expected {
+				t.Errorf("Expected diff:\n%s\ngot:\n%s", tt.expected, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package exec
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Become methods run commands as another user, root by default
+const (
+	BecomeSudo = "sudo" // sudo reads the password from stdin, the default
+	BecomeSu   = "su"   // su answers the password prompt on a PTY
+	BecomeDoas = "doas" // doas answers the password prompt on a PTY
+	BecomeNone = "none" // Commands run as the SSH user
+)
+
+// BecomeMethods are the supported become methods
+var BecomeMethods = []string{BecomeSudo, BecomeSu, BecomeDoas, BecomeNone}
+
+// passwordPrompt matches the password prompts of su and doas, like
+// "Password: " or "doas (admin@lb1) password: "
+var passwordPrompt = regexp.MustCompile(`(?i)password[^\n]*:\s*$`)
+
+// Become describes how commands gain the privileges of another user
+type Become struct {
+	// Method is one of BecomeMethods, sudo when empty
+	Method string
+	// User is the user commands run as, root when empty
+	User string
+	// Password authenticates the become method, methods fail instead of
+	// prompting when it is empty
+	Password string
+}
+
+// method returns the become method, sudo when it is not set
+func (b Become) method() string {
+	if b.Method == "" {
+		return BecomeSudo
+	}
+	return b.Method
+}
+
+// user returns the user commands run as, root when it is not set
+func (b Become) user() string {
+	if b.User == "" {
+		return "root"
+	}
+	return b.User
+}
+
+// usesPrompt reports whether the password is typed at a prompt on a PTY
+// instead of being read from stdin
+func (b Become) usesPrompt() bool {
+	method := b.method()
+	return b.Password != "" && (method == BecomeSu || method == BecomeDoas)
+}
+
+// commandLine wraps a command to run in a shell as the become user. The
+// command gets an empty stdin, so it never reads the password.
+func (b Become) commandLine(command string) (string, error) {
+	shell := ShellQuote("exec </dev/null; " + command)
+	user := ShellQuote(b.user())
+
+	switch b.method() {
+	case BecomeSudo:
+		// sudo reads the password from stdin without a prompt
+		if b.Password == "" {
+			return fmt.Sprintf("sudo -n -u %s sh -c %s", user, shell), nil
+		}
+		return fmt.Sprintf("sudo -S -p '' -u %s sh -c %s", user, shell), nil
+	case BecomeSu:
+		return fmt.Sprintf("su -s /bin/sh %s -c %s", user, shell), nil
+	case BecomeDoas:
+		if b.Password == "" {
+			return fmt.Sprintf("doas -n -u %s sh -c %s", user, shell), nil
+		}
+		return fmt.Sprintf("doas -u %s sh -c %s", user, shell), nil
+	case BecomeNone:
+		return "sh -c " + shell, nil
+	default:
+		return "", fmt.Errorf("unknown become method %q, supported are %s", b.Method, strings.Join(BecomeMethods, ", "))
+	}
+}
+
+// runBecome runs a command as the become user and returns its output. Only
+// sudo gets the password on stdin, su and doas get it at their prompt.
+func runBecome(client *ssh.Client, command string, become Become) (string, error) {
+	commandLine, err := become.commandLine(command)
+	if err != nil {
+		return "", err
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		return "", fmt.Errorf("failed to create SSH session: %w", err)
+	}
+	defer session.Close()
+
+	if become.usesPrompt() {
+		return runWithPrompt(session, commandLine, become.Password)
+	}
+
+	var stdoutBuf, stderrBuf bytes.Buffer
+	session.Stdout = &stdoutBuf
+	session.Stderr = &stderrBuf
+	if become.method() == BecomeSudo && become.Password != "" {
+		session.Stdin = strings.NewReader(become.Password + "\n")
+	}
+	if err := session.Run(commandLine); err != nil {
+		return "", fmt.Errorf("%w\nstderr: %s", err, stderrBuf.String())
+	}
+	return stdoutBuf.String(), nil
+}
+
+// runWithPrompt runs a command on a PTY and types the password at its prompt.
+// stdout and stderr are merged on a PTY.
+func runWithPrompt(session *ssh.Session, commandLine string, password string) (string, error) {
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          0,
+		ssh.TTY_OP_ISPEED: 14400,
+		ssh.TTY_OP_OSPEED: 14400,
+	}
+	if err := session.RequestPty("xterm", 40, 200, modes); err != nil {
+		return "", fmt.Errorf("failed to request a PTY: %w", err)
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return "", err
+	}
+	defer stdin.Close()
+
+	responder := &promptResponder{stdin: stdin, password: password}
+	session.Stdout = responder
+	if err := session.Run(commandLine); err != nil {
+		return "", fmt.Errorf("%w\noutput: %s", err, responder.Output())
+	}
+	return responder.Output(), nil
+}
+
+// promptResponder answers the first password prompt written to it and
+// collects the output which follows the prompt
+type promptResponder struct {
+	stdin    io.Writer
+	password string
+	answered bool
+	// before holds the output until the prompt is answered
+	before bytes.Buffer
+	after  bytes.Buffer
+}
+
+func (p *promptResponder) Write(data []byte) (int, error) {
+	if p.answered {
+		return p.after.Write(data)
+	}
+
+	p.before.Write(data)
+	if location := passwordPrompt.FindIndex(p.before.Bytes()); location != nil {
+		p.answered = true
+		p.before.Truncate(location[0])
+		if _, err := io.WriteString(p.stdin, p.password+"\n"); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+// Output returns the output of the command without the prompt and with the
+// line endings of the PTY converted to newlines
+func (p *promptResponder) Output() string {
+	if !p.answered {
+		return strings.ReplaceAll(p.before.String(), "\r\n", "\n")
+	}
+	// The newline typed after the password is echoed by su and doas
+	output := strings.ReplaceAll(p.after.String(), "\r\n", "\n")
+	return strings.TrimPrefix(output, "\n")
+}
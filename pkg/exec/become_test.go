@@ -0,0 +1,111 @@
+package exec
+
+import (
+	"bytes"
+	"os"
+	osexec "os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBecomeCommandLine(t *testing.T) {
+	tests := []struct {
+		become   Become
+		command  string
+		expected string
+	}{
+		{Become{Password: "s3cret"}, "apt update", `sudo -S -p '' -u 'root' sh -c 'exec </dev/null; apt update'`},
+		{Become{}, "cat /etc/sudoers.d/deploy", `sudo -n -u 'root' sh -c 'exec </dev/null; cat /etc/sudoers.d/deploy'`},
+		{Become{Method: BecomeSudo, User: "postgres", Password: "s3cret"}, "echo 'a' | tee /tmp/a", `sudo -S -p '' -u 'postgres' sh -c 'exec </dev/null; echo '\''a'\'' | tee /tmp/a'`},
+		{Become{Method: BecomeSu, Password: "s3cret"}, "apk update", `su -s /bin/sh 'root' -c 'exec </dev/null; apk update'`},
+		{Become{Method: BecomeDoas, Password: "s3cret"}, "apk update", `doas -u 'root' sh -c 'exec </dev/null; apk update'`},
+		{Become{Method: BecomeDoas}, "apk update", `doas -n -u 'root' sh -c 'exec </dev/null; apk update'`},
+		{Become{Method: BecomeNone, Password: "s3cret"}, "apk update", `sh -c 'exec </dev/null; apk update'`},
+	}
+	for _, tt := range tests {
+		got, err := tt.become.commandLine(tt.command)
+		if err != nil {
+			t.Errorf("Unexpected error for %+v: %v", tt.become, err)
+			continue
+		}
+		if got != tt.expected {
+			t.Errorf("Expected %s, got %s", tt.expected, got)
+		}
+	}
+
+	if _, err := (Become{Method: "pbrun"}).commandLine("id"); err == nil {
+		t.Errorf("Expected error for an unknown become method")
+	}
+}
+
+func TestBecomeUsesPrompt(t *testing.T) {
+	tests := []struct {
+		become   Become
+		expected bool
+	}{
+		{Become{Password: "s3cret"}, false},
+		{Become{Method: BecomeSu, Password: "s3cret"}, true},
+		{Become{Method: BecomeDoas, Password: "s3cret"}, true},
+		{Become{Method: BecomeDoas}, false},
+		{Become{Method: BecomeNone, Password: "s3cret"}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.become.usesPrompt(); got != tt.expected {
+			t.Errorf("Expected usesPrompt %v for %+v, got %v", tt.expected, tt.become, got)
+		}
+	}
+}
+
+func TestSudoPasswordOnStdin(t *testing.T) {
+	// A fake sudo reads the password from stdin like sudo -S and runs the command
+	dir := t.TempDir()
+	fakeSudo := "#!/bin/sh\nif [ \"$1\" = -S ]; then read -r password; echo \"password=$password\" >&2; fi\nshift 5\nexec \"$@\"\n"
+	if err := os.WriteFile(filepath.Join(dir, "sudo"), []byte(fakeSudo), 0755); err != nil {
+		t.Fatalf("Failed to write fake sudo: %v", err)
+	}
+
+	password := `p'a"s$(reboot)`
+	commandLine, err := Become{Password: password}.commandLine("cat; echo done")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	cmd := osexec.Command("sh", "-c", commandLine)
+	cmd.Env = append(os.Environ(), "PATH="+dir+":"+os.Getenv("PATH"))
+	cmd.Stdin = strings.NewReader(password + "\n")
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("Failed to run command: %v: %s", err, stderr.String())
+	}
+	if string(output) != "done\n" {
+		t.Errorf("Expected the command to get an empty stdin, got %q", output)
+	}
+	if stderr.String() != "password="+password+"\n" {
+		t.Errorf("Expected sudo to read the password, got %q", stderr.String())
+	}
+}
+
+func TestPromptResponder(t *testing.T) {
+	var stdin bytes.Buffer
+	responder := &promptResponder{stdin: &stdin, password: "s3cret"}
+	for _, chunk := range []string{"doas (admin@lb1) pass", "word: ", "\r\n", "line 1\r\nline 2\r\n"} {
+		if _, err := responder.Write([]byte(chunk)); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if stdin.String() != "s3cret\n" {
+		t.Errorf("Expected the password to be typed once, got %q", stdin.String())
+	}
+	if responder.Output() != "line 1\nline 2\n" {
+		t.Errorf("Expected output without the prompt, got %q", responder.Output())
+	}
+
+	stdin.Reset()
+	responder = &promptResponder{stdin: &stdin, password: "s3cret"}
+	responder.Write([]byte("no prompt\r\n"))
+	if stdin.Len() != 0 || responder.Output() != "no prompt\n" {
+		t.Errorf("Expected output without a prompt to be kept, got %q", responder.Output())
+	}
+}
@@ -0,0 +1,186 @@
+package exec
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// FileOptions sets the ownership and permissions of a transferred file, and
+// whether the previous remote file is kept as a backup when it is replaced
+type FileOptions struct {
+	Owner  string
+	Group  string
+	Mode   string
+	Backup bool
+	// Validate is a command run against the uploaded file before it replaces the
+	// remote file, %s is replaced with the path of the uploaded file
+	Validate string
+}
+
+// ParseMode parses an octal file mode like "0640"
+func ParseMode(mode string) (os.FileMode, error) {
+	value, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || value > 07777 {
+		return 0, fmt.Errorf("invalid file mode %q, expected an octal mode like 0644", mode)
+	}
+	return os.FileMode(value), nil
+}
+
+// backupPath returns the path of a timestamped backup copy of a remote file
+func backupPath(remoteFilePath string, now time.Time) string {
+	return fmt.Sprintf("%s.%s~", remoteFilePath, now.Format("20060102T150405"))
+}
+
+// backupCommand returns a command which copies an existing remote file to a
+// timestamped backup, keeping its owner and mode
+func backupCommand(remoteFilePath string, now time.Time) string {
+	quoted := ShellQuote(remoteFilePath)
+	return fmt.Sprintf("if [ -e %s ]; then cp -p %s %s; fi", quoted, quoted, ShellQuote(backupPath(remoteFilePath, now)))
+}
+
+// attributeCommands returns the commands which set the owner, group and mode
+// of a remote file, none when the options leave them unset
+func attributeCommands(remoteFilePath string, options FileOptions) ([]string, error) {
+	quoted := ShellQuote(remoteFilePath)
+
+	var commands []string
+	if options.Owner != "" || options.Group != "" {
+		owner := options.Owner
+		if options.Group != "" {
+			owner += ":" + options.Group
+		}
+		commands = append(commands, fmt.Sprintf("chown %s %s", ShellQuote(owner), quoted))
+	}
+	if options.Mode != "" {
+		mode, err := ParseMode(options.Mode)
+		if err != nil {
+			return nil, err
+		}
+		commands = append(commands, fmt.Sprintf("chmod %04o %s", uint32(mode), quoted))
+	}
+	return commands, nil
+}
+
+// statAttributesFormat prints the "owner group uid gid mode" of a file with stat -c
+const statAttributesFormat = "%U %G %u %g %a"
+
+// attributesDiffer compares the "owner group uid gid mode" output of stat with
+// the options. Numeric owners and groups are compared with the uid and gid.
+func attributesDiffer(statOutput string, options FileOptions) (bool, error) {
+	fields := strings.Fields(statOutput)
+	if len(fields) != 5 {
+		return false, fmt.Errorf("unexpected stat output %q", statOutput)
+	}
+
+	if options.Owner != "" && options.Owner != idField(options.Owner, fields[0], fields[2]) {
+		return true, nil
+	}
+	if options.Group != "" && options.Group != idField(options.Group, fields[1], fields[3]) {
+		return true, nil
+	}
+	if options.Mode != "" {
+		want, err := ParseMode(options.Mode)
+		if err != nil {
+			return false, err
+		}
+		got, err := ParseMode(fields[4])
+		if err != nil {
+			return false, err
+		}
+		if want != got {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// idField returns the numeric id when the configured owner or group is
+// numeric, and the name otherwise
+func idField(configured string, name string, id string) string {
+	if _, err := strconv.ParseUint(configured, 10, 32); err == nil {
+		return id
+	}
+	return name
+}
+
+// RemoteAttributesDiffer reports whether the owner, group or mode of an
+// existing remote file differ from the options
+func RemoteAttributesDiffer(client *ssh.Client, remoteFilePath string, options FileOptions, sudo bool, become Become) (bool, error) {
+	if options.Owner == "" && options.Group == "" && options.Mode == "" {
+		return false, nil
+	}
+
+	statCommand := fmt.Sprintf("stat -c '%s' %s", statAttributesFormat, ShellQuote(remoteFilePath))
+	var output string
+	var err error
+	if sudo {
+		output, err = RunRemoteCommandWithBecomeOutput(client, statCommand, become)
+	} else {
+		output, err = RunRemoteCommandWithOutput(client, statCommand)
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read attributes of remote file %s: %w", remoteFilePath, err)
+	}
+	return attributesDiffer(output, options)
+}
+
+// applyFileAttributes sets the owner, group and mode of an existing remote
+// file when they differ from the options, and reports whether it changed them
+func applyFileAttributes(client *ssh.Client, remoteFilePath string, options FileOptions, sudo bool, become Become) (bool, error) {
+	commands, err := attributeCommands(remoteFilePath, options)
+	if err != nil || len(commands) == 0 {
+		return false, err
+	}
+
+	differ, err := RemoteAttributesDiffer(client, remoteFilePath, options, sudo, become)
+	if err != nil || !differ {
+		return false, err
+	}
+
+	if err := runFileCommands(client, commands, sudo, become); err != nil {
+		return false, fmt.Errorf("failed to set attributes of remote file %s: %w", remoteFilePath, err)
+	}
+	logger.Infof("Updated owner and mode of %s:%s", client.RemoteAddr(), remoteFilePath)
+	return true, nil
+}
+
+// runFileCommands runs shell commands on a remote file as one command, through sudo when requested
+func runFileCommands(client *ssh.Client, commands []string, sudo bool, become Become) error {
+	command := strings.Join(commands, " && ")
+	if sudo {
+		return RunRemoteCommandWithBecome(client, command, become)
+	}
+	return RunRemoteCommand(client, command)
+}
+
+// validateCommand substitutes the path of the uploaded file into a validate command
+func validateCommand(validate string, remoteFilePath string) (string, error) {
+	if !strings.Contains(validate, "%s") {
+		return "", fmt.Errorf("validate command %q must contain %%s for the file to validate", validate)
+	}
+	return strings.ReplaceAll(validate, "%s", ShellQuote(remoteFilePath)), nil
+}
+
+// validateRemoteFile runs the validate command against an uploaded file, the
+// returned error contains the stderr of the validator
+func validateRemoteFile(client *ssh.Client, remoteFilePath string, validate string, sudo bool, become Become) error {
+	command, err := validateCommand(validate, remoteFilePath)
+	if err != nil {
+		return err
+	}
+	if sudo {
+		_, err = RunRemoteCommandWithBecomeOutput(client, command, become)
+	} else {
+		_, err = RunRemoteCommandWithOutput(client, command)
+	}
+	if err != nil {
+		return err
+	}
+	logger.Infof("Validated %s:%s with %s", client.RemoteAddr(), remoteFilePath, validate)
+	return nil
+}
@@ -0,0 +1,119 @@
+package exec
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseMode(t *testing.T) {
+	tests := []struct {
+		mode     string
+		expected os.FileMode
+		wantErr  bool
+	}{
+		{"0644", 0644, false},
+		{"600", 0600, false},
+		{"4755", 04755, false},
+		{"0999", 0, true},
+		{"rw-r--r--", 0, true},
+		{"17777", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			mode, err := ParseMode(tt.mode)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expected error %v, got %v", tt.wantErr, err)
+			}
+			if mode != tt.expected {
+				t.Errorf("Expected mode %o, got %o", tt.expected, mode)
+			}
+		})
+	}
+}
+
+func TestAttributeCommands(t *testing.T) {
+	commands, err := attributeCommands("/etc/sudoers.d/deploy", FileOptions{Owner: "root", Group: "root", Mode: "440"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []string{
+		"chown 'root:root' '/etc/sudoers.d/deploy'",
+		"chmod 0440 '/etc/sudoers.d/deploy'",
+	}
+	if len(commands) != len(expected) {
+		t.Fatalf("Expected %d commands, got %v", len(expected), commands)
+	}
+	for i := range expected {
+		if commands[i] != expected[i] {
+			t.Errorf("Expected command '%s', got '%s'", expected[i], commands[i])
+		}
+	}
+
+	commands, err = attributeCommands("/etc/motd", FileOptions{Group: "adm"})
+	if err != nil || len(commands) != 1 || commands[0] != "chown ':adm' '/etc/motd'" {
+		t.Errorf("Expected group only chown, got %v %v", commands, err)
+	}
+
+	if commands, _ := attributeCommands("/etc/motd", FileOptions{}); len(commands) != 0 {
+		t.Errorf("Expected no commands without options, got %v", commands)
+	}
+}
+
+func TestAttributesDiffer(t *testing.T) {
+	tests := []struct {
+		name     string
+		output   string
+		options  FileOptions
+		expected bool
+	}{
+		{"matching", "root root 0 0 640\n", FileOptions{Owner: "root", Group: "root", Mode: "0640"}, false},
+		{"owner differs", "ubuntu root 1000 0 640\n", FileOptions{Owner: "root"}, true},
+		{"group differs", "root root 0 0 640\n", FileOptions{Group: "haproxy"}, true},
+		{"mode differs", "root root 0 0 644\n", FileOptions{Mode: "0600"}, true},
+		{"numeric ids match", "www-data www-data 33 33 640\n", FileOptions{Owner: "33", Group: "33"}, false},
+		{"numeric owner differs", "ubuntu www-data 1000 33 640\n", FileOptions{Owner: "33"}, true},
+		{"unknown uid matches", "UNKNOWN UNKNOWN 1500 1500 640\n", FileOptions{Owner: "1500", Group: "1500"}, false},
+		{"unset options are ignored", "ubuntu ubuntu 1000 1000 777\n", FileOptions{Backup: true}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			differ, err := attributesDiffer(tt.output, tt.options)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if differ != tt.expected {
+				t.Errorf("Expected %v, got %v", tt.expected, differ)
+			}
+		})
+	}
+
+	if _, err := attributesDiffer("stat: cannot stat", FileOptions{Mode: "0644"}); err == nil {
+		t.Errorf("Expected error for unexpected stat output")
+	}
+}
+
+func TestBackupPath(t *testing.T) {
+	now := time.Date(2024, 3, 5, 14, 7, 9, 0, time.UTC)
+	expected := "/etc/haproxy/haproxy.cfg.20240305T140709~"
+	if path := backupPath("/etc/haproxy/haproxy.cfg", now); path != expected {
+		t.Errorf("Expected backup path '%s', got '%s'", expected, path)
+	}
+}
+
+func TestValidateCommand(t *testing.T) {
+	command, err := validateCommand("haproxy -c -f %s", "/etc/haproxy/.haproxy.cfg.steward")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := "haproxy -c -f '/etc/haproxy/.haproxy.cfg.steward'"
+	if command != expected {
+		t.Errorf("Expected command '%s', got '%s'", expected, command)
+	}
+
+	if _, err := validateCommand("visudo -c", "/tmp/deploy"); err == nil {
+		t.Errorf("Expected error for a validate command without %%s")
+	}
+}
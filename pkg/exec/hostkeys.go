@@ -0,0 +1,336 @@
+package exec
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Host key checking modes
+const (
+	HostKeyStrict = "strict" // Unknown host keys are rejected
+	HostKeyTOFU   = "tofu"   // Unknown host keys are trusted and recorded on first use, the default
+	HostKeyOff    = "off"    // Host keys are not verified
+)
+
+// HostKeyCheckingModes are the supported host key checking modes
+var HostKeyCheckingModes = []string{HostKeyStrict, HostKeyTOFU, HostKeyOff}
+
+// trustFileMutex serializes writes to the trust file by concurrent connections
+var trustFileMutex sync.Mutex
+
+// HostKeyPolicy configures how the host key of an SSH server is verified. A
+// pinned HostKey is checked on its own. Otherwise the trust file is checked
+// first, so keys accepted with steward host trust override stale entries of
+// the known hosts files.
+type HostKeyPolicy struct {
+	// Checking is one of HostKeyCheckingModes, tofu when empty
+	Checking string
+	// HostKey pins the key of the host, as SHA256:<base64> fingerprint or authorized key line
+	HostKey string
+	// KnownHostsFiles are read only known_hosts files, ~/.ssh/known_hosts when nil
+	KnownHostsFiles []string
+	// TrustFile is the known_hosts file steward records trusted keys in, ~/.steward/known_hosts when empty
+	TrustFile string
+}
+
+// HostKeyError reports a host key which does not match the known key of a host
+type HostKeyError struct {
+	// Host names the host in the configuration
+	Host        string
+	Address     string
+	Fingerprint string
+	// Known describes the known keys, like SHA256:... (~/.ssh/known_hosts:12)
+	Known []string
+	// Pinned is set when the known key is the host_key of the host
+	Pinned bool
+}
+
+func (e *HostKeyError) Error() string {
+	hint := fmt.Sprintf("run steward host trust --host %s", e.Host)
+	if e.Pinned {
+		hint = "update host_key in the configuration"
+	}
+	return fmt.Sprintf("host key of %s changed to %s, known keys are %s. This may be a man-in-the-middle attack. "+
+		"If the change is expected, %s", e.Address, e.Fingerprint, strings.Join(e.Known, ", "), hint)
+}
+
+// DefaultKnownHostsFiles returns the known_hosts file of the user
+func DefaultKnownHostsFiles() []string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil
+	}
+	return []string{filepath.Join(home, ".ssh", "known_hosts")}
+}
+
+// DefaultTrustFile returns the known_hosts file managed by steward
+func DefaultTrustFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(".steward", "known_hosts")
+	}
+	return filepath.Join(home, ".steward", "known_hosts")
+}
+
+// withDefaults fills the unset files of the policy
+func (p HostKeyPolicy) withDefaults() HostKeyPolicy {
+	if p.Checking == "" {
+		p.Checking = HostKeyTOFU
+	}
+	if p.KnownHostsFiles == nil {
+		p.KnownHostsFiles = DefaultKnownHostsFiles()
+	}
+	if p.TrustFile == "" {
+		p.TrustFile = DefaultTrustFile()
+	}
+	return p
+}
+
+// clientConfig sets the host key callback and the host key algorithms of an
+// SSH client config for a server address of the host name. Algorithms are
+// limited to the types of known keys, so the server never offers a key of a
+// type which is unknown.
+func (p HostKeyPolicy) clientConfig(config *ssh.ClientConfig, address string, name string) error {
+	p = p.withDefaults()
+
+	switch p.Checking {
+	case HostKeyOff:
+		logger.Warnf("Host key checking is off for %s", address)
+		config.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+		return nil
+	case HostKeyStrict, HostKeyTOFU:
+	default:
+		return fmt.Errorf("unknown host key checking %q, supported are %s", p.Checking, strings.Join(HostKeyCheckingModes, ", "))
+	}
+
+	if p.HostKey != "" {
+		pinned, err := pinnedHostKey(p.HostKey, name)
+		if err != nil {
+			return err
+		}
+		config.HostKeyCallback = pinned
+		return nil
+	}
+
+	trusted, err := knownHostsCallback([]string{p.TrustFile})
+	if err != nil {
+		return err
+	}
+	known, err := knownHostsCallback(p.KnownHostsFiles)
+	if err != nil {
+		return err
+	}
+
+	config.HostKeyAlgorithms = knownKeyAlgorithms(address, trusted, known)
+	config.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		for _, callback := range []ssh.HostKeyCallback{trusted, known} {
+			if callback == nil {
+				continue
+			}
+			err := callback(hostname, remote, key)
+			if err == nil {
+				return nil
+			}
+			var keyErr *knownhosts.KeyError
+			if !errors.As(err, &keyErr) {
+				return err
+			}
+			if len(keyErr.Want) > 0 {
+				return newHostKeyError(name, hostname, key, keyErr.Want)
+			}
+		}
+
+		// The host is not known
+		if p.Checking == HostKeyStrict {
+			return fmt.Errorf("host key %s of %s is unknown, run steward host trust --host %s to trust it",
+				ssh.FingerprintSHA256(key), hostname, name)
+		}
+		if err := TrustHostKey(p.TrustFile, hostname, key); err != nil {
+			return err
+		}
+		logger.Warnf("Trusted new host key %s of %s on first use, recorded in %s", ssh.FingerprintSHA256(key), hostname, p.TrustFile)
+		return nil
+	}
+	return nil
+}
+
+// ValidateHostKey checks that a pinned host key is a SHA256: fingerprint or public key
+func ValidateHostKey(hostKey string) error {
+	_, err := pinnedHostKey(hostKey, "")
+	return err
+}
+
+// pinnedHostKey accepts only the pinned key of a host, given as SHA256
+// fingerprint or authorized key line
+func pinnedHostKey(hostKey string, name string) (ssh.HostKeyCallback, error) {
+	fingerprint := hostKey
+	if !strings.HasPrefix(hostKey, "SHA256:") {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(hostKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid host_key %q, expected a SHA256: fingerprint or public key: %v", hostKey, err)
+		}
+		fingerprint = ssh.FingerprintSHA256(key)
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if got := ssh.FingerprintSHA256(key); got != fingerprint {
+			return &HostKeyError{Host: name, Address: hostname, Fingerprint: got, Known: []string{fingerprint + " (host_key)"}, Pinned: true}
+		}
+		return nil
+	}, nil
+}
+
+// knownHostsCallback checks keys against the known_hosts files which exist,
+// it is nil when none of them exists
+func knownHostsCallback(files []string) (ssh.HostKeyCallback, error) {
+	var existing []string
+	for _, file := range files {
+		if _, err := os.Stat(file); err == nil {
+			existing = append(existing, file)
+		}
+	}
+	if len(existing) == 0 {
+		return nil, nil
+	}
+	callback, err := knownhosts.New(existing...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read known hosts: %w", err)
+	}
+	return callback, nil
+}
+
+// knownKeyAlgorithms returns the host key algorithms of the keys known for an
+// address, nil when no key is known so any algorithm is accepted
+func knownKeyAlgorithms(address string, callbacks ...ssh.HostKeyCallback) []string {
+	// Checking a key which is never known lists the known keys of the address
+	probe, err := ssh.NewPublicKey(ed25519.PublicKey(make([]byte, ed25519.PublicKeySize)))
+	if err != nil {
+		return nil
+	}
+
+	var algorithms []string
+	seen := make(map[string]bool)
+	for _, callback := range callbacks {
+		if callback == nil {
+			continue
+		}
+		var keyErr *knownhosts.KeyError
+		if !errors.As(callback(address, &net.TCPAddr{}, probe), &keyErr) || len(keyErr.Want) == 0 {
+			continue
+		}
+		// Keys of the first file knowing the address are the ones accepted
+		for _, known := range keyErr.Want {
+			for _, algorithm := range keyAlgorithms(known.Key.Type()) {
+				if !seen[algorithm] {
+					seen[algorithm] = true
+					algorithms = append(algorithms, algorithm)
+				}
+			}
+		}
+		return algorithms
+	}
+	return nil
+}
+
+// keyAlgorithms returns the signature algorithms of a key type, RSA keys sign
+// with SHA-2 or SHA-1
+func keyAlgorithms(keyType string) []string {
+	if keyType == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+	return []string{keyType}
+}
+
+// newHostKeyError describes a mismatch with the known keys of a host
+func newHostKeyError(name string, address string, key ssh.PublicKey, want []knownhosts.KnownKey) *HostKeyError {
+	err := &HostKeyError{Host: name, Address: address, Fingerprint: ssh.FingerprintSHA256(key)}
+	for _, known := range want {
+		err.Known = append(err.Known, fmt.Sprintf("%s (%s:%d)", ssh.FingerprintSHA256(known.Key), known.Filename, known.Line))
+	}
+	return err
+}
+
+// TrustHostKey records key as the only trusted key of an address in a
+// known_hosts file, replacing the keys recorded for it before
+func TrustHostKey(trustFile string, address string, key ssh.PublicKey) error {
+	trustFileMutex.Lock()
+	defer trustFileMutex.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(trustFile), 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(trustFile), err)
+	}
+	data, err := os.ReadFile(trustFile)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read %s: %w", trustFile, err)
+	}
+
+	normalized := knownhosts.Normalize(address)
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if hosts, _, ok := strings.Cut(strings.TrimSpace(line), " "); ok {
+			if slices.Contains(strings.Split(hosts, ","), normalized) {
+				continue
+			}
+		}
+		out.WriteString(line + "\n")
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read %s: %w", trustFile, err)
+	}
+	out.WriteString(knownhosts.Line([]string{normalized}, key) + "\n")
+
+	if err := os.WriteFile(trustFile, out.Bytes(), 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %w", trustFile, err)
+	}
+	return nil
+}
+
+// ScanHostKey returns the host key an SSH server presents and the address
+// it is recorded for, without verifying the key or authenticating. Jump hosts
+// of the SSH config are connected to and verified as usual.
+func ScanHostKey(options SSHOptions) (ssh.PublicKey, string, error) {
+	auth := newSSHAuth()
+	defer auth.close()
+
+	target, jumps, err := auth.dialJumps(options)
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() {
+		for i := len(jumps) - 1; i >= 0; i-- {
+			jumps[i].Close()
+		}
+	}()
+
+	var hostKey ssh.PublicKey
+	errScanned := errors.New("host key scanned")
+	config := &ssh.ClientConfig{
+		User: target.user,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			hostKey = key
+			return errScanned
+		},
+	}
+	client, err := dialSSH(lastClient(jumps), target.address, config)
+	if client != nil {
+		client.Close()
+	}
+	if hostKey == nil {
+		return nil, "", fmt.Errorf("failed to get the host key of %s (%s): %v", target.name, target.address, err)
+	}
+	return hostKey, target.address, nil
+}
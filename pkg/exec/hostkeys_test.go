@@ -0,0 +1,165 @@
+package exec
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newTestHostKey(t *testing.T) ssh.PublicKey {
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	key, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatalf("Failed to convert key: %v", err)
+	}
+	return key
+}
+
+// checkHostKey runs the host key callback of a policy for a key presented by address
+func checkHostKey(t *testing.T, policy HostKeyPolicy, address string, key ssh.PublicKey) (*ssh.ClientConfig, error) {
+	config := &ssh.ClientConfig{}
+	if err := policy.clientConfig(config, address, hostOnly(address)); err != nil {
+		t.Fatalf("Failed to configure host key checking: %v", err)
+	}
+	remote, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		t.Fatalf("Failed to resolve %s: %v", address, err)
+	}
+	return config, config.HostKeyCallback(address, remote, key)
+}
+
+func TestHostKeyPolicyTrustOnFirstUse(t *testing.T) {
+	dir := t.TempDir()
+	policy := HostKeyPolicy{KnownHostsFiles: []string{}, TrustFile: filepath.Join(dir, "steward", "known_hosts")}
+	key := newTestHostKey(t)
+
+	if _, err := checkHostKey(t, policy, "192.168.100.14:22", key); err != nil {
+		t.Fatalf("Expected unknown key to be trusted on first use, got %v", err)
+	}
+	data, err := os.ReadFile(policy.TrustFile)
+	if err != nil {
+		t.Fatalf("Expected the key to be recorded: %v", err)
+	}
+	if !strings.HasPrefix(string(data), "192.168.100.14 ssh-ed25519 ") {
+		t.Errorf("Unexpected trust file %s", data)
+	}
+
+	config, err := checkHostKey(t, policy, "192.168.100.14:22", key)
+	if err != nil {
+		t.Errorf("Expected recorded key to be accepted, got %v", err)
+	}
+	if len(config.HostKeyAlgorithms) != 1 || config.HostKeyAlgorithms[0] != ssh.KeyAlgoED25519 {
+		t.Errorf("Expected host key algorithms of the known key, got %v", config.HostKeyAlgorithms)
+	}
+
+	_, err = checkHostKey(t, policy, "192.168.100.14:22", newTestHostKey(t))
+	var keyErr *HostKeyError
+	if !errors.As(err, &keyErr) {
+		t.Fatalf("Expected HostKeyError for a changed key, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "steward host trust --host 192.168.100.14") {
+		t.Errorf("Expected the error to explain how to trust the key, got %v", err)
+	}
+}
+
+func TestHostKeyPolicyStrict(t *testing.T) {
+	dir := t.TempDir()
+	policy := HostKeyPolicy{Checking: HostKeyStrict, KnownHostsFiles: []string{}, TrustFile: filepath.Join(dir, "known_hosts")}
+
+	if _, err := checkHostKey(t, policy, "192.168.100.14:22", newTestHostKey(t)); err == nil || !strings.Contains(err.Error(), "is unknown") {
+		t.Errorf("Expected unknown key to be rejected, got %v", err)
+	}
+	if _, err := os.Stat(policy.TrustFile); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing to be recorded in strict mode")
+	}
+}
+
+func TestHostKeyPolicyTrustFileOverridesKnownHosts(t *testing.T) {
+	dir := t.TempDir()
+	oldKey, newKey := newTestHostKey(t), newTestHostKey(t)
+	knownHosts := filepath.Join(dir, "known_hosts")
+	if err := os.WriteFile(knownHosts, []byte(knownhosts.Line([]string{"[192.168.100.14]:2222"}, oldKey)+"\n"), 0600); err != nil {
+		t.Fatalf("Failed to write known_hosts: %v", err)
+	}
+	policy := HostKeyPolicy{KnownHostsFiles: []string{knownHosts}, TrustFile: filepath.Join(dir, "trusted")}
+
+	if _, err := checkHostKey(t, policy, "192.168.100.14:2222", oldKey); err != nil {
+		t.Errorf("Expected key from known_hosts to be accepted, got %v", err)
+	}
+	if _, err := checkHostKey(t, policy, "192.168.100.14:2222", newKey); err == nil || !strings.Contains(err.Error(), knownHosts+":1") {
+		t.Errorf("Expected mismatch with the known_hosts entry, got %v", err)
+	}
+
+	if err := TrustHostKey(policy.TrustFile, "192.168.100.14:2222", newKey); err != nil {
+		t.Fatalf("Failed to trust key: %v", err)
+	}
+	if _, err := checkHostKey(t, policy, "192.168.100.14:2222", newKey); err != nil {
+		t.Errorf("Expected trusted key to override known_hosts, got %v", err)
+	}
+	if _, err := checkHostKey(t, policy, "192.168.100.14:2222", oldKey); err == nil {
+		t.Errorf("Expected the old key to be rejected once a new key is trusted")
+	}
+}
+
+func TestHostKeyPolicyPinned(t *testing.T) {
+	key := newTestHostKey(t)
+	policies := []HostKeyPolicy{
+		{HostKey: ssh.FingerprintSHA256(key), KnownHostsFiles: []string{}, TrustFile: filepath.Join(t.TempDir(), "known_hosts")},
+		{HostKey: strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))), KnownHostsFiles: []string{}, TrustFile: filepath.Join(t.TempDir(), "known_hosts")},
+	}
+	for _, policy := range policies {
+		if _, err := checkHostKey(t, policy, "192.168.100.14:22", key); err != nil {
+			t.Errorf("Expected pinned key to be accepted, got %v", err)
+		}
+		_, err := checkHostKey(t, policy, "192.168.100.14:22", newTestHostKey(t))
+		var keyErr *HostKeyError
+		if !errors.As(err, &keyErr) || !keyErr.Pinned {
+			t.Errorf("Expected pinned HostKeyError, got %v", err)
+		}
+	}
+
+	if err := ValidateHostKey("not a key"); err == nil {
+		t.Errorf("Expected error for an invalid host key")
+	}
+}
+
+func TestTrustHostKeyReplacesEntries(t *testing.T) {
+	trustFile := filepath.Join(t.TempDir(), "known_hosts")
+	other := knownhosts.Line([]string{"192.168.100.15"}, newTestHostKey(t))
+	if err := os.WriteFile(trustFile, []byte(other+"\n"+knownhosts.Line([]string{"192.168.100.14"}, newTestHostKey(t))+"\n"), 0600); err != nil {
+		t.Fatalf("Failed to write trust file: %v", err)
+	}
+
+	key := newTestHostKey(t)
+	if err := TrustHostKey(trustFile, "192.168.100.14:22", key); err != nil {
+		t.Fatalf("Failed to trust key: %v", err)
+	}
+	data, err := os.ReadFile(trustFile)
+	if err != nil {
+		t.Fatalf("Failed to read trust file: %v", err)
+	}
+	expected := other + "\n" + knownhosts.Line([]string{"192.168.100.14"}, key) + "\n"
+	if string(data) != expected {
+		t.Errorf("Expected %s, got %s", expected, data)
+	}
+}
+
+// hostOnly returns the host of an address without its port
+func hostOnly(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	return host
+}
@@ -1,9 +1,10 @@
 package exec
 
 import (
-	"os"
 	"bytes"
 	"fmt"
+	"net"
+	"os/user"
     "strings"
 
 	"steward/utils"
@@ -19,47 +20,251 @@ const (
     LazyMatch                        // Partial or substring match
 )
 
-// SetupSSHClient sets up an SSH client. Password is optional.
-// If password is not provided, use SSH key authentication.
-func SetupSSHClient(host string, port string, user string, password string, keyPath string) (*ssh.Client, error) {
-    var authMethods []ssh.AuthMethod
+// SSHOptions configures the connection to an SSH server. Settings which are
+// empty are resolved from the OpenSSH client config, like ssh does.
+type SSHOptions struct {
+    // Host is a host name, address or Host alias of the SSH config
+    Host string
+    // Port is 22 when it is not set here or in the SSH config
+    Port string
+    // User is the local user when it is not set here or in the SSH config
+    User string
+    // Password is optional, it is tried after the keys
+    Password string
+    // KeyPath replaces the IdentityFile keys of the SSH config
+    KeyPath string
+    // KeyPassphrase decrypts encrypted keys, they are prompted for on the terminal when it is empty
+    KeyPassphrase string
+    // HostKeys verifies the host key of the server
+    HostKeys HostKeyPolicy
+    // SSHConfigFile is the OpenSSH client config, ~/.ssh/config when empty, "none" to ignore it
+    SSHConfigFile string
+}
+
+// sshTarget is an SSH server with the settings of the SSH config applied
+type sshTarget struct {
+    // name is the host as configured, used in messages
+    name             string
+    address          string
+    user             string
+    password         string
+    identityFiles    []string
+    certificateFiles []string
+    // keyRequired is set when the identity files were configured with KeyPath
+    keyRequired   bool
+    keyPassphrase string
+    proxyJump     string
+    hostKeys      HostKeyPolicy
+}
 
-    // Add password authentication if provided
-    if password != "" {
-        authMethods = append(authMethods, ssh.Password(password))
+// resolve applies the SSH config to the options
+func (o SSHOptions) resolve() (sshTarget, error) {
+    configFile := o.SSHConfigFile
+    if configFile == "" {
+        configFile = DefaultSSHConfigFile()
+    } else if configFile == "none" {
+        configFile = ""
+    }
+    config, err := loadSSHConfig(configFile, o.Host)
+    if err != nil {
+        return sshTarget{}, err
     }
 
-    // Add public key authentication if keyPath is provided
-    if keyPath != "" {
-        privateKey, err := os.ReadFile(keyPath)
+    hostname := o.Host
+    if config.HostName != "" {
+        hostname = strings.ReplaceAll(config.HostName, "%h", o.Host)
+    }
+    port := firstNonEmpty(o.Port, config.Port, "22")
+    remoteUser := firstNonEmpty(o.User, config.User)
+    if remoteUser == "" {
+        current, err := user.Current()
         if err != nil {
-            return nil, fmt.Errorf("failed to load SSH key: %v", err)
+            return sshTarget{}, fmt.Errorf("no SSH user for %s: %v", o.Host, err)
+        }
+        remoteUser = current.Username
+    }
+
+    target := sshTarget{
+        name:          o.Host,
+        address:       net.JoinHostPort(hostname, port),
+        user:          remoteUser,
+        password:      o.Password,
+        keyPassphrase: o.KeyPassphrase,
+        proxyJump:     config.ProxyJump,
+        hostKeys:      o.HostKeys,
+    }
+    identityFiles := config.IdentityFiles
+    if o.KeyPath != "" {
+        identityFiles = []string{o.KeyPath}
+        target.keyRequired = true
+    } else if len(identityFiles) == 0 {
+        identityFiles = defaultIdentityFiles
+    }
+    for _, file := range identityFiles {
+        target.identityFiles = append(target.identityFiles, expandSSHTokens(file, hostname, port, remoteUser))
+    }
+    for _, file := range config.CertificateFiles {
+        target.certificateFiles = append(target.certificateFiles, expandSSHTokens(file, hostname, port, remoteUser))
+    }
+    return target, nil
+}
+
+// jumpHosts returns the options of the ProxyJump hosts of a target, each
+// given as [user@]host[:port]. Jump hosts authenticate with the keys of the
+// SSH config and the agent, their own ProxyJump is not followed.
+func (o SSHOptions) jumpHosts(proxyJump string) ([]SSHOptions, error) {
+    if proxyJump == "" || strings.EqualFold(proxyJump, "none") {
+        return nil, nil
+    }
+    var jumps []SSHOptions
+    for _, jump := range strings.Split(proxyJump, ",") {
+        jumpUser, hostPort, found := strings.Cut(strings.TrimPrefix(jump, "ssh://"), "@")
+        if !found {
+            jumpUser, hostPort = "", jumpUser
+        }
+        jumpHost, jumpPort := hostPort, ""
+        if host, port, err := net.SplitHostPort(hostPort); err == nil {
+            jumpHost, jumpPort = host, port
+        }
+        if jumpHost == "" {
+            return nil, fmt.Errorf("invalid ProxyJump %q", proxyJump)
+        }
+        jumps = append(jumps, SSHOptions{
+            Host:          jumpHost,
+            Port:          jumpPort,
+            User:          jumpUser,
+            HostKeys:      HostKeyPolicy{Checking: o.HostKeys.Checking, KnownHostsFiles: o.HostKeys.KnownHostsFiles, TrustFile: o.HostKeys.TrustFile},
+            SSHConfigFile: o.SSHConfigFile,
+        })
+    }
+    return jumps, nil
+}
+
+// SetupSSHClient connects and authenticates to an SSH server, through the
+// ProxyJump hosts of the SSH config. Keys of the agent of SSH_AUTH_SOCK are
+// offered after the key files, the password is tried last.
+func SetupSSHClient(options SSHOptions) (*ssh.Client, error) {
+    auth := newSSHAuth()
+    defer auth.close()
+
+    target, jumps, err := auth.dialJumps(options)
+    if err != nil {
+        return nil, err
+    }
+    closeJumps := func() {
+        for i := len(jumps) - 1; i >= 0; i-- {
+            jumps[i].Close()
         }
-        // Create the Signer for this private key.
-        signer, err := ssh.ParsePrivateKey(privateKey)
+    }
+
+    authMethods, err := auth.authMethods(target)
+    if err != nil {
+        closeJumps()
+        return nil, err
+    }
+    sshConfig := &ssh.ClientConfig{
+        User: target.user,
+        Auth: authMethods,
+    }
+    if err := target.hostKeys.clientConfig(sshConfig, target.address, target.name); err != nil {
+        closeJumps()
+        return nil, err
+    }
+
+    client, err := dialSSH(lastClient(jumps), target.address, sshConfig)
+    if err != nil {
+        closeJumps()
+        return nil, fmt.Errorf("failed to connect to SSH server %s (%s): %w", target.name, target.address, err)
+    }
+    if len(jumps) > 0 {
+        // The jump hosts carry the connection until it is closed
+        go func() {
+            client.Wait()
+            closeJumps()
+        }()
+    }
+    return client, nil
+}
+
+// dialJumps resolves the options and connects to the jump hosts of the
+// target in order, the last one carries the connection to the target
+func (a *sshAuth) dialJumps(options SSHOptions) (sshTarget, []*ssh.Client, error) {
+    target, err := options.resolve()
+    if err != nil {
+        return sshTarget{}, nil, err
+    }
+    jumpOptions, err := options.jumpHosts(target.proxyJump)
+    if err != nil {
+        return sshTarget{}, nil, err
+    }
+
+    var jumps []*ssh.Client
+    for _, jumpOption := range jumpOptions {
+        jump, err := a.dialJump(lastClient(jumps), jumpOption)
         if err != nil {
-            logger.Fatalf("Unable to parse private key: %v", err)
+            for i := len(jumps) - 1; i >= 0; i-- {
+                jumps[i].Close()
+            }
+            return sshTarget{}, nil, fmt.Errorf("failed to connect to jump host %s of %s: %w", jumpOption.Host, options.Host, err)
         }
-        authMethods = append(authMethods, ssh.PublicKeys(signer))
-    } else if password == "" {
-        // If no password and no keyPath, return an error
-        return nil, fmt.Errorf("either password or SSH key must be provided")
+        jumps = append(jumps, jump)
     }
+    return target, jumps, nil
+}
 
-    // Configure the SSH client
+// dialJump connects to a jump host, directly or through the previous one
+func (a *sshAuth) dialJump(via *ssh.Client, options SSHOptions) (*ssh.Client, error) {
+    target, err := options.resolve()
+    if err != nil {
+        return nil, err
+    }
+    authMethods, err := a.authMethods(target)
+    if err != nil {
+        return nil, err
+    }
     sshConfig := &ssh.ClientConfig{
-        User:            user,
-        Auth:            authMethods,
-        HostKeyCallback: ssh.InsecureIgnoreHostKey(), // Skip host key verification (not recommended for production)
+        User: target.user,
+        Auth: authMethods,
     }
+    if err := target.hostKeys.clientConfig(sshConfig, target.address, target.name); err != nil {
+        return nil, err
+    }
+    return dialSSH(via, target.address, sshConfig)
+}
 
-    // Connect to the SSH server
-    client, err := ssh.Dial("tcp", host+":"+port, sshConfig)
+// dialSSH connects to an SSH server directly, or through a jump host when via is set
+func dialSSH(via *ssh.Client, address string, config *ssh.ClientConfig) (*ssh.Client, error) {
+    if via == nil {
+        return ssh.Dial("tcp", address, config)
+    }
+    conn, err := via.Dial("tcp", address)
     if err != nil {
-        return nil, fmt.Errorf("failed to connect to SSH server: %s, %s, %v",host, port, err)
+        return nil, err
     }
+    clientConn, channels, requests, err := ssh.NewClientConn(conn, address, config)
+    if err != nil {
+        conn.Close()
+        return nil, err
+    }
+    return ssh.NewClient(clientConn, channels, requests), nil
+}
 
-    return client, nil
+// lastClient returns the last jump host, nil without jump hosts
+func lastClient(jumps []*ssh.Client) *ssh.Client {
+    if len(jumps) == 0 {
+        return nil
+    }
+    return jumps[len(jumps)-1]
+}
+
+// firstNonEmpty returns the first value which is not empty
+func firstNonEmpty(values ...string) string {
+    for _, value := range values {
+        if value != "" {
+            return value
+        }
+    }
+    return ""
 }
 
 // RunRemoteCommand executes a remote command on the SSH server
@@ -151,93 +356,33 @@ func RunRemoteCommandWithValidation(client *ssh.Client, command string, expected
     return nil
 }
 
-// RunRemoteCommandWithSudo executes a remote command with sudo, dynamically handling password prompts.
-func RunRemoteCommandWithSudo(client *ssh.Client, command string, sudoPassword string) error {
-    // Create a new session for the askpass command
-    askpassSession, err := client.NewSession()
-    if err != nil {
-        return fmt.Errorf("failed to create SSH session for askpass: %w", err)
-    }
-    defer askpassSession.Close()
-
-    // Create the askpass script on the remote server
-    asksudocmd := fmt.Sprintf(`echo '#!/bin/bash
-echo %s' > /tmp/askpass && chmod +x /tmp/askpass`, sudoPassword)
-
-    var stdoutBuf, stderrBuf bytes.Buffer
-    askpassSession.Stdout = &stdoutBuf
-    askpassSession.Stderr = &stderrBuf
-
-    err = askpassSession.Run(asksudocmd)
-    if err != nil {
-        return fmt.Errorf("failed to run askpass command: %w\nstderr: %s", err, stderrBuf.String())
-    }
-
-    // Create a new session for the main command
-    commandSession, err := client.NewSession()
-    if err != nil {
-        return fmt.Errorf("failed to create SSH session for command: %w", err)
-    }
-    defer commandSession.Close()
-
-    // Replace all occurrences of "sudo" with "sudo -A" in the command
-    command = fmt.Sprintf("export SUDO_ASKPASS=/tmp/askpass; %s", strings.ReplaceAll(command, "sudo", "sudo -A"))
-    // command = strings.ReplaceAll(command, "sudo", "sudo -A")
-
-    commandSession.Stdout = &stdoutBuf
-    commandSession.Stderr = &stderrBuf
-
-    // Run the main command
-    err = commandSession.Run(command)
-    if err != nil {
-        return fmt.Errorf("command execution failed: %s %w\nstderr: %s",command, err, stderrBuf.String())
-    }
-
-    return nil
+// RunRemoteCommandWithBecome executes a remote command as the become user,
+// root by default. The whole command runs in a shell of that user, so it does
+// not call sudo itself.
+func RunRemoteCommandWithBecome(client *ssh.Client, command string, become Become) error {
+    _, err := RunRemoteCommandWithBecomeOutput(client, command, become)
+    return err
 }
 
-// RunRemoteCommandWithValidation executes a remote command and validates its output, return error if not valid.
-func RunRemoteCommandWithSudoValidation(client *ssh.Client, command string, expectedOutput string, mode ValidationMode, sudoPassword string) error {
-    // Create a new session for the askpass command
-    askpassSession, err := client.NewSession()
-    if err != nil {
-        return fmt.Errorf("failed to create SSH session for askpass: %w", err)
-    }
-    defer askpassSession.Close()
-
-    // Create the askpass script on the remote server
-    asksudocmd := fmt.Sprintf(`echo '#!/bin/bash
-echo %s' > /tmp/askpass && chmod +x /tmp/askpass`, sudoPassword)
-
-    var stdoutBuf, stderrBuf bytes.Buffer
-    askpassSession.Stdout = &stdoutBuf
-    askpassSession.Stderr = &stderrBuf
-
-    err = askpassSession.Run(asksudocmd)
+// RunRemoteCommandWithBecomeOutput executes a remote command as the become user
+// and returns its output. The password is sent over the SSH session, nothing is
+// written on the remote host.
+func RunRemoteCommandWithBecomeOutput(client *ssh.Client, command string, become Become) (string, error) {
+    output, err := runBecome(client, command, become)
     if err != nil {
-        return fmt.Errorf("failed to run askpass command: %w\nstderr: %s", err, stderrBuf.String())
+        return "", fmt.Errorf("command execution failed: %s %w", command, err)
     }
+    return output, nil
+}
 
-    // Create a new session for the main command
-    commandSession, err := client.NewSession()
+// RunRemoteCommandWithBecomeValidation executes a remote command as the become user and validates its output, return error if not valid.
+func RunRemoteCommandWithBecomeValidation(client *ssh.Client, command string, expectedOutput string, mode ValidationMode, become Become) error {
+    output, err := RunRemoteCommandWithBecomeOutput(client, command, become)
     if err != nil {
-        return err
-    }
-    defer commandSession.Close()
-
-    // Replace all occurrences of "sudo" with "sudo -A" in the command
-    command = fmt.Sprintf("export SUDO_ASKPASS=/tmp/askpass; %s", strings.ReplaceAll(command, "sudo", "sudo -A"))
-
-    // Run the command
-    if err := commandSession.Run(command); err != nil {
-        logger.Errorf("Command execution error on host %s: %v\nStdout: %s\nStderr: %s",
-            client.RemoteAddr(), err, stdoutBuf.String(), stderrBuf.String())
+        logger.Errorf("Command execution error on host %s: %v", client.RemoteAddr(), err)
         return fmt.Errorf("command execution error: %v", err)
     }
 
-    // Capture the output
-    output := stdoutBuf.String()
-
     // Log the output
     logger.Infof("Command executed successfully on host %s: %s\nOutput: %s", client.RemoteAddr(), command, output)
 
@@ -262,4 +407,4 @@ echo %s' > /tmp/askpass && chmod +x /tmp/askpass`, sudoPassword)
 
     logger.Infof("Output validation succeeded on host %s: %s", client.RemoteAddr(), command)
     return nil
-}
\ No newline at end of file
+}
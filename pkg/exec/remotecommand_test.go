@@ -11,7 +11,7 @@ func TestSetupSSHClient(t *testing.T) {
     password := "admin"
     keyPath := "" // No SSH key used in this test
 
-    client, err := SetupSSHClient(host, port, user, password, keyPath)
+    client, err := SetupSSHClient(SSHOptions{Host: host, Port: port, User: user, Password: password, KeyPath: keyPath})
     if err != nil {
         t.Fatalf("Failed to set up SSH client: %v", err)
     }
@@ -27,7 +27,7 @@ func TestRunRemoteCommand(t *testing.T) {
     password := "admin"
     keyPath := "" // No SSH key used in this test
 
-    client, err := SetupSSHClient(host, port, user, password, keyPath)
+    client, err := SetupSSHClient(SSHOptions{Host: host, Port: port, User: user, Password: password, KeyPath: keyPath})
     if err != nil {
         t.Fatalf("Failed to set up SSH client: %v", err)
     }
@@ -48,7 +48,7 @@ func TestRunRemoteCommandWithValidation(t *testing.T) {
     password := "admin"
     keyPath := "" // No SSH key used in this test
 
-    client, err := SetupSSHClient(host, port, user, password, keyPath)
+    client, err := SetupSSHClient(SSHOptions{Host: host, Port: port, User: user, Password: password, KeyPath: keyPath})
     if err != nil {
         t.Fatalf("Failed to set up SSH client: %v", err)
     }
@@ -69,4 +69,4 @@ func TestRunRemoteCommandWithValidation(t *testing.T) {
         t.Fatalf("LazyMatch validation failed: %v", err)
     }
     t.Log("LazyMatch validation succeeded")
-}
\ No newline at end of file
+}
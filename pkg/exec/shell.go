@@ -0,0 +1,10 @@
+package exec
+
+import (
+	"strings"
+)
+
+// ShellQuote quotes a string for use as a single word in a POSIX shell command
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
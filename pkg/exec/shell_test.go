@@ -0,0 +1,19 @@
+package exec
+
+import (
+	"testing"
+)
+
+func TestShellQuote(t *testing.T) {
+	tests := map[string]string{
+		"":                         "''",
+		"/etc/haproxy/haproxy.cfg": "'/etc/haproxy/haproxy.cfg'",
+		"it's":                     `'it'\''s'`,
+		"$(reboot)":                "'$(reboot)'",
+	}
+	for input, expected := range tests {
+		if got := ShellQuote(input); got != expected {
+			t.Errorf("ShellQuote(%q) = %s, expected %s", input, got, expected)
+		}
+	}
+}
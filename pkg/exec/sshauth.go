@@ -0,0 +1,295 @@
+package exec
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	osexec "os/exec"
+	"strings"
+	"sync"
+
+	"steward/utils"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// defaultIdentityFiles are tried like ssh does when no key is configured
+var defaultIdentityFiles = []string{"~/.ssh/id_ed25519", "~/.ssh/id_ecdsa", "~/.ssh/id_rsa"}
+
+// promptPassphrase asks for the passphrase of an encrypted key
+var promptPassphrase = promptTerminal
+
+// keyPassphrases caches the passphrases typed at the prompt by key file, so
+// connections to many hosts prompt once per key
+var keyPassphrases = struct {
+	sync.Mutex
+	values map[string]string
+}{values: make(map[string]string)}
+
+// sshAuth collects the keys offered to SSH servers from key files and the
+// agent of SSH_AUTH_SOCK
+type sshAuth struct {
+	agentConn    net.Conn
+	agentSigners []ssh.Signer
+}
+
+// newSSHAuth connects to the agent of SSH_AUTH_SOCK. Connecting without the
+// agent is not an error, its keys are just not offered.
+func newSSHAuth() *sshAuth {
+	auth := &sshAuth{}
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return auth
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		logger.Warnf("Failed to connect to ssh-agent at %s: %v", socket, err)
+		return auth
+	}
+	signers, err := agent.NewClient(conn).Signers()
+	if err != nil {
+		logger.Warnf("Failed to list the keys of ssh-agent: %v", err)
+		conn.Close()
+		return auth
+	}
+	auth.agentConn = conn
+	auth.agentSigners = signers
+	return auth
+}
+
+// close disconnects from the agent, once the connections are authenticated
+func (a *sshAuth) close() {
+	if a.agentConn != nil {
+		a.agentConn.Close()
+	}
+}
+
+// authMethods returns the authentication methods of a target. Keys are
+// offered before the password, keys of files before the keys of the agent.
+func (a *sshAuth) authMethods(target sshTarget) ([]ssh.AuthMethod, error) {
+	certificates, err := loadCertificates(target.certificateFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	var signers []ssh.Signer
+	for _, file := range target.identityFiles {
+		fileSigners, err := a.keySigners(file, target.keyPassphrase, certificates)
+		if err != nil {
+			if target.keyRequired {
+				return nil, err
+			}
+			// Identity files of the SSH config and the defaults may not exist
+			if !errors.Is(err, os.ErrNotExist) {
+				logger.Warnf("Skipping SSH key: %v", err)
+			}
+			continue
+		}
+		signers = append(signers, fileSigners...)
+	}
+	signers = uniqueSigners(append(signers, a.agentSigners...))
+
+	var methods []ssh.AuthMethod
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+	if target.password != "" {
+		methods = append(methods, ssh.Password(target.password))
+	}
+	if len(methods) == 0 {
+		return nil, fmt.Errorf("no SSH authentication for %s, set password or ssh_key, add a key to ssh-agent or an IdentityFile to ~/.ssh/config", target.name)
+	}
+	return methods, nil
+}
+
+// CheckSSHAuth reports whether a host has a way to authenticate, without
+// connecting to it. The SSH config is applied like SetupSSHClient does. A
+// password, a configured ssh_key, an existing IdentityFile or default key,
+// or a running ssh-agent pass, the keys themselves are only read on connect.
+func CheckSSHAuth(options SSHOptions) error {
+	target, err := options.resolve()
+	if err != nil {
+		return err
+	}
+	if target.password != "" || target.keyRequired || os.Getenv("SSH_AUTH_SOCK") != "" {
+		return nil
+	}
+	for _, file := range target.identityFiles {
+		if _, err := os.Stat(file); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("no SSH authentication for %s, set password or ssh_key, add a key to ssh-agent or an IdentityFile to ~/.ssh/config", target.name)
+}
+
+// keySigners returns the signers of a private key file, the certificates of
+// the key first. An encrypted key held by the agent is left to the agent,
+// other encrypted keys are decrypted with passphrase or a passphrase typed at
+// the terminal.
+func (a *sshAuth) keySigners(file string, passphrase string, certificates []*ssh.Certificate) ([]ssh.Signer, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load SSH key: %w", err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(data)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		publicKey := missing.PublicKey
+		if publicKey == nil {
+			publicKey = readPublicKey(file + ".pub")
+		}
+		if publicKey != nil && a.agentHolds(publicKey) {
+			return nil, nil
+		}
+		if passphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(data, []byte(passphrase))
+		} else {
+			signer, err = decryptKeyAtPrompt(file, data)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse SSH key %s: %v", file, err)
+	}
+
+	if certificate := readPublicKey(file + "-cert.pub"); certificate != nil {
+		if cert, ok := certificate.(*ssh.Certificate); ok {
+			certificates = append(certificates, cert)
+		}
+	}
+	var signers []ssh.Signer
+	for _, cert := range certificates {
+		if string(cert.Key.Marshal()) != string(signer.PublicKey().Marshal()) {
+			continue
+		}
+		certSigner, err := ssh.NewCertSigner(cert, signer)
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificate of SSH key %s: %v", file, err)
+		}
+		signers = append(signers, certSigner)
+	}
+	return append(signers, signer), nil
+}
+
+// agentHolds reports whether the agent holds the private key of publicKey
+func (a *sshAuth) agentHolds(publicKey ssh.PublicKey) bool {
+	for _, signer := range a.agentSigners {
+		if string(signer.PublicKey().Marshal()) == string(publicKey.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadCertificates reads the certificates of CertificateFile settings
+func loadCertificates(files []string) ([]*ssh.Certificate, error) {
+	var certificates []*ssh.Certificate
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load SSH certificate: %v", err)
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse SSH certificate %s: %v", file, err)
+		}
+		cert, ok := key.(*ssh.Certificate)
+		if !ok {
+			return nil, fmt.Errorf("%s is not an SSH certificate", file)
+		}
+		certificates = append(certificates, cert)
+	}
+	return certificates, nil
+}
+
+// readPublicKey reads a public key or certificate file, nil when it is
+// missing or invalid
+func readPublicKey(file string) ssh.PublicKey {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil
+	}
+	return key
+}
+
+// uniqueSigners drops signers of keys offered before, servers count every
+// offered key against their limit of authentication attempts
+func uniqueSigners(signers []ssh.Signer) []ssh.Signer {
+	seen := make(map[string]bool)
+	var unique []ssh.Signer
+	for _, signer := range signers {
+		key := string(signer.PublicKey().Marshal())
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		unique = append(unique, signer)
+	}
+	return unique
+}
+
+// decryptKeyAtPrompt decrypts a key with a passphrase typed at the terminal,
+// asking up to three times like ssh. Prompts are serialized and correct
+// passphrases are kept, so concurrent connections ask once per key.
+func decryptKeyAtPrompt(file string, data []byte) (ssh.Signer, error) {
+	keyPassphrases.Lock()
+	defer keyPassphrases.Unlock()
+
+	if passphrase, ok := keyPassphrases.values[file]; ok {
+		return ssh.ParsePrivateKeyWithPassphrase(data, []byte(passphrase))
+	}
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		var passphrase string
+		passphrase, err = promptPassphrase(fmt.Sprintf("Enter passphrase for key %s: ", file))
+		if err != nil {
+			return nil, fmt.Errorf("key is encrypted, set ssh_key_passphrase or add it to ssh-agent: %v", err)
+		}
+		var signer ssh.Signer
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(data, []byte(passphrase))
+		if err == nil {
+			utils.RegisterSecret(passphrase)
+			keyPassphrases.values[file] = passphrase
+			return signer, nil
+		}
+	}
+	return nil, err
+}
+
+// promptTerminal reads a line from the terminal without echoing it
+func promptTerminal(prompt string) (string, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", fmt.Errorf("no terminal to prompt on")
+	}
+	defer tty.Close()
+
+	if err := stty(tty, "-echo"); err != nil {
+		return "", fmt.Errorf("failed to disable echo on the terminal: %v", err)
+	}
+	defer func() {
+		stty(tty, "echo")
+		fmt.Fprintln(tty)
+	}()
+
+	fmt.Fprint(tty, prompt)
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// stty changes the settings of a terminal
+func stty(tty *os.File, args ...string) error {
+	cmd := osexec.Command("stty", args...)
+	cmd.Stdin = tty
+	return cmd.Run()
+}
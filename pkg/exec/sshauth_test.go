@@ -0,0 +1,394 @@
+package exec
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// testSSHServer accepts SSH connections of authorized keys and forwards the
+// direct-tcpip channels of jump connections
+type testSSHServer struct {
+	host      string
+	port      string
+	forwarded atomic.Int32
+	// passwords counts the rejected password attempts
+	passwords atomic.Int32
+}
+
+// newTestSSHServer starts an SSH server on localhost accepting user with the
+// keys accepted by authorized
+func newTestSSHServer(t *testing.T, user string, authorized func(key ssh.PublicKey) bool) *testSSHServer {
+	t.Helper()
+	_, hostPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate host key: %v", err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(hostPrivate)
+	if err != nil {
+		t.Fatalf("Failed to create host key: %v", err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == user && authorized(key) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unauthorized")
+		},
+	}
+	config.AddHostKey(hostKey)
+	server := &testSSHServer{}
+	config.PasswordCallback = func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+		server.passwords.Add(1)
+		return nil, fmt.Errorf("unauthorized")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	server.host, server.port, _ = net.SplitHostPort(listener.Addr().String())
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn, config)
+		}
+	}()
+	return server
+}
+
+func (s *testSSHServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	defer conn.Close()
+	serverConn, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	defer serverConn.Close()
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() == "session" {
+			go serveSFTPSession(newChannel)
+			continue
+		}
+		if newChannel.ChannelType() != "direct-tcpip" {
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported")
+			continue
+		}
+		var payload struct {
+			Host       string
+			Port       uint32
+			OriginHost string
+			OriginPort uint32
+		}
+		if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+			newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		target, err := net.Dial("tcp", net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port))))
+		if err != nil {
+			newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			target.Close()
+			continue
+		}
+		s.forwarded.Add(1)
+		go ssh.DiscardRequests(channelRequests)
+		go func() {
+			io.Copy(channel, target)
+			channel.Close()
+		}()
+		go func() {
+			io.Copy(target, channel)
+			target.Close()
+		}()
+	}
+}
+
+// serveSFTPSession serves the sftp subsystem on the local file system, other
+// session requests are refused
+func serveSFTPSession(newChannel ssh.NewChannel) {
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+	for request := range requests {
+		var payload struct{ Name string }
+		if request.Type != "subsystem" || ssh.Unmarshal(request.Payload, &payload) != nil || payload.Name != "sftp" {
+			request.Reply(false, nil)
+			continue
+		}
+		request.Reply(true, nil)
+		server, err := sftp.NewServer(channel)
+		if err != nil {
+			return
+		}
+		server.Serve()
+		return
+	}
+}
+
+// newTestKey generates an ed25519 key
+func newTestKey(t *testing.T) (ed25519.PrivateKey, ssh.Signer) {
+	t.Helper()
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatalf("Failed to create signer: %v", err)
+	}
+	return private, signer
+}
+
+// writeTestKey writes a private key file, encrypted when passphrase is set
+func writeTestKey(t *testing.T, path string, private ed25519.PrivateKey, passphrase string) {
+	t.Helper()
+	var block *pem.Block
+	var err error
+	if passphrase == "" {
+		block, err = ssh.MarshalPrivateKey(private, "")
+	} else {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(private, "", []byte(passphrase))
+	}
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatalf("Failed to create key directory: %v", err)
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+}
+
+// sameKey accepts a single key
+func sameKey(want ssh.PublicKey) func(key ssh.PublicKey) bool {
+	return func(key ssh.PublicKey) bool {
+		return bytes.Equal(key.Marshal(), want.Marshal())
+	}
+}
+
+// isolateSSH keeps tests away from the keys, agent and known hosts of the user
+func isolateSSH(t *testing.T) (string, HostKeyPolicy) {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("SSH_AUTH_SOCK", "")
+	keyPassphrases.Lock()
+	keyPassphrases.values = make(map[string]string)
+	keyPassphrases.Unlock()
+	return home, HostKeyPolicy{KnownHostsFiles: []string{}, TrustFile: filepath.Join(home, ".steward", "known_hosts")}
+}
+
+func TestSetupSSHClientAgent(t *testing.T) {
+	home, hostKeys := isolateSSH(t)
+	private, signer := newTestKey(t)
+	server := newTestSSHServer(t, "deploy", sameKey(signer.PublicKey()))
+
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: private}); err != nil {
+		t.Fatalf("Failed to add key to agent: %v", err)
+	}
+	socket := filepath.Join(home, "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Failed to listen on agent socket: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+
+	options := SSHOptions{Host: server.host, Port: server.port, User: "deploy", HostKeys: hostKeys, SSHConfigFile: "none"}
+	if _, err := SetupSSHClient(options); err == nil {
+		t.Fatalf("Expected error without agent")
+	}
+
+	t.Setenv("SSH_AUTH_SOCK", socket)
+	client, err := SetupSSHClient(options)
+	if err != nil {
+		t.Fatalf("Expected authentication with the agent key, got %v", err)
+	}
+	client.Close()
+
+	// Keys are offered before the password
+	options.Password = "s3cret"
+	client, err = SetupSSHClient(options)
+	if err != nil {
+		t.Fatalf("Expected authentication with the agent key, got %v", err)
+	}
+	client.Close()
+	if tried := server.passwords.Load(); tried != 0 {
+		t.Errorf("Expected the password not to be tried, got %d attempts", tried)
+	}
+}
+
+func TestSetupSSHClientEncryptedKey(t *testing.T) {
+	home, hostKeys := isolateSSH(t)
+	private, signer := newTestKey(t)
+	server := newTestSSHServer(t, "deploy", sameKey(signer.PublicKey()))
+	keyPath := filepath.Join(home, "deploy_key")
+	writeTestKey(t, keyPath, private, "correct horse")
+
+	prompts := 0
+	promptPassphrase = func(prompt string) (string, error) {
+		prompts++
+		return "correct horse", nil
+	}
+	defer func() { promptPassphrase = promptTerminal }()
+
+	options := SSHOptions{Host: server.host, Port: server.port, User: "deploy", KeyPath: keyPath, HostKeys: hostKeys, SSHConfigFile: "none"}
+
+	options.KeyPassphrase = "wrong"
+	if _, err := SetupSSHClient(options); err == nil || !strings.Contains(err.Error(), "unable to parse SSH key") {
+		t.Errorf("Expected error for a wrong passphrase, got %v", err)
+	}
+
+	options.KeyPassphrase = "correct horse"
+	client, err := SetupSSHClient(options)
+	if err != nil {
+		t.Fatalf("Expected authentication with the passphrase, got %v", err)
+	}
+	client.Close()
+	if prompts != 0 {
+		t.Errorf("Expected no prompt with ssh_key_passphrase, got %d", prompts)
+	}
+
+	options.KeyPassphrase = ""
+	for i := 0; i < 2; i++ {
+		client, err := SetupSSHClient(options)
+		if err != nil {
+			t.Fatalf("Expected authentication with the prompted passphrase, got %v", err)
+		}
+		client.Close()
+	}
+	if prompts != 1 {
+		t.Errorf("Expected the passphrase to be prompted once, got %d", prompts)
+	}
+}
+
+func TestSetupSSHClientCertificate(t *testing.T) {
+	home, hostKeys := isolateSSH(t)
+	_, authority := newTestKey(t)
+	private, signer := newTestKey(t)
+
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return bytes.Equal(auth.Marshal(), authority.PublicKey().Marshal())
+		},
+	}
+	server := newTestSSHServer(t, "deploy", func(key ssh.PublicKey) bool {
+		_, err := checker.Authenticate(connMetadata("deploy"), key)
+		return err == nil
+	})
+
+	keyPath := filepath.Join(home, "deploy_key")
+	writeTestKey(t, keyPath, private, "")
+	options := SSHOptions{Host: server.host, Port: server.port, User: "deploy", KeyPath: keyPath, HostKeys: hostKeys, SSHConfigFile: "none"}
+	if _, err := SetupSSHClient(options); err == nil {
+		t.Fatalf("Expected error without certificate")
+	}
+
+	cert := &ssh.Certificate{
+		Key:             signer.PublicKey(),
+		CertType:        ssh.UserCert,
+		KeyId:           "deploy",
+		ValidPrincipals: []string{"deploy"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, authority); err != nil {
+		t.Fatalf("Failed to sign certificate: %v", err)
+	}
+	if err := os.WriteFile(keyPath+"-cert.pub", ssh.MarshalAuthorizedKey(cert), 0644); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+	client, err := SetupSSHClient(options)
+	if err != nil {
+		t.Fatalf("Expected authentication with the certificate, got %v", err)
+	}
+	client.Close()
+}
+
+func TestSetupSSHClientSSHConfig(t *testing.T) {
+	home, hostKeys := isolateSSH(t)
+	private, signer := newTestKey(t)
+	bastion := newTestSSHServer(t, "jumper", sameKey(signer.PublicKey()))
+	target := newTestSSHServer(t, "deploy", sameKey(signer.PublicKey()))
+	writeTestKey(t, filepath.Join(home, ".ssh", "deploy_key"), private, "")
+
+	configFile := filepath.Join(home, ".ssh", "config")
+	config := fmt.Sprintf(`Host web1
+  HostName %s
+  Port %s
+  User deploy
+  ProxyJump jumper@bastion
+
+Host bastion
+  HostName %s
+  Port %s
+
+Host *
+  IdentityFile ~/.ssh/deploy_key
+`, target.host, target.port, bastion.host, bastion.port)
+	if err := os.WriteFile(configFile, []byte(config), 0600); err != nil {
+		t.Fatalf("Failed to write SSH config: %v", err)
+	}
+
+	client, err := SetupSSHClient(SSHOptions{Host: "web1", HostKeys: hostKeys})
+	if err != nil {
+		t.Fatalf("Expected connection through the jump host, got %v", err)
+	}
+	client.Close()
+	if target.forwarded.Load() != 0 || bastion.forwarded.Load() != 1 {
+		t.Errorf("Expected one connection forwarded by the jump host, got %d", bastion.forwarded.Load())
+	}
+
+	key, address, err := ScanHostKey(SSHOptions{Host: "web1", HostKeys: hostKeys})
+	if err != nil {
+		t.Fatalf("Failed to scan host key: %v", err)
+	}
+	if address != net.JoinHostPort(target.host, target.port) || key == nil {
+		t.Errorf("Expected host key of %s:%s, got %s", target.host, target.port, address)
+	}
+}
+
+// connMetadata is the metadata of a connection of user
+type connMetadata string
+
+func (c connMetadata) User() string          { return string(c) }
+func (c connMetadata) SessionID() []byte     { return nil }
+func (c connMetadata) ClientVersion() []byte { return nil }
+func (c connMetadata) ServerVersion() []byte { return nil }
+func (c connMetadata) RemoteAddr() net.Addr  { return &net.TCPAddr{} }
+func (c connMetadata) LocalAddr() net.Addr   { return &net.TCPAddr{} }
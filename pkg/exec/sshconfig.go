@@ -0,0 +1,241 @@
+package exec
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+// maxSSHConfigIncludes limits the depth of nested Include directives
+const maxSSHConfigIncludes = 16
+
+// sshHostConfig holds the settings of an OpenSSH client config which apply to
+// a host. Like ssh, the first value of a setting wins, identity and
+// certificate files accumulate.
+type sshHostConfig struct {
+	HostName         string
+	User             string
+	Port             string
+	ProxyJump        string
+	IdentityFiles    []string
+	CertificateFiles []string
+}
+
+// DefaultSSHConfigFile returns the OpenSSH client config of the user
+func DefaultSSHConfigFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".ssh", "config")
+}
+
+// loadSSHConfig returns the settings of an OpenSSH client config for a host
+// name or alias. A missing config applies no settings. Match blocks are not
+// supported and never apply, apart from Match all.
+func loadSSHConfig(file string, host string) (sshHostConfig, error) {
+	var config sshHostConfig
+	if file == "" {
+		return config, nil
+	}
+	if err := config.parseFile(file, host, true, 0); err != nil {
+		return sshHostConfig{}, err
+	}
+	return config, nil
+}
+
+// parseFile applies the settings of a config file. active tells whether the
+// lines before the first Host line apply, like the lines of an Include inside
+// a Host block.
+func (c *sshHostConfig) parseFile(file string, host string, active bool, depth int) error {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read SSH config: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		keyword, args, err := splitSSHConfigLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", file, lineNumber, err)
+		}
+		if keyword == "" {
+			continue
+		}
+
+		switch keyword {
+		case "host":
+			active = matchSSHHost(args, host)
+			continue
+		case "match":
+			active = len(args) == 1 && strings.EqualFold(args[0], "all")
+			continue
+		}
+		if !active {
+			continue
+		}
+		if len(args) == 0 {
+			return fmt.Errorf("%s:%d: missing argument of %s", file, lineNumber, keyword)
+		}
+
+		switch keyword {
+		case "include":
+			if depth >= maxSSHConfigIncludes {
+				return fmt.Errorf("%s:%d: too many nested includes", file, lineNumber)
+			}
+			for _, pattern := range args {
+				pattern = expandHome(pattern)
+				if !filepath.IsAbs(pattern) {
+					// Like ssh, includes of the user config are relative to ~/.ssh
+					pattern = filepath.Join(filepath.Dir(file), pattern)
+				}
+				matches, err := filepath.Glob(pattern)
+				if err != nil {
+					return fmt.Errorf("%s:%d: %v", file, lineNumber, err)
+				}
+				for _, match := range matches {
+					if err := c.parseFile(match, host, true, depth+1); err != nil {
+						return err
+					}
+				}
+			}
+		case "hostname":
+			setFirst(&c.HostName, args[0])
+		case "user":
+			setFirst(&c.User, args[0])
+		case "port":
+			setFirst(&c.Port, args[0])
+		case "proxyjump":
+			setFirst(&c.ProxyJump, args[0])
+		case "identityfile":
+			c.IdentityFiles = append(c.IdentityFiles, args[0])
+		case "certificatefile":
+			c.CertificateFiles = append(c.CertificateFiles, args[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read SSH config %s: %w", file, err)
+	}
+	return nil
+}
+
+// splitSSHConfigLine returns the lower case keyword and the arguments of a
+// config line. Arguments may be quoted, the keyword may be followed by =.
+func splitSSHConfigLine(line string) (string, []string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", nil, nil
+	}
+
+	keyword, rest := line, ""
+	if end := strings.IndexAny(line, " \t="); end >= 0 {
+		keyword, rest = line[:end], strings.TrimLeft(line[end:], " \t")
+		rest = strings.TrimLeft(strings.TrimPrefix(rest, "="), " \t")
+	}
+
+	var args []string
+	for rest != "" {
+		var arg string
+		if rest[0] == '"' {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				return "", nil, fmt.Errorf("unterminated quote")
+			}
+			arg, rest = rest[1:end+1], rest[end+2:]
+		} else {
+			end := strings.IndexAny(rest, " \t")
+			if end < 0 {
+				end = len(rest)
+			}
+			arg, rest = rest[:end], rest[end:]
+		}
+		args = append(args, arg)
+		rest = strings.TrimLeft(rest, " \t")
+	}
+	return strings.ToLower(keyword), args, nil
+}
+
+// matchSSHHost reports whether a host matches the patterns of a Host line. A
+// negated pattern which matches excludes the host.
+func matchSSHHost(patterns []string, host string) bool {
+	matched := false
+	for _, pattern := range patterns {
+		if negated, ok := strings.CutPrefix(pattern, "!"); ok {
+			if matchWildcard(negated, host) {
+				return false
+			}
+			continue
+		}
+		if matchWildcard(pattern, host) {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// matchWildcard matches s against a pattern of * and ? wildcards, ignoring case
+func matchWildcard(pattern string, s string) bool {
+	pattern, s = strings.ToLower(pattern), strings.ToLower(s)
+	for pattern != "" {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if matchWildcard(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if s == "" {
+				return false
+			}
+		default:
+			if s == "" || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return s == ""
+}
+
+// setFirst sets a setting which is not set yet
+func setFirst(setting *string, value string) {
+	if *setting == "" {
+		*setting = value
+	}
+}
+
+// expandSSHTokens expands ~ and the %d, %h, %p, %r, %u and %% tokens of a
+// path in an SSH config
+func expandSSHTokens(path string, hostname string, port string, remoteUser string) string {
+	path = expandHome(path)
+	home, _ := os.UserHomeDir()
+	localUser := ""
+	if current, err := user.Current(); err == nil {
+		localUser = current.Username
+	}
+	replacer := strings.NewReplacer("%%", "%", "%d", home, "%h", hostname, "%p", port, "%r", remoteUser, "%u", localUser)
+	return replacer.Replace(path)
+}
+
+// expandHome replaces a leading ~ with the home directory of the user
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
@@ -0,0 +1,120 @@
+package exec
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadSSHConfig(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "bastions.conf"), []byte("Host bastion\n  HostName 10.0.0.1\n"), 0600); err != nil {
+		t.Fatalf("Failed to write include: %v", err)
+	}
+	configFile := filepath.Join(dir, "config")
+	content := `# Hosts of the lab
+Include bastions.conf
+
+Host web? !web9
+  HostName %h.lab.example.com
+  User=deploy
+  IdentityFile "/keys/web key"
+
+Match exec "true"
+  User nobody
+
+Host web*
+  User admin
+  Port 2222
+  ProxyJump jumper@bastion:2200
+  CertificateFile /keys/web-cert.pub
+
+Host *
+  IdentityFile /keys/default
+`
+	if err := os.WriteFile(configFile, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	tests := []struct {
+		host     string
+		expected sshHostConfig
+	}{
+		{"web1", sshHostConfig{
+			HostName:         "%h.lab.example.com",
+			User:             "deploy",
+			Port:             "2222",
+			ProxyJump:        "jumper@bastion:2200",
+			IdentityFiles:    []string{"/keys/web key", "/keys/default"},
+			CertificateFiles: []string{"/keys/web-cert.pub"},
+		}},
+		{"web9", sshHostConfig{
+			User:             "admin",
+			Port:             "2222",
+			ProxyJump:        "jumper@bastion:2200",
+			IdentityFiles:    []string{"/keys/default"},
+			CertificateFiles: []string{"/keys/web-cert.pub"},
+		}},
+		{"bastion", sshHostConfig{
+			HostName:      "10.0.0.1",
+			IdentityFiles: []string{"/keys/default"},
+		}},
+	}
+	for _, test := range tests {
+		config, err := loadSSHConfig(configFile, test.host)
+		if err != nil {
+			t.Fatalf("Failed to load SSH config: %v", err)
+		}
+		if !reflect.DeepEqual(config, test.expected) {
+			t.Errorf("Expected %+v for %s, got %+v", test.expected, test.host, config)
+		}
+	}
+
+	missing, err := loadSSHConfig(filepath.Join(dir, "missing"), "web1")
+	if err != nil || !reflect.DeepEqual(missing, sshHostConfig{}) {
+		t.Errorf("Expected no settings from a missing config, got %+v, %v", missing, err)
+	}
+}
+
+func TestResolveSSHOptions(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("HOME", dir)
+	configFile := filepath.Join(dir, "config")
+	config := "Host web1\n  HostName 10.0.0.11\n  User deploy\n  Port 2222\n  IdentityFile ~/.ssh/%r@%h\n  ProxyJump bastion,jumper@10.0.0.2:2200\n"
+	if err := os.WriteFile(configFile, []byte(config), 0600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	options := SSHOptions{Host: "web1", SSHConfigFile: configFile}
+	target, err := options.resolve()
+	if err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+	if target.address != "10.0.0.11:2222" || target.user != "deploy" || target.keyRequired {
+		t.Errorf("Unexpected target %+v", target)
+	}
+	if expected := []string{filepath.Join(dir, ".ssh", "deploy@10.0.0.11")}; !reflect.DeepEqual(target.identityFiles, expected) {
+		t.Errorf("Expected identity files %v, got %v", expected, target.identityFiles)
+	}
+
+	jumps, err := options.jumpHosts(target.proxyJump)
+	if err != nil {
+		t.Fatalf("Failed to parse ProxyJump: %v", err)
+	}
+	if len(jumps) != 2 || jumps[0].Host != "bastion" || jumps[0].User != "" ||
+		jumps[1].Host != "10.0.0.2" || jumps[1].User != "jumper" || jumps[1].Port != "2200" {
+		t.Errorf("Unexpected jump hosts %+v", jumps)
+	}
+
+	// Configured settings override the SSH config
+	options = SSHOptions{Host: "web1", Port: "22", User: "admin", KeyPath: "/keys/admin", SSHConfigFile: configFile}
+	target, err = options.resolve()
+	if err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+	if target.address != "10.0.0.11:22" || target.user != "admin" || !target.keyRequired ||
+		!reflect.DeepEqual(target.identityFiles, []string{"/keys/admin"}) {
+		t.Errorf("Unexpected target %+v", target)
+	}
+}
@@ -3,18 +3,38 @@ package exec
 import (
 	"os"
 	"fmt"
+    "io"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
     "path/filepath"
+    "strings"
+    "time"
 
     "golang.org/x/crypto/ssh"
     "github.com/pkg/sftp"
 )
 
-// TransferFile transfers a file to the remote host using SFTP and ensures the target directory exists
-func TransferFile(client *ssh.Client, localFilePath, remoteFilePath string) error {
+// newFileMode is the mode of transferred files which replace no remote file
+const newFileMode os.FileMode = 0644
+
+// TransferFile transfers a file to the remote host using SFTP and ensures the target directory exists.
+// The file is uploaded to a unique temporary file next to the remote file and renamed over it, so
+// the remote file is never half-written. The upload is skipped when the remote file already has the
+// same SHA-256, the returned bool reports whether the remote file or its owner and mode changed.
+func TransferFile(client *ssh.Client, localFilePath, remoteFilePath string, options FileOptions) (bool, error) {
+    changed, err := remoteFileDiffers(client, localFilePath, remoteFilePath, false, Become{})
+    if err != nil {
+        return false, err
+    }
+    if !changed {
+        return applyFileAttributes(client, remoteFilePath, options, false, Become{})
+    }
+
     // Create an SFTP client
     sftpClient, err := sftp.NewClient(client)
     if err != nil {
-        return err
+        return false, err
     }
     defer sftpClient.Close()
 
@@ -22,51 +42,173 @@ func TransferFile(client *ssh.Client, localFilePath, remoteFilePath string) erro
     remoteDir := filepath.Dir(remoteFilePath)
 
     if err := sftpClient.MkdirAll(remoteDir); err != nil {
-        return err
+        return false, err
     }
 
-    // Open the local file
-    localFile, err := os.Open(localFilePath)
+    stagingFilePath, err := stagingPath(remoteFilePath)
     if err != nil {
-        return err
+        return false, err
     }
-    defer localFile.Close()
+    if err := uploadFile(sftpClient, localFilePath, stagingFilePath); err != nil {
+        return false, err
+    }
+    // The staging file is removed unless it was renamed over the remote file
+    moved := false
+    defer func() {
+        if !moved {
+            sftpClient.Remove(stagingFilePath)
+        }
+    }()
 
-    // Create the remote file
-    remoteFile, err := sftpClient.Create(remoteFilePath)
+    // Keep the mode of the file being replaced, new files are readable by everyone
+    // unless options say otherwise, like with TransferFileWithRoot
+    mode := newFileMode
+    if info, err := sftpClient.Stat(remoteFilePath); err == nil {
+        mode = info.Mode().Perm()
+    } else if !os.IsNotExist(err) {
+        return false, fmt.Errorf("failed to stat remote file %s: %w", remoteFilePath, err)
+    }
+    if err := sftpClient.Chmod(stagingFilePath, mode); err != nil {
+        return false, err
+    }
+
+    if options.Validate != "" {
+        if err := validateRemoteFile(client, stagingFilePath, options.Validate, false, Become{}); err != nil {
+            return false, fmt.Errorf("validation of remote file %s failed: %w", remoteFilePath, err)
+        }
+    }
+
+    // Set the owner and mode before the file is renamed, and keep the previous file if requested
+    commands, err := attributeCommands(stagingFilePath, options)
     if err != nil {
-        return err
+        return false, err
+    }
+    if options.Backup {
+        commands = append(commands, backupCommand(remoteFilePath, time.Now()))
+    }
+    if len(commands) > 0 {
+        if err := runFileCommands(client, commands, false, Become{}); err != nil {
+            return false, fmt.Errorf("failed to prepare remote file %s: %w", remoteFilePath, err)
+        }
     }
-    defer remoteFile.Close()
 
-    // Copy the local file content to the remote file
-    if _, err := remoteFile.ReadFrom(localFile); err != nil {
-        return fmt.Errorf("failed to copy file content to remote file %s: %v", remoteFilePath, err)
+    if err := sftpClient.PosixRename(stagingFilePath, remoteFilePath); err != nil {
+        return false, fmt.Errorf("failed to move %s in place: %w", remoteFilePath, err)
     }
+    moved = true
 
     logger.Infof("File %s transferred to %s:%s", localFilePath, client.RemoteAddr(), remoteFilePath)
-    return nil
+    return true, nil
 }
 
-func TransferFileWithRoot(client *ssh.Client, localFilePath, remoteFilePath string, sudoPassword string) error {
-	// Detect filename
-	fileName := filepath.Base(localFilePath)
+// TransferFileWithRoot transfers a file to a location only writable by root.
+// The file is uploaded to a private temporary file, copied with root privileges to a
+// unique temporary file next to the remote file and renamed over it, so the remote
+// file is never half-written. The upload is skipped when the remote file already has
+// the same SHA-256, the returned bool reports whether the remote file or its owner and
+// mode changed. The file is copied by the become user, which must be able to read the
+// upload of the SSH user, like root.
+func TransferFileWithRoot(client *ssh.Client, localFilePath, remoteFilePath string, become Become, options FileOptions) (bool, error) {
+    changed, err := remoteFileDiffers(client, localFilePath, remoteFilePath, true, become)
+    if err != nil {
+        return false, err
+    }
+    if !changed {
+        return applyFileAttributes(client, remoteFilePath, options, true, become)
+    }
 
     // Create an SFTP client
     sftpClient, err := sftp.NewClient(client)
     if err != nil {
-        return err
+        return false, err
     }
     defer sftpClient.Close()
 
-    // Ensure the remote directory exists
+    // Upload to a unique file which only the SSH user can read
+    suffix, err := randomSuffix()
+    if err != nil {
+        return false, err
+    }
+    uploadFilePath := "/tmp/steward-" + suffix
+    if err := uploadFile(sftpClient, localFilePath, uploadFilePath); err != nil {
+        return false, err
+    }
+    defer sftpClient.Remove(uploadFilePath)
+
+    stagingFilePath, err := stagingPath(remoteFilePath)
+    if err != nil {
+        return false, err
+    }
     remoteDir := filepath.Dir(remoteFilePath)
+    quotedRemote := ShellQuote(remoteFilePath)
+    quotedStaging := ShellQuote(stagingFilePath)
+
+    // Copy the upload next to the remote file, keeping the owner and mode of the file being
+    // replaced. New files are owned by root and readable by everyone unless options say otherwise.
+    commands := []string{
+        fmt.Sprintf("mkdir -p %s", ShellQuote(remoteDir)),
+        fmt.Sprintf("cp %s %s", ShellQuote(uploadFilePath), quotedStaging),
+        fmt.Sprintf("if [ -e %s ]; then chmod \"$(stat -c %%a %s)\" %s && chown \"$(stat -c %%u:%%g %s)\" %s; else chmod %04o %s; fi",
+            quotedRemote, quotedRemote, quotedStaging, quotedRemote, quotedStaging, uint32(newFileMode), quotedStaging),
+    }
+    if err := runFileCommands(client, commands, true, become); err != nil {
+        removeStagingFile(client, stagingFilePath, become)
+        return false, fmt.Errorf("failed to stage remote file %s: %w", remoteFilePath, err)
+    }
+
+    // Nothing is moved in place when the validator rejects the file
+    if options.Validate != "" {
+        if err := validateRemoteFile(client, stagingFilePath, options.Validate, true, become); err != nil {
+            removeStagingFile(client, stagingFilePath, become)
+            return false, fmt.Errorf("validation of remote file %s failed: %w", remoteFilePath, err)
+        }
+    }
+
+    // Set the owner and mode before the file is renamed, so it is never readable with
+    // the wrong permissions, and keep the previous file if requested
+    commands, err = attributeCommands(stagingFilePath, options)
+    if err != nil {
+        removeStagingFile(client, stagingFilePath, become)
+        return false, err
+    }
+    if options.Backup {
+        commands = append(commands, backupCommand(remoteFilePath, time.Now()))
+    }
+
+    // Rename the file over the remote file with root privileges
+    commands = append(commands, fmt.Sprintf("mv -f %s %s", quotedStaging, quotedRemote))
+    if err := runFileCommands(client, commands, true, become); err != nil {
+        removeStagingFile(client, stagingFilePath, become)
+        return false, err
+    }
+
+    logger.Infof("File %s transferred to %s:%s", localFilePath, client.RemoteAddr(), remoteFilePath)
+    return true, nil
+}
+
+// stagingPath returns a unique temporary path in the directory of a remote file.
+// Renames within a directory are atomic, so the remote file is replaced at once.
+func stagingPath(remoteFilePath string) (string, error) {
+    suffix, err := randomSuffix()
+    if err != nil {
+        return "", err
+    }
+    name := fmt.Sprintf(".%s.steward-%s", filepath.Base(remoteFilePath), suffix)
+    return filepath.Join(filepath.Dir(remoteFilePath), name), nil
+}
 
-	err = RunRemoteCommandWithSudo(client, fmt.Sprintf("sudo mkdir -p %s", remoteDir), sudoPassword)
-	if err != nil {
-		return err
-	}
+// randomSuffix returns a random hex string which makes temporary file names unique
+func randomSuffix() (string, error) {
+    suffix := make([]byte, 8)
+    if _, err := rand.Read(suffix); err != nil {
+        return "", fmt.Errorf("failed to generate temporary file name: %w", err)
+    }
+    return hex.EncodeToString(suffix), nil
+}
 
+// uploadFile copies a local file to a new remote file which only the SSH user can
+// access. The remote file must not exist, partial uploads are removed.
+func uploadFile(sftpClient *sftp.Client, localFilePath, remoteFilePath string) error {
     // Open the local file
     localFile, err := os.Open(localFilePath)
     if err != nil {
@@ -75,23 +217,98 @@ func TransferFileWithRoot(client *ssh.Client, localFilePath, remoteFilePath stri
     defer localFile.Close()
 
     // Create the remote file
-    remoteFile, err := sftpClient.Create("/tmp/"+fileName)
+    remoteFile, err := sftpClient.OpenFile(remoteFilePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
     if err != nil {
-        return err
+        return fmt.Errorf("failed to create remote file %s: %w", remoteFilePath, err)
     }
     defer remoteFile.Close()
 
-    // Copy the local file content to the remote file
-    if _, err := remoteFile.ReadFrom(localFile); err != nil {
-        return err
+    err = remoteFile.Chmod(0600)
+    if err == nil {
+        // Copy the local file content to the remote file
+        _, err = remoteFile.ReadFrom(localFile)
+    }
+    if err == nil {
+        // Flush the upload before the file is used
+        err = remoteFile.Close()
     }
+    if err != nil {
+        sftpClient.Remove(remoteFilePath)
+        return fmt.Errorf("failed to copy file content to remote file %s: %w", remoteFilePath, err)
+    }
+    return nil
+}
 
-	// Move the file to the desired location with root privileges
-	err = RunRemoteCommandWithSudo(client, fmt.Sprintf("sudo mv /tmp/%s %s", fileName, remoteFilePath), sudoPassword)
-	if err != nil {
-		return err
-	}
+// removeStagingFile removes a temporary file left next to a remote file by a failed transfer
+func removeStagingFile(client *ssh.Client, stagingFilePath string, become Become) {
+    command := fmt.Sprintf("rm -f %s", ShellQuote(stagingFilePath))
+    if err := RunRemoteCommandWithBecome(client, command, become); err != nil {
+        logger.Warnf("Failed to remove temporary file %s:%s: %v", client.RemoteAddr(), stagingFilePath, err)
+    }
+}
 
-    logger.Infof("File %s transferred to %s:%s", localFilePath, client.RemoteAddr(), remoteFilePath)
-    return nil
-}
\ No newline at end of file
+// RemoteFileSHA256 returns the hex encoded SHA-256 of a remote file, or an empty
+// string when the file does not exist. Files owned by root are hashed with
+// sha256sum through sudo, other files are read through SFTP.
+func RemoteFileSHA256(client *ssh.Client, remoteFilePath string, sudo bool, become Become) (string, error) {
+    if sudo {
+        quoted := ShellQuote(remoteFilePath)
+        command := fmt.Sprintf("if [ -e %s ]; then sha256sum %s; fi", quoted, quoted)
+        output, err := RunRemoteCommandWithBecomeOutput(client, command, become)
+        if err != nil {
+            return "", fmt.Errorf("failed to hash remote file %s: %w", remoteFilePath, err)
+        }
+        fields := strings.Fields(output)
+        if len(fields) == 0 {
+            return "", nil
+        }
+        return fields[0], nil
+    }
+
+    sftpClient, err := sftp.NewClient(client)
+    if err != nil {
+        return "", err
+    }
+    defer sftpClient.Close()
+
+    remoteFile, err := sftpClient.Open(remoteFilePath)
+    if os.IsNotExist(err) {
+        return "", nil
+    }
+    if err != nil {
+        return "", fmt.Errorf("failed to open remote file %s: %w", remoteFilePath, err)
+    }
+    defer remoteFile.Close()
+
+    hash := sha256.New()
+    if _, err := io.Copy(hash, remoteFile); err != nil {
+        return "", fmt.Errorf("failed to read remote file %s: %w", remoteFilePath, err)
+    }
+    return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// remoteFileDiffers compares the SHA-256 of a local file with the remote file
+func remoteFileDiffers(client *ssh.Client, localFilePath, remoteFilePath string, sudo bool, become Become) (bool, error) {
+    localFile, err := os.Open(localFilePath)
+    if err != nil {
+        return false, err
+    }
+    defer localFile.Close()
+
+    hash := sha256.New()
+    if _, err := io.Copy(hash, localFile); err != nil {
+        return false, fmt.Errorf("failed to hash local file %s: %w", localFilePath, err)
+    }
+    localHash := hex.EncodeToString(hash.Sum(nil))
+
+    remoteHash, err := RemoteFileSHA256(client, remoteFilePath, sudo, become)
+    if err != nil {
+        return false, err
+    }
+
+    if localHash == remoteHash {
+        logger.Infof("File %s:%s is up to date, skipping transfer", client.RemoteAddr(), remoteFilePath)
+        return false, nil
+    }
+    return true, nil
+}
@@ -0,0 +1,73 @@
+package exec
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStagingPath(t *testing.T) {
+	first, err := stagingPath("/etc/app/config.yaml")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	second, err := stagingPath("/etc/app/config.yaml")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if filepath.Dir(first) != "/etc/app" {
+		t.Errorf("Expected staging file in /etc/app, got '%s'", first)
+	}
+	if !strings.HasPrefix(filepath.Base(first), ".config.yaml.steward-") {
+		t.Errorf("Expected hidden staging file named after the remote file, got '%s'", first)
+	}
+	if first == second {
+		t.Errorf("Expected unique staging paths, got '%s' twice", first)
+	}
+}
+
+func TestTransferFileModes(t *testing.T) {
+	home, hostKeys := isolateSSH(t)
+	private, signer := newTestKey(t)
+	server := newTestSSHServer(t, "deploy", sameKey(signer.PublicKey()))
+	keyPath := filepath.Join(home, "deploy_key")
+	writeTestKey(t, keyPath, private, "")
+
+	client, err := SetupSSHClient(SSHOptions{Host: server.host, Port: server.port, User: "deploy", KeyPath: keyPath, HostKeys: hostKeys, SSHConfigFile: "none"})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	localFile := filepath.Join(home, "motd")
+	if err := os.WriteFile(localFile, []byte("welcome\n"), 0600); err != nil {
+		t.Fatalf("Failed to write local file: %v", err)
+	}
+	remoteDir := t.TempDir()
+
+	// New files are readable by everyone
+	newFile := filepath.Join(remoteDir, "new", "motd")
+	if changed, err := TransferFile(client, localFile, newFile, FileOptions{}); err != nil || !changed {
+		t.Fatalf("Expected new file to be transferred, got %v %v", changed, err)
+	}
+	if info, err := os.Stat(newFile); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("Expected mode 0644 of a new file, got %v %v", info.Mode().Perm(), err)
+	}
+
+	// Replaced files keep their mode
+	existingFile := filepath.Join(remoteDir, "motd")
+	if err := os.WriteFile(existingFile, []byte("old\n"), 0640); err != nil {
+		t.Fatalf("Failed to write remote file: %v", err)
+	}
+	if err := os.Chmod(existingFile, 0640); err != nil {
+		t.Fatalf("Failed to chmod remote file: %v", err)
+	}
+	if changed, err := TransferFile(client, localFile, existingFile, FileOptions{}); err != nil || !changed {
+		t.Fatalf("Expected existing file to be replaced, got %v %v", changed, err)
+	}
+	if info, err := os.Stat(existingFile); err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("Expected mode 0640 of a replaced file, got %v %v", info.Mode().Perm(), err)
+	}
+}
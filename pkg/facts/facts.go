@@ -0,0 +1,127 @@
+package facts
+
+import (
+	"fmt"
+	"strings"
+
+	"steward/pkg/common"
+	"steward/pkg/exec"
+	"steward/utils"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var logger = utils.SetupLogging(false)
+
+// managerTools maps the package managers steward supports to the binary probed on the host,
+// in the order they are preferred when the distribution is unknown
+var managerTools = []struct {
+	Manager string
+	Binary  string
+}{
+	{"apt", "apt-get"},
+	{"dnf", "dnf"},
+	{"yum", "yum"},
+	{"apk", "apk"},
+	{"snap", "snap"},
+}
+
+// distroManagers maps distribution IDs from /etc/os-release to their native package managers
+var distroManagers = map[string][]string{
+	"debian":    {"apt"},
+	"ubuntu":    {"apt"},
+	"rhel":      {"dnf", "yum"},
+	"fedora":    {"dnf", "yum"},
+	"centos":    {"dnf", "yum"},
+	"rocky":     {"dnf", "yum"},
+	"almalinux": {"dnf", "yum"},
+	"alpine":    {"apk"},
+}
+
+// Gather reads /etc/os-release and probes the package tools available on the remote host
+func Gather(client *ssh.Client) (*common.Facts, error) {
+	osRelease, err := exec.RunRemoteCommandWithOutput(client, "cat /etc/os-release 2>/dev/null || cat /usr/lib/os-release 2>/dev/null || true")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read os-release: %w", err)
+	}
+	release := ParseOSRelease(osRelease)
+
+	system, err := exec.RunRemoteCommandWithOutput(client, "hostname; uname -m")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hostname and architecture: %w", err)
+	}
+	systemLines := strings.Split(strings.TrimSpace(system), "\n")
+
+	var probe []string
+	for _, tool := range managerTools {
+		probe = append(probe, fmt.Sprintf("command -v %s >/dev/null 2>&1 && echo %s", tool.Binary, tool.Manager))
+	}
+	available, err := exec.RunRemoteCommandWithOutput(client, strings.Join(probe, "; ")+"; true")
+	if err != nil {
+		return nil, fmt.Errorf("failed to probe package managers: %w", err)
+	}
+
+	facts := &common.Facts{
+		Distro:     release["ID"],
+		DistroLike: strings.Fields(release["ID_LIKE"]),
+		Version:    release["VERSION_ID"],
+		PrettyName: release["PRETTY_NAME"],
+		Managers:   strings.Fields(available),
+	}
+	if len(systemLines) > 0 {
+		facts.Hostname = strings.TrimSpace(systemLines[0])
+	}
+	if len(systemLines) > 1 {
+		facts.Arch = strings.TrimSpace(systemLines[1])
+	}
+	facts.DefaultManager = DefaultManager(facts)
+
+	logger.Infof("Detected %s %s with package manager %s on host %s", facts.Distro, facts.Version, facts.DefaultManager, client.RemoteAddr())
+	return facts, nil
+}
+
+// ParseOSRelease parses the KEY=value lines of an os-release file
+func ParseOSRelease(content string) map[string]string {
+	release := make(map[string]string)
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			continue
+		}
+		value = strings.Trim(value, `"'`)
+		release[strings.TrimSpace(key)] = value
+	}
+	return release
+}
+
+// DefaultManager picks the native package manager of the detected distribution.
+// Distributions are matched by ID, then by ID_LIKE. If none of them is known the
+// first available tool is used, in the order of managerTools.
+func DefaultManager(facts *common.Facts) string {
+	for _, distro := range append([]string{facts.Distro}, facts.DistroLike...) {
+		for _, manager := range distroManagers[distro] {
+			if contains(facts.Managers, manager) {
+				return manager
+			}
+		}
+	}
+	for _, tool := range managerTools {
+		if contains(facts.Managers, tool.Manager) {
+			return tool.Manager
+		}
+	}
+	return ""
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
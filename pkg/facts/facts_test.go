@@ -0,0 +1,58 @@
+package facts
+
+import (
+	"testing"
+
+	"steward/pkg/common"
+)
+
+func TestParseOSRelease(t *testing.T) {
+	content := `PRETTY_NAME="Ubuntu 22.04.4 LTS"
+NAME="Ubuntu"
+VERSION_ID="22.04"
+# comment
+ID=ubuntu
+ID_LIKE=debian
+`
+	release := ParseOSRelease(content)
+
+	expected := map[string]string{
+		"PRETTY_NAME": "Ubuntu 22.04.4 LTS",
+		"NAME":        "Ubuntu",
+		"VERSION_ID":  "22.04",
+		"ID":          "ubuntu",
+		"ID_LIKE":     "debian",
+	}
+	if len(release) != len(expected) {
+		t.Errorf("Expected %d keys, got %d", len(expected), len(release))
+	}
+	for key, value := range expected {
+		if release[key] != value {
+			t.Errorf("Expected %s '%s', got '%s'", key, value, release[key])
+		}
+	}
+}
+
+func TestDefaultManager(t *testing.T) {
+	tests := []struct {
+		name     string
+		facts    common.Facts
+		expected string
+	}{
+		{"ubuntu", common.Facts{Distro: "ubuntu", Managers: []string{"apt", "snap"}}, "apt"},
+		{"rocky with dnf", common.Facts{Distro: "rocky", DistroLike: []string{"rhel", "centos", "fedora"}, Managers: []string{"dnf", "yum"}}, "dnf"},
+		{"centos 7 with yum", common.Facts{Distro: "centos", Managers: []string{"yum"}}, "yum"},
+		{"alpine", common.Facts{Distro: "alpine", Managers: []string{"apk"}}, "apk"},
+		{"derivative by ID_LIKE", common.Facts{Distro: "linuxmint", DistroLike: []string{"ubuntu", "debian"}, Managers: []string{"apt"}}, "apt"},
+		{"unknown distro", common.Facts{Distro: "custom", Managers: []string{"snap", "apk"}}, "apk"},
+		{"no managers", common.Facts{Distro: "ubuntu"}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DefaultManager(&tt.facts); got != tt.expected {
+				t.Errorf("Expected manager '%s', got '%s'", tt.expected, got)
+			}
+		})
+	}
+}
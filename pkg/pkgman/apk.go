@@ -0,0 +1,193 @@
+package pkgman
+
+import (
+	"fmt"
+	"path"
+	"steward/pkg/exec"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// apkRepositories is the repository list of apk
+	apkRepositories = "/etc/apk/repositories"
+	// apkKeyDir is where apk looks up repository signing keys
+	apkKeyDir = "/etc/apk/keys"
+)
+
+// ApkManager provides methods to manage apk packages on a remote Alpine server
+type ApkManager struct {
+	Client *ssh.Client
+}
+
+// NewApkManager creates a new instance of ApkManager
+func NewApkManager(client *ssh.Client) *ApkManager {
+	return &ApkManager{Client: client}
+}
+
+// UpdateRepo updates the apk package index
+func (a *ApkManager) UpdateRepo(become exec.Become) error {
+	command := "apk update"
+	return exec.RunRemoteCommandWithBecome(a.Client, command, become)
+}
+
+// InstallPackage installs a package using apk
+func (a *ApkManager) InstallPackage(become exec.Become, packageName string) error {
+	return a.InstallPackages(become, packageName)
+}
+
+// InstallPackages installs several packages in a single apk transaction
+func (a *ApkManager) InstallPackages(become exec.Become, packageNames ...string) error {
+	command := fmt.Sprintf("apk add %s", strings.Join(packageNames, " "))
+	return exec.RunRemoteCommandWithBecome(a.Client, command, become)
+}
+
+// RemovePackage removes a package using apk
+func (a *ApkManager) RemovePackage(become exec.Become, packageName string) error {
+	return a.RemovePackages(become, packageName)
+}
+
+// RemovePackages removes several packages in a single apk transaction
+func (a *ApkManager) RemovePackages(become exec.Become, packageNames ...string) error {
+	command := fmt.Sprintf("apk del %s", strings.Join(packageNames, " "))
+	return exec.RunRemoteCommandWithBecome(a.Client, command, become)
+}
+
+// UpgradePackage upgrades an installed package to the latest available version
+func (a *ApkManager) UpgradePackage(become exec.Become, packageName string) error {
+	return a.UpgradePackages(become, packageName)
+}
+
+// UpgradePackages upgrades several installed packages in a single apk transaction
+func (a *ApkManager) UpgradePackages(become exec.Become, packageNames ...string) error {
+	command := fmt.Sprintf("apk add -u %s", strings.Join(packageNames, " "))
+	return exec.RunRemoteCommandWithBecome(a.Client, command, become)
+}
+
+// PackageSpec pins a package to a version using the apk "name=version" syntax
+func (a *ApkManager) PackageSpec(packageName string, version string) string {
+	if version == "" {
+		return packageName
+	}
+	return fmt.Sprintf("%s=%s", packageName, version)
+}
+
+// AddRepository appends a third-party repository to /etc/apk/repositories
+func (a *ApkManager) AddRepository(become exec.Become, repoName string, repoUrl string) error {
+	// Check if the repository is already added
+	checkCommand := fmt.Sprintf("grep -xF '%s' %s || true", repoUrl, apkRepositories)
+	output, err := exec.RunRemoteCommandWithOutput(a.Client, checkCommand)
+	if err != nil {
+		return fmt.Errorf("failed to check repository: %w", err)
+	}
+
+	if strings.Contains(output, repoUrl) {
+		logger.Infof("Repository '%s' is already added. Skipping.", repoName)
+		return nil
+	}
+
+	// Add the repository if not already added
+	command := fmt.Sprintf("echo '%s' | tee -a %s && apk update", repoUrl, apkRepositories)
+	return exec.RunRemoteCommandWithBecome(a.Client, command, become)
+}
+
+// InstallGPGKey downloads a repository signing key into /etc/apk/keys.
+// apk matches keys by file name, so the name of the key in the URL is kept
+// when it is a public key file.
+func (a *ApkManager) InstallGPGKey(become exec.Become, keyName string, keyURL string) error {
+	keyFile := apkKeyPath(keyName, keyURL)
+
+	// Check if the key is already installed
+	checkCommand := fmt.Sprintf("test -f %s && echo 'exists' || true", keyFile)
+	output, err := exec.RunRemoteCommandWithOutput(a.Client, checkCommand)
+	if err != nil {
+		return fmt.Errorf("failed to check signing key: %w", err)
+	}
+
+	if strings.Contains(output, "exists") {
+		logger.Infof("Signing key '%s' is already installed. Skipping.", keyName)
+		return nil
+	}
+
+	// Install the key if not already installed
+	command := fmt.Sprintf("mkdir -p %s && wget -qO %s %s", apkKeyDir, keyFile, keyURL)
+	return exec.RunRemoteCommandWithBecome(a.Client, command, become)
+}
+
+// KeyFingerprint returns the SHA-256 of an installed signing key, apk keys are plain RSA keys
+func (a *ApkManager) KeyFingerprint(keyName string, keyURL string) (string, error) {
+	command := fmt.Sprintf("sha256sum %s 2>/dev/null | cut -d' ' -f1", apkKeyPath(keyName, keyURL))
+	output, err := exec.RunRemoteCommandWithOutput(a.Client, command)
+	if err != nil {
+		return "", fmt.Errorf("failed to read signing key fingerprint: %w", err)
+	}
+	return strings.TrimSpace(output), nil
+}
+
+// IsPackageInstalled checks if a package is installed using apk info -e
+func (a *ApkManager) IsPackageInstalled(packageName string) (bool, error) {
+	command := fmt.Sprintf("apk info -e %s || true", packageName)
+	output, err := exec.RunRemoteCommandWithOutput(a.Client, command)
+	if err != nil {
+		return false, fmt.Errorf("failed to check package: %w", err)
+	}
+	return strings.TrimSpace(output) == packageName, nil
+}
+
+// FetchInstalledVersion fetches the installed version of a package from apk info -v
+func (a *ApkManager) FetchInstalledVersion(packageName string) (string, error) {
+	versions, err := a.InstalledVersions(packageName)
+	if err != nil {
+		return "", err
+	}
+
+	version, ok := versions[packageName]
+	if !ok {
+		return "", fmt.Errorf("package '%s' is not installed", packageName)
+	}
+	return version, nil
+}
+
+// InstalledVersions fetches the installed versions of several packages with a
+// single apk info -v call. Packages which are not installed are left out.
+func (a *ApkManager) InstalledVersions(packageNames ...string) (map[string]string, error) {
+	output, err := exec.RunRemoteCommandWithOutput(a.Client, "apk info -v 2>/dev/null")
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch installed versions: %w", err)
+	}
+
+	versions := make(map[string]string)
+	for _, packageName := range packageNames {
+		if version, ok := parseApkVersion(output, packageName); ok {
+			versions[packageName] = version
+		}
+	}
+	return versions, nil
+}
+
+// parseApkVersion finds the version of a package in the "name-version" lines
+// printed by apk info -v. Package names may contain dashes themselves, so the
+// version is the remainder after the name when it starts with a digit.
+func parseApkVersion(output string, packageName string) (string, bool) {
+	prefix := packageName + "-"
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, prefix) {
+			continue
+		}
+		version := strings.TrimPrefix(line, prefix)
+		if version != "" && version[0] >= '0' && version[0] <= '9' {
+			return version, true
+		}
+	}
+	return "", false
+}
+
+// apkKeyPath returns the path where the signing key of a repository is stored
+func apkKeyPath(keyName string, keyURL string) string {
+	if base := path.Base(keyURL); strings.HasSuffix(base, ".pub") {
+		return fmt.Sprintf("%s/%s", apkKeyDir, base)
+	}
+	return fmt.Sprintf("%s/%s.rsa.pub", apkKeyDir, keyName)
+}
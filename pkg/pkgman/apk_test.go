@@ -0,0 +1,42 @@
+package pkgman
+
+import (
+	"testing"
+)
+
+func TestParseApkVersion(t *testing.T) {
+	output := `musl-1.2.5-r0
+busybox-1.36.1-r29
+ca-certificates-bundle-20241121-r1
+ca-certificates-20241121-r1
+py3-setuptools-70.3.0-r0
+`
+	tests := []struct {
+		name     string
+		expected string
+		found    bool
+	}{
+		{"musl", "1.2.5-r0", true},
+		{"ca-certificates", "20241121-r1", true},
+		{"ca-certificates-bundle", "20241121-r1", true},
+		{"py3-setuptools", "70.3.0-r0", true},
+		{"ca", "", false},
+		{"nginx", "", false},
+	}
+
+	for _, tt := range tests {
+		version, found := parseApkVersion(output, tt.name)
+		if found != tt.found || version != tt.expected {
+			t.Errorf("parseApkVersion(%q) = (%q, %v), expected (%q, %v)", tt.name, version, found, tt.expected, tt.found)
+		}
+	}
+}
+
+func TestApkKeyPath(t *testing.T) {
+	if got := apkKeyPath("docker", "https://example.com/keys/builder-6512.rsa.pub"); got != "/etc/apk/keys/builder-6512.rsa.pub" {
+		t.Errorf("Expected key file name from URL, got '%s'", got)
+	}
+	if got := apkKeyPath("docker", "https://example.com/key"); got != "/etc/apk/keys/docker.rsa.pub" {
+		t.Errorf("Expected key file name from key name, got '%s'", got)
+	}
+}
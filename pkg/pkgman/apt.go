@@ -21,20 +21,66 @@ func NewAptManager(client *ssh.Client) *AptManager {
 }
 
 // UpdateRepo updates the apt package repository
-func (a *AptManager) UpdateRepo(sudoPass string) error {
-    command := fmt.Sprintf("sudo apt update")
+func (a *AptManager) UpdateRepo(become exec.Become) error {
+    command := fmt.Sprintf("apt update")
     // return exec.RunRemoteCommand(a.Client, command)
-    return exec.RunRemoteCommandWithSudo(a.Client, command, sudoPass)
+    return exec.RunRemoteCommandWithBecome(a.Client, command, become)
 }
 
 // InstallPackage installs a package using apt
-func (a *AptManager) InstallPackage(sudoPass string, packageName string) error {
-    command := fmt.Sprintf("sudo apt install -y %s", packageName)
-    return exec.RunRemoteCommandWithSudo(a.Client, command, sudoPass)
+func (a *AptManager) InstallPackage(become exec.Become, packageName string) error {
+    return a.InstallPackages(become, packageName)
+}
+
+// InstallPackages installs several packages in a single apt transaction
+func (a *AptManager) InstallPackages(become exec.Become, packageNames ...string) error {
+    command := fmt.Sprintf("apt install -y %s", strings.Join(packageNames, " "))
+    return exec.RunRemoteCommandWithBecome(a.Client, command, become)
+}
+
+// RemovePackage removes a package using apt
+func (a *AptManager) RemovePackage(become exec.Become, packageName string) error {
+    return a.RemovePackages(become, packageName)
+}
+
+// RemovePackages removes several packages in a single apt transaction
+func (a *AptManager) RemovePackages(become exec.Become, packageNames ...string) error {
+    command := fmt.Sprintf("apt remove -y %s", strings.Join(packageNames, " "))
+    return exec.RunRemoteCommandWithBecome(a.Client, command, become)
+}
+
+// PurgePackage removes a package together with its configuration files
+func (a *AptManager) PurgePackage(become exec.Become, packageName string) error {
+    return a.PurgePackages(become, packageName)
+}
+
+// PurgePackages removes several packages together with their configuration files
+func (a *AptManager) PurgePackages(become exec.Become, packageNames ...string) error {
+    command := fmt.Sprintf("apt purge -y %s", strings.Join(packageNames, " "))
+    return exec.RunRemoteCommandWithBecome(a.Client, command, become)
+}
+
+// UpgradePackage upgrades an installed package to the latest available version
+func (a *AptManager) UpgradePackage(become exec.Become, packageName string) error {
+    return a.UpgradePackages(become, packageName)
+}
+
+// UpgradePackages upgrades several installed packages in a single apt transaction
+func (a *AptManager) UpgradePackages(become exec.Become, packageNames ...string) error {
+    command := fmt.Sprintf("apt install -y --only-upgrade %s", strings.Join(packageNames, " "))
+    return exec.RunRemoteCommandWithBecome(a.Client, command, become)
+}
+
+// PackageSpec pins a package to a version using the apt "name=version" syntax
+func (a *AptManager) PackageSpec(packageName string, version string) string {
+    if version == "" {
+        return packageName
+    }
+    return fmt.Sprintf("%s=%s", packageName, version)
 }
 
 // AddRepository adds a third-party repository to the system
-func (a *AptManager) AddRepository(sudoPass string, repoName string, repoUrl string) error {
+func (a *AptManager) AddRepository(become exec.Become, repoName string, repoUrl string) error {
     // Check if the repository is already added
     checkCommand := fmt.Sprintf("grep -h '^deb .*%s' /etc/apt/sources.list /etc/apt/sources.list.d/*.list || true", repoUrl)
     output, err := exec.RunRemoteCommandWithOutput(a.Client, checkCommand)
@@ -48,12 +94,12 @@ func (a *AptManager) AddRepository(sudoPass string, repoName string, repoUrl str
     }
 
     // Add the repository if not already added
-    command := fmt.Sprintf("echo 'deb [signed-by=/etc/apt/keyrings/%s-apt-keyring.gpg] %s /' | sudo tee /etc/apt/sources.list.d/%s.list && sudo apt update", repoName, repoUrl, repoName)
-    return exec.RunRemoteCommandWithSudo(a.Client, command, sudoPass)
+    command := fmt.Sprintf("echo 'deb [signed-by=/etc/apt/keyrings/%s-apt-keyring.gpg] %s /' | tee /etc/apt/sources.list.d/%s.list && apt update", repoName, repoUrl, repoName)
+    return exec.RunRemoteCommandWithBecome(a.Client, command, become)
 }
 
 // InstallGPGKey installs a GPG key from a URL
-func (a *AptManager) InstallGPGKey(sudoPass string, keyName string, keyURL string) error {
+func (a *AptManager) InstallGPGKey(become exec.Become, keyName string, keyURL string) error {
     // Check if the GPG key is already installed
     checkCommand := fmt.Sprintf("test -f /etc/apt/keyrings/%s-apt-keyring.gpg && echo 'exists' || true", keyName)
     output, err := exec.RunRemoteCommandWithOutput(a.Client, checkCommand)
@@ -67,51 +113,78 @@ func (a *AptManager) InstallGPGKey(sudoPass string, keyName string, keyURL strin
     }
 
     // Create Directory for keyrings if it doesn't exist
-    createDirCommand := "sudo mkdir -p /etc/apt/keyrings"
-    if err := exec.RunRemoteCommandWithSudo(a.Client, createDirCommand, sudoPass); err != nil {
+    createDirCommand := "mkdir -p /etc/apt/keyrings"
+    if err := exec.RunRemoteCommandWithBecome(a.Client, createDirCommand, become); err != nil {
         return fmt.Errorf("failed to create keyrings directory: %w", err)
     }
 
     // Install the GPG key if not already installed
-    command := fmt.Sprintf("curl -fsSL %s | sudo gpg --dearmor -o /etc/apt/keyrings/%s-apt-keyring.gpg", keyURL, keyName)
-    return exec.RunRemoteCommandWithSudo(a.Client, command, sudoPass)
+    command := fmt.Sprintf("curl -fsSL %s | gpg --dearmor -o /etc/apt/keyrings/%s-apt-keyring.gpg", keyURL, keyName)
+    return exec.RunRemoteCommandWithBecome(a.Client, command, become)
+}
+
+// KeyFingerprint returns the fingerprint of the first key in an installed keyring
+func (a *AptManager) KeyFingerprint(keyName string, keyURL string) (string, error) {
+    command := fmt.Sprintf("gpg --show-keys --with-colons /etc/apt/keyrings/%s-apt-keyring.gpg 2>/dev/null | awk -F: '/^fpr/ {print $10; exit}'", keyName)
+    output, err := exec.RunRemoteCommandWithOutput(a.Client, command)
+    if err != nil {
+        return "", fmt.Errorf("failed to read GPG key fingerprint: %w", err)
+    }
+    return strings.TrimSpace(output), nil
 }
 
 // Check if a package is installed
 func (a *AptManager) IsPackageInstalled(packageName string) (bool, error) {
-    command := fmt.Sprintf("dpkg -l | grep '^ii' | grep '%s'", packageName)
+    // dpkg-query fails for unknown packages, which means not installed
+    command := fmt.Sprintf("dpkg-query -W -f='${db:Status-Abbrev}' %s 2>/dev/null || true", packageName)
     output, err := exec.RunRemoteCommandWithOutput(a.Client, command)
     if err != nil {
         return false, fmt.Errorf("failed to check package: %w", err)
     }
 
-    if strings.Contains(output, packageName) {
-        return true, nil
-    }
-    return false, nil
+    // "ii" means the package is desired to be and is installed
+    return strings.HasPrefix(output, "ii"), nil
 }
 
-// FetchInstalledVersion fetches the installed version of a package and updates a configuration file
+// FetchInstalledVersion fetches the installed version of a package
 func (a *AptManager) FetchInstalledVersion(packageName string) (string, error) {
-    // Check if the package is installed
-    isInstalled, err := a.IsPackageInstalled(packageName)
+    versions, err := a.InstalledVersions(packageName)
     if err != nil {
-        return "", fmt.Errorf("failed to check if package is installed: %w", err)
+        return "", err
     }
 
-    if !isInstalled {
+    version, ok := versions[packageName]
+    if !ok {
         return "", fmt.Errorf("package '%s' is not installed", packageName)
     }
+    return version, nil
+}
 
-    // Fetch the installed version of the package
-    command := fmt.Sprintf("dpkg -l | grep '^ii' | grep '  %s  ' | awk '{print $3}'", packageName)
-    version, err := exec.RunRemoteCommandWithOutput(a.Client, command)
+// InstalledVersions fetches the installed versions of several packages with a
+// single dpkg-query call. Packages which are not installed are left out.
+func (a *AptManager) InstalledVersions(packageNames ...string) (map[string]string, error) {
+    // dpkg-query fails if any of the packages is unknown, the known ones are still printed
+    command := fmt.Sprintf("dpkg-query -W -f='${Package}\\t${db:Status-Abbrev}\\t${Version}\\n' %s 2>/dev/null || true", strings.Join(packageNames, " "))
+    output, err := exec.RunRemoteCommandWithOutput(a.Client, command)
     if err != nil {
-        return "", fmt.Errorf("failed to fetch installed version of package '%s': %w", packageName, err)
+        return nil, fmt.Errorf("failed to fetch installed versions: %w", err)
     }
+    return parseDpkgQuery(output), nil
+}
 
-    version = strings.TrimSpace(version) // Remove any trailing whitespace
-
-    // Return new package name with version which installed
-    return fmt.Sprintf("%s", version), nil 
-}
\ No newline at end of file
+// parseDpkgQuery parses the "package<TAB>status<TAB>version" lines printed by
+// dpkg-query into a map of installed package versions
+func parseDpkgQuery(output string) map[string]string {
+    versions := make(map[string]string)
+    for _, line := range strings.Split(output, "\n") {
+        fields := strings.Split(strings.TrimRight(line, "\r"), "\t")
+        if len(fields) != 3 {
+            continue
+        }
+        // "ii" means the package is desired to be and is installed
+        if strings.HasPrefix(fields[1], "ii") && fields[2] != "" {
+            versions[fields[0]] = fields[2]
+        }
+    }
+    return versions
+}
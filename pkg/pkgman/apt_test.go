@@ -0,0 +1,37 @@
+package pkgman
+
+import (
+	"testing"
+)
+
+func TestParseDpkgQuery(t *testing.T) {
+	output := "curl\tii \t7.81.0-1ubuntu1.16\n" +
+		"gpg\tii \t2.2.27-3ubuntu2.1\n" +
+		"nginx\trc \t1.18.0-6ubuntu14.4\n" +
+		"kubeadm\tun \t\n"
+
+	versions := parseDpkgQuery(output)
+
+	expected := map[string]string{
+		"curl": "7.81.0-1ubuntu1.16",
+		"gpg":  "2.2.27-3ubuntu2.1",
+	}
+	if len(versions) != len(expected) {
+		t.Fatalf("Expected %d installed packages, got %d: %v", len(expected), len(versions), versions)
+	}
+	for name, version := range expected {
+		if versions[name] != version {
+			t.Errorf("Expected %s version '%s', got '%s'", name, version, versions[name])
+		}
+	}
+}
+
+func TestAptPackageSpec(t *testing.T) {
+	apt := &AptManager{}
+	if got := apt.PackageSpec("kubeadm", ""); got != "kubeadm" {
+		t.Errorf("Expected 'kubeadm', got '%s'", got)
+	}
+	if got := apt.PackageSpec("kubeadm", "1.32.0-1.1"); got != "kubeadm=1.32.0-1.1" {
+		t.Errorf("Expected 'kubeadm=1.32.0-1.1', got '%s'", got)
+	}
+}
@@ -0,0 +1,214 @@
+package pkgman
+
+import (
+	"fmt"
+	"steward/pkg/exec"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// rpmKeyDir is where signing keys of third-party repositories are stored
+const rpmKeyDir = "/etc/pki/rpm-gpg"
+
+// DnfManager provides methods to manage dnf or yum packages on a remote server
+type DnfManager struct {
+	Client *ssh.Client
+	// Binary is the package manager command, either "dnf" or "yum"
+	Binary string
+}
+
+// NewDnfManager creates a new instance of DnfManager using dnf
+func NewDnfManager(client *ssh.Client) *DnfManager {
+	return &DnfManager{Client: client, Binary: "dnf"}
+}
+
+// NewYumManager creates a new instance of DnfManager using yum
+func NewYumManager(client *ssh.Client) *DnfManager {
+	return &DnfManager{Client: client, Binary: "yum"}
+}
+
+// UpdateRepo refreshes the dnf metadata cache
+func (d *DnfManager) UpdateRepo(become exec.Become) error {
+	command := fmt.Sprintf("%s makecache -y", d.Binary)
+	return exec.RunRemoteCommandWithBecome(d.Client, command, become)
+}
+
+// InstallPackage installs a package using dnf
+func (d *DnfManager) InstallPackage(become exec.Become, packageName string) error {
+	return d.InstallPackages(become, packageName)
+}
+
+// InstallPackages installs several packages in a single dnf transaction
+func (d *DnfManager) InstallPackages(become exec.Become, packageNames ...string) error {
+	command := fmt.Sprintf("%s install -y %s", d.Binary, strings.Join(packageNames, " "))
+	return exec.RunRemoteCommandWithBecome(d.Client, command, become)
+}
+
+// RemovePackage removes a package using dnf
+func (d *DnfManager) RemovePackage(become exec.Become, packageName string) error {
+	return d.RemovePackages(become, packageName)
+}
+
+// RemovePackages removes several packages in a single dnf transaction
+func (d *DnfManager) RemovePackages(become exec.Become, packageNames ...string) error {
+	command := fmt.Sprintf("%s remove -y %s", d.Binary, strings.Join(packageNames, " "))
+	return exec.RunRemoteCommandWithBecome(d.Client, command, become)
+}
+
+// UpgradePackage upgrades an installed package to the latest available version
+func (d *DnfManager) UpgradePackage(become exec.Become, packageName string) error {
+	return d.UpgradePackages(become, packageName)
+}
+
+// UpgradePackages upgrades several installed packages in a single dnf transaction
+func (d *DnfManager) UpgradePackages(become exec.Become, packageNames ...string) error {
+	command := fmt.Sprintf("%s upgrade -y %s", d.Binary, strings.Join(packageNames, " "))
+	return exec.RunRemoteCommandWithBecome(d.Client, command, become)
+}
+
+// PackageSpec pins a package to a version using the rpm "name-version" syntax
+func (d *DnfManager) PackageSpec(packageName string, version string) string {
+	if version == "" {
+		return packageName
+	}
+	return fmt.Sprintf("%s-%s", packageName, version)
+}
+
+// VersionMatches reports whether an installed "version-release" satisfies a
+// pinned version, which may leave out the release
+func (d *DnfManager) VersionMatches(installed string, pinned string) bool {
+	return installed == pinned || strings.HasPrefix(installed, pinned+"-")
+}
+
+// PinsInstalledVersion is true, "name-version-release" installs the exact package
+func (d *DnfManager) PinsInstalledVersion() bool {
+	return true
+}
+
+// AddRepository adds a third-party repository as a .repo file in /etc/yum.repos.d.
+// The repository is GPG checked when a key was installed with InstallGPGKey.
+func (d *DnfManager) AddRepository(become exec.Become, repoName string, repoUrl string) error {
+	repoFile := fmt.Sprintf("/etc/yum.repos.d/%s.repo", repoName)
+
+	// Check if the repository is already added
+	checkCommand := fmt.Sprintf("grep -h '^baseurl=%s' %s 2>/dev/null || true", repoUrl, repoFile)
+	output, err := exec.RunRemoteCommandWithOutput(d.Client, checkCommand)
+	if err != nil {
+		return fmt.Errorf("failed to check repository: %w", err)
+	}
+
+	if strings.Contains(output, repoUrl) {
+		logger.Infof("Repository '%s' is already added. Skipping.", repoName)
+		return nil
+	}
+
+	lines := []string{
+		fmt.Sprintf("[%s]", repoName),
+		fmt.Sprintf("name=%s", repoName),
+		fmt.Sprintf("baseurl=%s", repoUrl),
+		"enabled=1",
+	}
+
+	// Only enable GPG checks when the signing key is present
+	keyFile := rpmKeyPath(repoName)
+	output, err = exec.RunRemoteCommandWithOutput(d.Client, fmt.Sprintf("test -f %s && echo 'exists' || true", keyFile))
+	if err != nil {
+		return fmt.Errorf("failed to check GPG key: %w", err)
+	}
+	if strings.Contains(output, "exists") {
+		lines = append(lines, "gpgcheck=1", fmt.Sprintf("gpgkey=file://%s", keyFile))
+	} else {
+		lines = append(lines, "gpgcheck=0")
+	}
+
+	// Add the repository if not already added
+	command := fmt.Sprintf("printf '%%s\\n' '%s' | tee %s && %s makecache -y",
+		strings.Join(lines, "' '"), repoFile, d.Binary)
+	return exec.RunRemoteCommandWithBecome(d.Client, command, become)
+}
+
+// InstallGPGKey downloads a GPG key from a URL and imports it with rpm --import
+func (d *DnfManager) InstallGPGKey(become exec.Become, keyName string, keyURL string) error {
+	keyFile := rpmKeyPath(keyName)
+
+	// Check if the GPG key is already installed
+	checkCommand := fmt.Sprintf("test -f %s && echo 'exists' || true", keyFile)
+	output, err := exec.RunRemoteCommandWithOutput(d.Client, checkCommand)
+	if err != nil {
+		return fmt.Errorf("failed to check GPG key: %w", err)
+	}
+
+	if strings.Contains(output, "exists") {
+		logger.Infof("GPG key '%s' is already installed. Skipping.", keyName)
+		return nil
+	}
+
+	// Install the GPG key if not already installed
+	command := fmt.Sprintf("mkdir -p %s && curl -fsSL %s -o %s && rpm --import %s", rpmKeyDir, keyURL, keyFile, keyFile)
+	return exec.RunRemoteCommandWithBecome(d.Client, command, become)
+}
+
+// KeyFingerprint returns the fingerprint of an installed repository signing key
+func (d *DnfManager) KeyFingerprint(keyName string, keyURL string) (string, error) {
+	command := fmt.Sprintf("gpg --show-keys --with-colons %s 2>/dev/null | awk -F: '/^fpr/ {print $10; exit}'", rpmKeyPath(keyName))
+	output, err := exec.RunRemoteCommandWithOutput(d.Client, command)
+	if err != nil {
+		return "", fmt.Errorf("failed to read GPG key fingerprint: %w", err)
+	}
+	return strings.TrimSpace(output), nil
+}
+
+// IsPackageInstalled checks if a package is installed using rpm -q
+func (d *DnfManager) IsPackageInstalled(packageName string) (bool, error) {
+	command := fmt.Sprintf("rpm -q %s >/dev/null 2>&1 && echo 'installed' || true", packageName)
+	output, err := exec.RunRemoteCommandWithOutput(d.Client, command)
+	if err != nil {
+		return false, fmt.Errorf("failed to check package: %w", err)
+	}
+	return strings.Contains(output, "installed"), nil
+}
+
+// FetchInstalledVersion fetches the installed "version-release" of a package using rpm -q
+func (d *DnfManager) FetchInstalledVersion(packageName string) (string, error) {
+	versions, err := d.InstalledVersions(packageName)
+	if err != nil {
+		return "", err
+	}
+
+	version, ok := versions[packageName]
+	if !ok {
+		return "", fmt.Errorf("package '%s' is not installed", packageName)
+	}
+	return version, nil
+}
+
+// InstalledVersions fetches the installed "version-release" of several packages
+// with a single rpm -q call. Packages which are not installed are left out.
+func (d *DnfManager) InstalledVersions(packageNames ...string) (map[string]string, error) {
+	// rpm -q fails if any of the packages is not installed, the installed ones are still printed
+	command := fmt.Sprintf("rpm -q --qf '%%{NAME}\\t%%{VERSION}-%%{RELEASE}\\n' %s 2>/dev/null || true", strings.Join(packageNames, " "))
+	output, err := exec.RunRemoteCommandWithOutput(d.Client, command)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch installed versions: %w", err)
+	}
+	return parseRpmQuery(output), nil
+}
+
+// parseRpmQuery parses the "name<TAB>version-release" lines printed by rpm -q
+// into a map. The "package x is not installed" lines have no tab and are skipped.
+func parseRpmQuery(output string) map[string]string {
+	versions := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		name, version, found := strings.Cut(strings.TrimSpace(line), "\t")
+		if found && version != "" {
+			versions[name] = version
+		}
+	}
+	return versions
+}
+
+// rpmKeyPath returns the path where the signing key of a repository is stored
+func rpmKeyPath(keyName string) string {
+	return fmt.Sprintf("%s/RPM-GPG-KEY-%s", rpmKeyDir, keyName)
+}
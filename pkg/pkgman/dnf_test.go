@@ -0,0 +1,52 @@
+package pkgman
+
+import (
+	"testing"
+)
+
+func TestParseRpmQuery(t *testing.T) {
+	output := "curl\t7.76.1-29.el9_4\n" +
+		"package nginx is not installed\n" +
+		"kernel-headers\t5.14.0-427.el9\n"
+
+	versions := parseRpmQuery(output)
+
+	expected := map[string]string{
+		"curl":           "7.76.1-29.el9_4",
+		"kernel-headers": "5.14.0-427.el9",
+	}
+	if len(versions) != len(expected) {
+		t.Fatalf("Expected %d installed packages, got %d: %v", len(expected), len(versions), versions)
+	}
+	for name, version := range expected {
+		if versions[name] != version {
+			t.Errorf("Expected %s version '%s', got '%s'", name, version, versions[name])
+		}
+	}
+}
+
+func TestDnfPackageSpec(t *testing.T) {
+	dnf := NewDnfManager(nil)
+	if got := dnf.PackageSpec("nginx", "1.20.1-14.el9"); got != "nginx-1.20.1-14.el9" {
+		t.Errorf("Expected 'nginx-1.20.1-14.el9', got '%s'", got)
+	}
+}
+
+func TestDnfVersionMatches(t *testing.T) {
+	dnf := NewDnfManager(nil)
+	tests := []struct {
+		installed string
+		pinned    string
+		expected  bool
+	}{
+		{"1.20.1-14.el9", "1.20.1-14.el9", true},
+		{"1.20.1-14.el9", "1.20.1", true},
+		{"1.20.1-14.el9", "1.20", false},
+		{"1.20.10-1.el9", "1.20.1", false},
+	}
+	for _, tt := range tests {
+		if got := dnf.VersionMatches(tt.installed, tt.pinned); got != tt.expected {
+			t.Errorf("Expected %v for %s pinned to %s, got %v", tt.expected, tt.installed, tt.pinned, got)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package pkgman
+
+import (
+	"fmt"
+	"sort"
+
+	"steward/pkg/exec"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// PackageManager is the common interface implemented by every package manager backend
+type PackageManager interface {
+	// UpdateRepo refreshes the package index on the remote server
+	UpdateRepo(become exec.Become) error
+	// InstallPackage installs a package spec as returned by PackageSpec
+	InstallPackage(become exec.Become, packageName string) error
+	// InstallPackages installs several package specs in a single transaction
+	InstallPackages(become exec.Become, packageNames ...string) error
+	// RemovePackage removes an installed package
+	RemovePackage(become exec.Become, packageName string) error
+	// RemovePackages removes several installed packages in a single transaction
+	RemovePackages(become exec.Become, packageNames ...string) error
+	// UpgradePackage upgrades an installed package to the latest available version
+	UpgradePackage(become exec.Become, packageName string) error
+	// UpgradePackages upgrades several installed packages in a single transaction
+	UpgradePackages(become exec.Become, packageNames ...string) error
+	// IsPackageInstalled checks if a package is installed
+	IsPackageInstalled(packageName string) (bool, error)
+	// FetchInstalledVersion returns the installed version of a package
+	FetchInstalledVersion(packageName string) (string, error)
+	// InstalledVersions returns the installed versions of several packages with a
+	// single query, packages which are not installed are left out of the map
+	InstalledVersions(packageNames ...string) (map[string]string, error)
+	// PackageSpec formats a package name and optional version for InstallPackage
+	PackageSpec(packageName string, version string) string
+}
+
+// RepositoryManager is implemented by package managers which can register
+// third-party repositories and their signing keys
+type RepositoryManager interface {
+	// AddRepository adds a third-party repository to the system
+	AddRepository(become exec.Become, repoName string, repoUrl string) error
+	// InstallGPGKey installs the signing key of a repository from a URL
+	InstallGPGKey(become exec.Become, keyName string, keyURL string) error
+	// KeyFingerprint returns the fingerprint of a signing key installed with InstallGPGKey
+	KeyFingerprint(keyName string, keyURL string) (string, error)
+}
+
+// Purger is implemented by package managers which can remove a package
+// together with its configuration files
+type Purger interface {
+	// PurgePackage removes a package and its configuration files
+	PurgePackage(become exec.Become, packageName string) error
+	// PurgePackages removes several packages and their configuration files in a single transaction
+	PurgePackages(become exec.Become, packageNames ...string) error
+}
+
+// VersionMatcher is implemented by package managers whose installed versions
+// are not in the format packages are pinned with. Installed versions of other
+// managers must equal the pinned version.
+type VersionMatcher interface {
+	// VersionMatches reports whether an installed version satisfies a pinned version
+	VersionMatches(installed string, pinned string) bool
+	// PinsInstalledVersion reports whether an installed version can be passed to
+	// PackageSpec, to pin a package to the version recorded in the lockfile
+	PinsInstalledVersion() bool
+}
+
+// ChannelManager is implemented by package managers which pin packages to
+// channels instead of versions. Their VersionMatches compares the tracked
+// channel with the pinned channel.
+type ChannelManager interface {
+	// TrackingChannels returns the channels several installed packages track
+	// with a single query, packages which are not installed are left out
+	TrackingChannels(packageNames ...string) (map[string]string, error)
+	// SwitchChannel moves an installed package to another channel
+	SwitchChannel(become exec.Become, packageName string, channel string) error
+}
+
+// VersionMatches reports whether the installed version of a package satisfies
+// its pinned version for a package manager
+func VersionMatches(manager PackageManager, installed string, pinned string) bool {
+	if matcher, ok := manager.(VersionMatcher); ok {
+		return matcher.VersionMatches(installed, pinned)
+	}
+	return installed == pinned
+}
+
+// PinsInstalledVersion reports whether packages of a package manager can be
+// pinned to their installed version
+func PinsInstalledVersion(manager PackageManager) bool {
+	if matcher, ok := manager.(VersionMatcher); ok {
+		return matcher.PinsInstalledVersion()
+	}
+	return true
+}
+
+// Factory creates a package manager bound to an SSH client
+type Factory func(client *ssh.Client) PackageManager
+
+// registry maps the manager names used in the configuration to their factories
+var registry = map[string]Factory{
+	"apt":  func(client *ssh.Client) PackageManager { return NewAptManager(client) },
+	"snap": func(client *ssh.Client) PackageManager { return NewSnapManager(client) },
+	"dnf":  func(client *ssh.Client) PackageManager { return NewDnfManager(client) },
+	"yum":  func(client *ssh.Client) PackageManager { return NewYumManager(client) },
+	"apk":  func(client *ssh.Client) PackageManager { return NewApkManager(client) },
+}
+
+// NewManager creates the package manager registered under name
+func NewManager(name string, client *ssh.Client) (PackageManager, error) {
+	factory, ok := registry[name]
+	if !ok {
+		return nil, fmt.Errorf("unsupported package manager: %q", name)
+	}
+	return factory(client), nil
+}
+
+// IsSupported reports whether a package manager is registered under name
+func IsSupported(name string) bool {
+	_, ok := registry[name]
+	return ok
+}
+
+// SupportedManagers returns the sorted names of all registered package managers
+func SupportedManagers() []string {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
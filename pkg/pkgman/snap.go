@@ -21,28 +21,138 @@ func NewSnapManager(client *ssh.Client) *SnapManager {
 }
 
 // InstallPackage installs a Snap package
-func (s *SnapManager) InstallPackage(sudoPass string, packageName string) error {
-    command := fmt.Sprintf("sudo snap install %s", packageName)
-    return exec.RunRemoteCommandWithSudo(s.Client, command, sudoPass)
+func (s *SnapManager) InstallPackage(become exec.Become, packageName string) error {
+    command := fmt.Sprintf("snap install %s", packageName)
+    return exec.RunRemoteCommandWithBecome(s.Client, command, become)
+}
+
+// InstallPackages installs several Snap packages. Snap only accepts a channel
+// for a single package, so pinned packages are installed one by one.
+func (s *SnapManager) InstallPackages(become exec.Become, packageNames ...string) error {
+    var plain []string
+    for _, packageName := range packageNames {
+        if strings.Contains(packageName, " ") {
+            if err := s.InstallPackage(become, packageName); err != nil {
+                return err
+            }
+            continue
+        }
+        plain = append(plain, packageName)
+    }
+    if len(plain) == 0 {
+        return nil
+    }
+    return s.InstallPackage(become, strings.Join(plain, " "))
 }
 
 // RemovePackage removes a Snap package
-func (s *SnapManager) RemovePackage(sudoPass string, packageName string) error {
-    command := fmt.Sprintf("sudo snap remove %s", packageName)
-    return exec.RunRemoteCommandWithSudo(s.Client, command, sudoPass)
+func (s *SnapManager) RemovePackage(become exec.Become, packageName string) error {
+    return s.RemovePackages(become, packageName)
+}
+
+// RemovePackages removes several Snap packages
+func (s *SnapManager) RemovePackages(become exec.Become, packageNames ...string) error {
+    command := fmt.Sprintf("snap remove %s", strings.Join(packageNames, " "))
+    return exec.RunRemoteCommandWithBecome(s.Client, command, become)
+}
+
+// UpdateRepo is a no-op for Snap, the store is always queried live
+func (s *SnapManager) UpdateRepo(become exec.Become) error {
+    return nil
+}
+
+// PackageSpec pins a Snap package to a channel, Snap has no version pinning
+func (s *SnapManager) PackageSpec(packageName string, version string) string {
+    if version == "" {
+        return packageName
+    }
+    return fmt.Sprintf("%s --channel=%s", packageName, version)
+}
+
+// VersionMatches reports whether the channel a Snap package tracks, as
+// returned by TrackingChannels, is its pinned channel. Channels are compared
+// in full, 1.29 is 1.29/stable and stable is latest/stable.
+func (s *SnapManager) VersionMatches(installed string, pinned string) bool {
+    return fullSnapChannel(installed) == fullSnapChannel(pinned)
+}
+
+// snapRisks are the risk levels of Snap channels
+var snapRisks = []string{"stable", "candidate", "beta", "edge"}
+
+// fullSnapChannel expands a Snap channel to track/risk
+func fullSnapChannel(channel string) string {
+    if channel == "" || strings.Contains(channel, "/") {
+        return channel
+    }
+    for _, risk := range snapRisks {
+        if channel == risk {
+            return "latest/" + channel
+        }
+    }
+    return channel + "/stable"
+}
+
+// TrackingChannels fetches the channels several installed Snap packages track
+// with a single snap list call. Packages which are not installed are left out.
+func (s *SnapManager) TrackingChannels(packageNames ...string) (map[string]string, error) {
+    command := fmt.Sprintf("snap list %s 2>/dev/null || true", strings.Join(packageNames, " "))
+    output, err := exec.RunRemoteCommandWithOutput(s.Client, command)
+    if err != nil {
+        return nil, fmt.Errorf("failed to fetch tracking channels of Snap packages: %w", err)
+    }
+    return parseSnapTracking(output), nil
+}
+
+// parseSnapTracking parses the Tracking column of snap list, packages
+// installed from a local file track no channel and are shown as -
+func parseSnapTracking(output string) map[string]string {
+    channels := make(map[string]string)
+    for _, line := range strings.Split(output, "\n") {
+        fields := strings.Fields(line)
+        if len(fields) >= 4 && fields[0] != "Name" { // Skip the header line
+            channel := fields[3]
+            if channel == "-" {
+                channel = ""
+            }
+            channels[fields[0]] = channel
+        }
+    }
+    return channels
+}
+
+// SwitchChannel refreshes an installed Snap package to another channel
+func (s *SnapManager) SwitchChannel(become exec.Become, packageName string, channel string) error {
+    command := fmt.Sprintf("snap refresh --channel=%s %s", channel, packageName)
+    return exec.RunRemoteCommandWithBecome(s.Client, command, become)
+}
+
+// PinsInstalledVersion is false, an installed version is not a Snap channel
+func (s *SnapManager) PinsInstalledVersion() bool {
+    return false
+}
+
+// UpgradePackage refreshes a Snap package to the latest revision of its channel
+func (s *SnapManager) UpgradePackage(become exec.Become, packageName string) error {
+    return s.UpgradePackages(become, packageName)
+}
+
+// UpgradePackages refreshes several Snap packages
+func (s *SnapManager) UpgradePackages(become exec.Become, packageNames ...string) error {
+    command := fmt.Sprintf("snap refresh %s", strings.Join(packageNames, " "))
+    return exec.RunRemoteCommandWithBecome(s.Client, command, become)
 }
 
 // RefreshPackages refreshes Snap packages
-func (s *SnapManager) RefreshPackages(sudoPass string) error {
-    command := "sudo snap refresh"
-    return exec.RunRemoteCommandWithSudo(s.Client, command, sudoPass)
+func (s *SnapManager) RefreshPackages(become exec.Become) error {
+    command := "snap refresh"
+    return exec.RunRemoteCommandWithBecome(s.Client, command, become)
 }
 
 // AddRepository adds a third-party Snap repository to the system
-func (s *SnapManager) AddRepository(sudoPass string, assertionFilePath string) error {
+func (s *SnapManager) AddRepository(become exec.Become, assertionFilePath string) error {
     // Import the assertion file
-    command := fmt.Sprintf("sudo snap ack %s", assertionFilePath)
-    err := exec.RunRemoteCommandWithSudo(s.Client, command, sudoPass)
+    command := fmt.Sprintf("snap ack %s", assertionFilePath)
+    err := exec.RunRemoteCommandWithBecome(s.Client, command, become)
     if err != nil {
         return fmt.Errorf("failed to add Snap repository: %w", err)
     }
@@ -53,7 +163,7 @@ func (s *SnapManager) AddRepository(sudoPass string, assertionFilePath string) e
 
 // IsPackageInstalled checks if a Snap package is installed
 func (s *SnapManager) IsPackageInstalled(packageName string) (bool, error) {
-    command := fmt.Sprintf("snap list | grep '^%s '", packageName)
+    command := fmt.Sprintf("snap list | grep '^%s ' || true", packageName)
     output, err := exec.RunRemoteCommandWithOutput(s.Client, command)
     if err != nil {
         return false, fmt.Errorf("failed to check Snap package: %w", err)
@@ -65,6 +175,39 @@ func (s *SnapManager) IsPackageInstalled(packageName string) (bool, error) {
     return false, nil
 }
 
+// FetchInstalledVersion fetches the installed version of a Snap package
+func (s *SnapManager) FetchInstalledVersion(packageName string) (string, error) {
+    versions, err := s.InstalledVersions(packageName)
+    if err != nil {
+        return "", err
+    }
+
+    version, ok := versions[packageName]
+    if !ok {
+        return "", fmt.Errorf("Snap package '%s' is not installed", packageName)
+    }
+    return version, nil
+}
+
+// InstalledVersions fetches the installed versions of several Snap packages
+// with a single snap list call. Packages which are not installed are left out.
+func (s *SnapManager) InstalledVersions(packageNames ...string) (map[string]string, error) {
+    command := fmt.Sprintf("snap list %s 2>/dev/null || true", strings.Join(packageNames, " "))
+    output, err := exec.RunRemoteCommandWithOutput(s.Client, command)
+    if err != nil {
+        return nil, fmt.Errorf("failed to fetch installed versions of Snap packages: %w", err)
+    }
+
+    versions := make(map[string]string)
+    for _, line := range strings.Split(output, "\n") {
+        fields := strings.Fields(line)
+        if len(fields) >= 2 && fields[0] != "Name" { // Skip the header line
+            versions[fields[0]] = fields[1]
+        }
+    }
+    return versions, nil
+}
+
 // ListInstalledPackages lists all installed Snap packages
 func (s *SnapManager) ListInstalledPackages() ([]string, error) {
     command := "snap list --all"
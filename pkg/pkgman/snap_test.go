@@ -0,0 +1,50 @@
+package pkgman
+
+import (
+	"testing"
+)
+
+func TestParseSnapTracking(t *testing.T) {
+	output := "Name      Version  Rev    Tracking       Publisher   Notes\n" +
+		"microk8s  v1.29.4  6809   1.29/stable    canonical✓  classic\n" +
+		"hello     2.10     42     latest/edge    canonical✓  -\n" +
+		"local     1.0      x1     -              -           -\n"
+
+	channels := parseSnapTracking(output)
+
+	expected := map[string]string{
+		"microk8s": "1.29/stable",
+		"hello":    "latest/edge",
+		"local":    "",
+	}
+	if len(channels) != len(expected) {
+		t.Fatalf("Expected %d installed snaps, got %d: %v", len(expected), len(channels), channels)
+	}
+	for name, channel := range expected {
+		if channels[name] != channel {
+			t.Errorf("Expected %s channel '%s', got '%s'", name, channel, channels[name])
+		}
+	}
+}
+
+func TestSnapVersionMatches(t *testing.T) {
+	snap := NewSnapManager(nil)
+	tests := []struct {
+		tracking string
+		pinned   string
+		expected bool
+	}{
+		{"1.29/stable", "1.29/stable", true},
+		{"1.29/stable", "1.29", true},
+		{"latest/stable", "stable", true},
+		{"latest/edge", "edge", true},
+		{"1.28/stable", "1.29/stable", false},
+		{"1.29/stable", "1.29/edge", false},
+		{"", "1.29/stable", false},
+	}
+	for _, tt := range tests {
+		if got := snap.VersionMatches(tt.tracking, tt.pinned); got != tt.expected {
+			t.Errorf("Expected VersionMatches(%q, %q) to be %v, got %v", tt.tracking, tt.pinned, tt.expected, got)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package run
+
+import (
+	"fmt"
+
+	"steward/pkg/common"
+)
+
+// splitCommands separates the commands which run on every apply from the
+// handlers, the commands notified by configuration templates. Handlers only
+// run when a template notifying them changed.
+func splitCommands(templates []common.ConfigurationTemplate, commands []common.Command) ([]common.Command, []common.Command, error) {
+	known := make(map[string]bool, len(commands))
+	for _, command := range commands {
+		known[command.Name] = true
+	}
+
+	notified := make(map[string]bool)
+	for _, template := range templates {
+		for _, name := range template.Notify {
+			if !known[name] {
+				return nil, nil, fmt.Errorf("template %s notifies unknown command %s", template.Name, name)
+			}
+			notified[name] = true
+		}
+	}
+
+	var always, handlers []common.Command
+	for _, command := range commands {
+		if notified[command.Name] {
+			handlers = append(handlers, command)
+		} else {
+			always = append(always, command)
+		}
+	}
+	return always, handlers, nil
+}
+
+// triggeredHandlers returns the handlers notified by at least one changed
+// template, in the order the commands are defined. Each handler is returned
+// once however many templates notified it.
+func triggeredHandlers(templates []common.ConfigurationTemplate, handlers []common.Command, changed map[string]bool) []common.Command {
+	triggered := make(map[string]bool)
+	for _, template := range templates {
+		if !changed[template.Name] {
+			continue
+		}
+		for _, name := range template.Notify {
+			triggered[name] = true
+		}
+	}
+
+	var commands []common.Command
+	for _, handler := range handlers {
+		if triggered[handler.Name] {
+			commands = append(commands, handler)
+			// Commands with the same name run once
+			delete(triggered, handler.Name)
+		}
+	}
+	return commands
+}
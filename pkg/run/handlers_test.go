@@ -0,0 +1,74 @@
+package run
+
+import (
+	"testing"
+
+	"steward/pkg/common"
+)
+
+func TestSplitCommands(t *testing.T) {
+	templates := []common.ConfigurationTemplate{
+		{Name: "haproxy", Notify: []string{"reload-haproxy"}},
+		{Name: "keepalived", Notify: []string{"reload-keepalived"}},
+	}
+	commands := []common.Command{
+		{Name: "hostname"},
+		{Name: "reload-haproxy"},
+		{Name: "reload-keepalived"},
+	}
+
+	always, handlers, err := splitCommands(templates, commands)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(always) != 1 || always[0].Name != "hostname" {
+		t.Errorf("Expected only hostname to always run, got %v", always)
+	}
+	if len(handlers) != 2 || handlers[0].Name != "reload-haproxy" || handlers[1].Name != "reload-keepalived" {
+		t.Errorf("Expected reload commands as handlers, got %v", handlers)
+	}
+
+	templates = append(templates, common.ConfigurationTemplate{Name: "nginx", Notify: []string{"reload-nginx"}})
+	if _, _, err := splitCommands(templates, commands); err == nil {
+		t.Errorf("Expected error for a notification of an unknown command")
+	}
+}
+
+func TestTriggeredHandlers(t *testing.T) {
+	templates := []common.ConfigurationTemplate{
+		{Name: "haproxy", Notify: []string{"reload-haproxy"}},
+		{Name: "haproxy-certs", Notify: []string{"reload-haproxy"}},
+		{Name: "keepalived", Notify: []string{"reload-keepalived"}},
+		{Name: "motd"},
+	}
+	handlers := []common.Command{
+		{Name: "reload-keepalived"},
+		{Name: "reload-haproxy"},
+	}
+
+	tests := []struct {
+		name     string
+		changed  map[string]bool
+		expected []string
+	}{
+		{"nothing changed", map[string]bool{}, nil},
+		{"unrelated template changed", map[string]bool{"motd": true}, nil},
+		{"one template changed", map[string]bool{"keepalived": true}, []string{"reload-keepalived"}},
+		{"handler notified twice runs once", map[string]bool{"haproxy": true, "haproxy-certs": true}, []string{"reload-haproxy"}},
+		{"definition order", map[string]bool{"haproxy": true, "keepalived": true}, []string{"reload-keepalived", "reload-haproxy"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			triggered := triggeredHandlers(templates, handlers, tt.changed)
+			if len(triggered) != len(tt.expected) {
+				t.Fatalf("Expected %d handlers, got %v", len(tt.expected), triggered)
+			}
+			for i, name := range tt.expected {
+				if triggered[i].Name != name {
+					t.Errorf("Expected handler %d to be '%s', got '%s'", i, name, triggered[i].Name)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,441 @@
+package run
+
+import (
+	"fmt"
+
+	"steward/pkg/common"
+	"steward/pkg/exec"
+	"steward/pkg/pkgman"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// fallbackManager is used for packages which do not name a package manager
+// when no package manager could be detected on the host
+const fallbackManager = "apt"
+
+// hostManagers lazily creates one package manager per manager name for a host
+type hostManagers struct {
+	client         *ssh.Client
+	become         exec.Become
+	defaultManager string
+	managers       map[string]pkgman.PackageManager
+	// refresh updates the repository index of a manager before its first use
+	refresh bool
+}
+
+// newHostManagers creates the package managers of a host. Packages without a
+// manager use the default manager detected in the host facts.
+func newHostManagers(client *ssh.Client, become exec.Become, hostFacts *common.Facts) *hostManagers {
+	defaultManager := fallbackManager
+	if hostFacts != nil && hostFacts.DefaultManager != "" {
+		defaultManager = hostFacts.DefaultManager
+	}
+	return &hostManagers{
+		client:         client,
+		become:         become,
+		defaultManager: defaultManager,
+		managers:       make(map[string]pkgman.PackageManager),
+		refresh:        true,
+	}
+}
+
+// resolve returns the manager name used for a package, the host default when empty
+func (h *hostManagers) resolve(name string) string {
+	if name == "" {
+		return h.defaultManager
+	}
+	return name
+}
+
+// get returns the package manager registered under name. The repository index
+// of a manager is refreshed the first time it is used on the host, unless
+// refresh is disabled.
+func (h *hostManagers) get(name string) (pkgman.PackageManager, error) {
+	name = h.resolve(name)
+	if manager, ok := h.managers[name]; ok {
+		return manager, nil
+	}
+
+	manager, err := pkgman.NewManager(name, h.client)
+	if err != nil {
+		return nil, err
+	}
+	if h.refresh {
+		if err := manager.UpdateRepo(h.become); err != nil {
+			return nil, fmt.Errorf("failed to update %s repository: %w", name, err)
+		}
+		logger.Infof("Updated %s repository on host %s", name, h.client.RemoteAddr())
+	}
+
+	h.managers[name] = manager
+	return manager, nil
+}
+
+// appEntry is a core or external application to converge on a host
+type appEntry struct {
+	Name      string
+	Manager   string
+	Version   string
+	State     string
+	Purge     bool
+	GPGKeyURL string
+	Repo      string
+}
+
+func coreAppEntry(app common.CoreApp) appEntry {
+	return appEntry{
+		Name:    app.Name,
+		Manager: app.Manager,
+		Version: app.Version,
+		State:   app.State,
+		Purge:   app.Purge,
+	}
+}
+
+func externalAppEntry(app common.ExternalApp) appEntry {
+	return appEntry{
+		Name:      app.Name,
+		Manager:   app.Manager,
+		Version:   app.Version,
+		State:     app.State,
+		Purge:     app.Purge,
+		GPGKeyURL: app.GPGKeyURL,
+		Repo:      app.Repo,
+	}
+}
+
+// appGroup is the set of applications handled by one package manager
+type appGroup struct {
+	manager pkgman.PackageManager
+	apps    []appEntry
+	// fingerprints of the repository keys installed for the applications
+	fingerprints map[string]string
+}
+
+// groupApps groups applications by package manager in the order the managers
+// are first used. Present applications without a version are pinned to the
+// version recorded in locked, when given and the manager pins versions.
+func groupApps(managers *hostManagers, apps []appEntry, locked *common.HostLock) ([]string, map[string]*appGroup, error) {
+	var order []string
+	groups := make(map[string]*appGroup)
+	for _, app := range apps {
+		name := managers.resolve(app.Manager)
+		group, ok := groups[name]
+		if !ok {
+			manager, err := managers.get(name)
+			if err != nil {
+				return nil, nil, err
+			}
+			group = &appGroup{manager: manager, fingerprints: make(map[string]string)}
+			groups[name] = group
+			order = append(order, name)
+		}
+
+		if app.Version == "" && packageState(app.State) == common.StatePresent && pkgman.PinsInstalledVersion(group.manager) {
+			if version, ok := locked.LockedVersion(app.Name, name); ok {
+				logger.Infof("Pinned package %s to locked version %s on host %s", app.Name, version, managers.client.RemoteAddr())
+				app.Version = version
+			}
+		}
+		group.apps = append(group.apps, app)
+	}
+	return order, groups, nil
+}
+
+// convergeApps brings applications into their desired state. Applications are
+// grouped by package manager and each group is installed, upgraded and removed
+// in one transaction per operation. done is called for each application with
+// its resolved lock, the version is empty once it is absent.
+func convergeApps(managers *hostManagers, apps []appEntry, locked *common.HostLock, done func(app appEntry, pkg common.PackageLock)) error {
+	order, groups, err := groupApps(managers, apps, locked)
+	if err != nil {
+		return err
+	}
+
+	// Repositories have to be registered before any package of a group is installed
+	for _, name := range order {
+		group := groups[name]
+		for _, app := range group.apps {
+			fingerprint, err := registerRepository(managers, group.manager, name, app)
+			if err != nil {
+				return fmt.Errorf("package %s: %w", app.Name, err)
+			}
+			group.fingerprints[app.Name] = fingerprint
+		}
+	}
+
+	for _, name := range order {
+		if err := convergeGroup(managers, name, groups[name], done); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// PackageChange is a change apply makes to a package
+type PackageChange struct {
+	Name    string `json:"name"`
+	Manager string `json:"manager"`
+	Action  string `json:"action"`
+	Current string `json:"current"`
+	Desired string `json:"desired"`
+}
+
+// planApps returns the changes convergeApps would make, without changing the host
+func planApps(managers *hostManagers, apps []appEntry, locked *common.HostLock) ([]PackageChange, error) {
+	order, groups, err := groupApps(managers, apps, locked)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []PackageChange
+	for _, name := range order {
+		group := groups[name]
+		names := make([]string, 0, len(group.apps))
+		for _, app := range group.apps {
+			names = append(names, app.Name)
+		}
+
+		installed, current, err := currentVersions(group.manager, names)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		for _, app := range group.apps {
+			installedVersion, isInstalled := installed[app.Name]
+			action, err := packageAction(group.manager, app, current[app.Name], isInstalled)
+			if err != nil {
+				return nil, err
+			}
+			if action == "" {
+				continue
+			}
+
+			desired := app.Version
+			switch action {
+			case actionRemove, actionPurge:
+				desired = ""
+			case actionUpgrade:
+				desired = common.StateLatest
+			}
+			if action == actionSwitchChannel {
+				installedVersion = current[app.Name]
+			}
+			changes = append(changes, PackageChange{
+				Name:    app.Name,
+				Manager: name,
+				Action:  action,
+				Current: installedVersion,
+				Desired: desired,
+			})
+		}
+	}
+	return changes, nil
+}
+
+// Actions taken on a package to converge it
+const (
+	actionInstall       = "install"
+	actionUpgrade       = "upgrade"
+	actionRemove        = "remove"
+	actionPurge         = "purge"
+	actionSwitchChannel = "switch-channel"
+)
+
+// currentVersions returns the installed versions of packages, and the values
+// their pinned versions are compared with: the installed versions, or the
+// tracked channels for package managers which pin channels
+func currentVersions(manager pkgman.PackageManager, names []string) (map[string]string, map[string]string, error) {
+	installed, err := manager.InstalledVersions(names...)
+	if err != nil {
+		return nil, nil, err
+	}
+	channelManager, ok := manager.(pkgman.ChannelManager)
+	if !ok {
+		return installed, installed, nil
+	}
+	channels, err := channelManager.TrackingChannels(names...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return installed, channels, nil
+}
+
+// packageAction decides which action converges an application given its
+// current version, the tracked channel for package managers which pin
+// channels. An empty action means the application is converged.
+func packageAction(manager pkgman.PackageManager, app appEntry, installedVersion string, isInstalled bool) (string, error) {
+	switch app.State {
+	case common.StateAbsent:
+		if !isInstalled {
+			return "", nil
+		}
+		if app.Purge {
+			return actionPurge, nil
+		}
+		return actionRemove, nil
+	case common.StateLatest:
+		if isInstalled {
+			return actionUpgrade, nil
+		}
+		return actionInstall, nil
+	case common.StatePresent, "":
+		if !isInstalled {
+			return actionInstall, nil
+		}
+		// Reinstall only when the pinned version differs, or move to the pinned channel
+		if app.Version != "" && !pkgman.VersionMatches(manager, installedVersion, app.Version) {
+			if _, ok := manager.(pkgman.ChannelManager); ok {
+				return actionSwitchChannel, nil
+			}
+			return actionInstall, nil
+		}
+		return "", nil
+	default:
+		return "", fmt.Errorf("unknown state %q of package %s", app.State, app.Name)
+	}
+}
+
+// registerRepository installs the GPG key and repository of an external
+// application and returns the fingerprint of the installed key
+func registerRepository(managers *hostManagers, manager pkgman.PackageManager, managerName string, app appEntry) (string, error) {
+	// Repositories are kept when a package is removed, other packages may use them
+	if app.State == common.StateAbsent || (app.GPGKeyURL == "" && app.Repo == "") {
+		return "", nil
+	}
+
+	repoManager, ok := manager.(pkgman.RepositoryManager)
+	if !ok {
+		return "", fmt.Errorf("package manager %q does not support third-party repositories", managerName)
+	}
+
+	// Install GPG key skip if empty
+	fingerprint := ""
+	if app.GPGKeyURL != "" {
+		if err := repoManager.InstallGPGKey(managers.become, app.Name, app.GPGKeyURL); err != nil {
+			return "", fmt.Errorf("failed to install GPG key: %w", err)
+		}
+		logger.Infof("Installed GPG key %s on host %s", app.Name, managers.client.RemoteAddr())
+
+		var err error
+		fingerprint, err = repoManager.KeyFingerprint(app.Name, app.GPGKeyURL)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// Install repo skip if empty
+	if app.Repo != "" {
+		if err := repoManager.AddRepository(managers.become, app.Name, app.Repo); err != nil {
+			return "", fmt.Errorf("failed to add repository: %w", err)
+		}
+		logger.Infof("Added repo %s on host %s", app.Name, managers.client.RemoteAddr())
+	}
+	return fingerprint, nil
+}
+
+// convergeGroup converges the applications of one package manager. Installed
+// versions are resolved with one query before and one after the changes.
+func convergeGroup(managers *hostManagers, managerName string, group *appGroup, done func(app appEntry, pkg common.PackageLock)) error {
+	manager := group.manager
+
+	names := make([]string, 0, len(group.apps))
+	for _, app := range group.apps {
+		names = append(names, app.Name)
+	}
+
+	installed, current, err := currentVersions(manager, names)
+	if err != nil {
+		return err
+	}
+
+	var install, upgrade, remove, purge []string
+	var switchChannel []appEntry
+	for _, app := range group.apps {
+		_, isInstalled := installed[app.Name]
+		action, err := packageAction(group.manager, app, current[app.Name], isInstalled)
+		if err != nil {
+			return err
+		}
+		switch action {
+		case actionSwitchChannel:
+			switchChannel = append(switchChannel, app)
+		case actionPurge:
+			purge = append(purge, app.Name)
+		case actionRemove:
+			remove = append(remove, app.Name)
+		case actionUpgrade:
+			upgrade = append(upgrade, app.Name)
+		case actionInstall:
+			version := app.Version
+			if app.State == common.StateLatest {
+				version = ""
+			}
+			install = append(install, manager.PackageSpec(app.Name, version))
+		}
+	}
+
+	if len(purge) > 0 {
+		if purger, ok := manager.(pkgman.Purger); ok {
+			err = purger.PurgePackages(managers.become, purge...)
+		} else {
+			// Managers without purge support remove configuration files on removal
+			err = manager.RemovePackages(managers.become, purge...)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if len(remove) > 0 {
+		if err := manager.RemovePackages(managers.become, remove...); err != nil {
+			return err
+		}
+	}
+	if len(install) > 0 {
+		if err := manager.InstallPackages(managers.become, install...); err != nil {
+			return err
+		}
+	}
+	if len(upgrade) > 0 {
+		if err := manager.UpgradePackages(managers.become, upgrade...); err != nil {
+			return err
+		}
+	}
+	for _, app := range switchChannel {
+		// packageAction only switches channels of channel managers
+		if err := manager.(pkgman.ChannelManager).SwitchChannel(managers.become, app.Name, app.Version); err != nil {
+			return err
+		}
+	}
+
+	versions, err := manager.InstalledVersions(names...)
+	if err != nil {
+		return fmt.Errorf("failed to fetch installed versions: %w", err)
+	}
+	for _, app := range group.apps {
+		version, isInstalled := versions[app.Name]
+		if app.State == common.StateAbsent {
+			if isInstalled {
+				return fmt.Errorf("package %s is still installed", app.Name)
+			}
+			version = ""
+		} else if !isInstalled {
+			return fmt.Errorf("package %s is not installed", app.Name)
+		}
+		done(app, common.PackageLock{
+			Manager:        managerName,
+			Version:        version,
+			Repo:           app.Repo,
+			KeyFingerprint: group.fingerprints[app.Name],
+		})
+	}
+	return nil
+}
+
+// packageState returns the state of a package, present when it is not set
+func packageState(state string) string {
+	if state == "" {
+		return common.StatePresent
+	}
+	return state
+}
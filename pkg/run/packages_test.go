@@ -0,0 +1,71 @@
+package run
+
+import (
+	"testing"
+
+	"steward/pkg/common"
+	"steward/pkg/exec"
+	"steward/pkg/pkgman"
+)
+
+func TestPackageAction(t *testing.T) {
+	apt := pkgman.NewAptManager(nil)
+	dnf := pkgman.NewDnfManager(nil)
+	snap := pkgman.NewSnapManager(nil)
+
+	tests := []struct {
+		name        string
+		manager     pkgman.PackageManager
+		app         appEntry
+		installed   string
+		isInstalled bool
+		expected    string
+	}{
+		{"present missing", apt, appEntry{Name: "curl"}, "", false, actionInstall},
+		{"present installed", apt, appEntry{Name: "curl"}, "7.81.0", true, ""},
+		{"present pinned match", apt, appEntry{Name: "curl", Version: "7.81.0"}, "7.81.0", true, ""},
+		{"present pinned differs", apt, appEntry{Name: "curl", Version: "7.81.0"}, "7.88.1", true, actionInstall},
+		{"dnf pinned version matches release", dnf, appEntry{Name: "nginx", Version: "1.20.1"}, "1.20.1-14.el9", true, ""},
+		{"dnf pinned release matches", dnf, appEntry{Name: "nginx", Version: "1.20.1-14.el9"}, "1.20.1-14.el9", true, ""},
+		{"dnf pinned version differs", dnf, appEntry{Name: "nginx", Version: "1.20"}, "1.20.1-14.el9", true, actionInstall},
+		{"snap pinned channel changed", snap, appEntry{Name: "microk8s", Version: "1.29/stable"}, "1.28/stable", true, actionSwitchChannel},
+		{"snap pinned channel tracked", snap, appEntry{Name: "microk8s", Version: "1.29"}, "1.29/stable", true, ""},
+		{"snap pinned channel missing", snap, appEntry{Name: "microk8s", Version: "1.29/stable"}, "", false, actionInstall},
+		{"latest missing", apt, appEntry{Name: "curl", State: common.StateLatest}, "", false, actionInstall},
+		{"latest installed", apt, appEntry{Name: "curl", State: common.StateLatest}, "7.81.0", true, actionUpgrade},
+		{"absent missing", apt, appEntry{Name: "nginx", State: common.StateAbsent}, "", false, ""},
+		{"absent installed", apt, appEntry{Name: "nginx", State: common.StateAbsent}, "1.18.0", true, actionRemove},
+		{"absent purge", apt, appEntry{Name: "nginx", State: common.StateAbsent, Purge: true}, "1.18.0", true, actionPurge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			action, err := packageAction(tt.manager, tt.app, tt.installed, tt.isInstalled)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if action != tt.expected {
+				t.Errorf("Expected action '%s', got '%s'", tt.expected, action)
+			}
+		})
+	}
+
+	if _, err := packageAction(apt, appEntry{Name: "curl", State: "installed"}, "", false); err == nil {
+		t.Errorf("Expected an error for an unknown state")
+	}
+}
+
+func TestGroupAppsSkipsLockedSnapVersions(t *testing.T) {
+	managers := newHostManagers(nil, exec.Become{}, nil)
+	managers.refresh = false
+	locked := common.NewHostLock()
+	locked.SetPackage("microk8s", common.PackageLock{Manager: "snap", Version: "v1.29.4"})
+
+	_, groups, err := groupApps(managers, []appEntry{{Name: "microk8s", Manager: "snap"}}, locked)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if version := groups["snap"].apps[0].Version; version != "" {
+		t.Errorf("Expected snap package not to be pinned to its locked version, got '%s'", version)
+	}
+}
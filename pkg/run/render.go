@@ -0,0 +1,183 @@
+package run
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"steward/pkg/common"
+	"steward/pkg/diff"
+)
+
+// RenderedTemplate is a configuration template rendered for a host
+type RenderedTemplate struct {
+	Host       string
+	Name       string
+	RemoteFile string
+	Content    []byte
+}
+
+// Path returns the path of the rendered template relative to a render
+// directory, the remote file path below a directory per host
+func (r RenderedTemplate) Path() string {
+	return filepath.Join(r.Host, filepath.FromSlash(r.RemoteFile))
+}
+
+// RenderConfig renders the configuration templates of the merged config
+// locally, without connecting to the hosts. Empty filters select all hosts
+// and templates. Facts are not detected, templates see empty facts.
+func RenderConfig(config *common.Config, hostFilter string, templateFilter string) ([]RenderedTemplate, error) {
+	inventory := make([]common.Host, len(config.Hosts))
+	copy(inventory, config.Hosts)
+
+	var rendered []RenderedTemplate
+	hostFound, templateFound := false, false
+	for _, host := range config.Hosts {
+		if hostFilter != "" && host.Host != hostFilter {
+			continue
+		}
+		hostFound = true
+
+		var templates []common.ConfigurationTemplate
+		templates = append(templates, config.Common.Configuration...)
+		templates = append(templates, host.Configuration...)
+
+		host.Facts = &common.Facts{}
+		for _, template := range templates {
+			if templateFilter != "" && template.Name != templateFilter {
+				continue
+			}
+			templateFound = true
+
+			context := common.NewTemplateContext(template.Data, host, inventory)
+			content, err := common.RenderTemplate(template.TemplateFile, context)
+			if err != nil {
+				return nil, fmt.Errorf("failed to render template %s for host %s: %w", template.Name, host.Host, err)
+			}
+			rendered = append(rendered, RenderedTemplate{
+				Host:       host.Host,
+				Name:       template.Name,
+				RemoteFile: template.RemoteFile,
+				Content:    content,
+			})
+		}
+	}
+
+	if hostFilter != "" && !hostFound {
+		return nil, fmt.Errorf("host %s not found in config", hostFilter)
+	}
+	if templateFilter != "" && !templateFound {
+		return nil, fmt.Errorf("template %s not found in config", templateFilter)
+	}
+	return rendered, nil
+}
+
+// WriteRendered writes rendered templates below dir
+func WriteRendered(dir string, rendered []RenderedTemplate) error {
+	for _, r := range rendered {
+		path := filepath.Join(dir, r.Path())
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, r.Content, 0644); err != nil {
+			return err
+		}
+		logger.Infof("Rendered template %s for host %s at %s", r.Name, r.Host, path)
+	}
+	return nil
+}
+
+// PrintRendered writes rendered templates to w, each preceded by a header
+func PrintRendered(w io.Writer, rendered []RenderedTemplate) error {
+	for _, r := range rendered {
+		if _, err := fmt.Fprintf(w, "# %s: %s (%s)\n%s\n", r.Host, r.Name, r.RemoteFile, r.Content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DiffRendered writes the unified diff between a previous render in dir and
+// the rendered templates to w, and reports whether any template differs.
+// Templates missing from the previous render are shown as new files. Files of
+// the previous render which are no longer rendered are shown as removed, below
+// the directory of hostFilter when set. A render of a single template cannot
+// tell which files were removed, so templateFilter skips them.
+func DiffRendered(w io.Writer, dir string, rendered []RenderedTemplate, hostFilter string, templateFilter string) (bool, error) {
+	changed := false
+	outputs := make(map[string]bool)
+	for _, r := range rendered {
+		outputs[r.Path()] = true
+		previousPath := filepath.Join(dir, r.Path())
+		previous, err := os.ReadFile(previousPath)
+		if err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+
+		name := filepath.ToSlash(r.Path())
+		patch := diff.Unified("a/"+name, "b/"+name, string(previous), string(r.Content))
+		if patch == "" {
+			continue
+		}
+		changed = true
+		if _, err := io.WriteString(w, patch); err != nil {
+			return false, err
+		}
+	}
+	if templateFilter != "" {
+		return changed, nil
+	}
+
+	removed, err := removedOutputs(dir, hostFilter, outputs)
+	if err != nil {
+		return false, err
+	}
+	for _, path := range removed {
+		previous, err := os.ReadFile(filepath.Join(dir, path))
+		if err != nil {
+			return false, err
+		}
+		name := filepath.ToSlash(path)
+		patch := diff.Unified("a/"+name, "b/"+name, string(previous), "")
+		if patch == "" {
+			continue
+		}
+		changed = true
+		if _, err := io.WriteString(w, patch); err != nil {
+			return false, err
+		}
+	}
+	return changed, nil
+}
+
+// removedOutputs returns the paths of the files of a previous render in dir
+// which are not among outputs, relative to dir
+func removedOutputs(dir string, hostFilter string, outputs map[string]bool) ([]string, error) {
+	root := dir
+	if hostFilter != "" {
+		root = filepath.Join(dir, hostFilter)
+	}
+	var removed []string
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		relative, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if !outputs[relative] {
+			removed = append(removed, relative)
+		}
+		return nil
+	})
+	return removed, err
+}
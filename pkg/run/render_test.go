@@ -0,0 +1,146 @@
+package run
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"steward/pkg/common"
+)
+
+// renderTestConfig returns a merged config with one template on two hosts
+func renderTestConfig(t *testing.T) *common.Config {
+	templateFile := filepath.Join(t.TempDir(), "keepalived.tmpl")
+	if err := os.WriteFile(templateFile, []byte("state {{.state}} on {{.Host.Host}}\n"), 0644); err != nil {
+		t.Fatalf("Failed to create template file: %v", err)
+	}
+
+	template := common.ConfigurationTemplate{
+		Name:         "keepalived",
+		TemplateFile: templateFile,
+		RemoteFile:   "/etc/keepalived/keepalived.conf",
+		Data:         map[string]interface{}{"state": "MASTER"},
+	}
+	return &common.Config{Hosts: []common.Host{
+		{Host: "10.0.0.1", Configuration: []common.ConfigurationTemplate{template}},
+		{Host: "10.0.0.2", Configuration: []common.ConfigurationTemplate{template}},
+	}}
+}
+
+func TestRenderConfig(t *testing.T) {
+	config := renderTestConfig(t)
+
+	rendered, err := RenderConfig(config, "", "")
+	if err != nil {
+		t.Fatalf("RenderConfig failed: %v", err)
+	}
+	if len(rendered) != 2 {
+		t.Fatalf("Expected 2 rendered templates, got %d", len(rendered))
+	}
+	if string(rendered[1].Content) != "state MASTER on 10.0.0.2\n" {
+		t.Errorf("Unexpected content '%s'", rendered[1].Content)
+	}
+	expectedPath := filepath.Join("10.0.0.2", "etc", "keepalived", "keepalived.conf")
+	if rendered[1].Path() != expectedPath {
+		t.Errorf("Expected path '%s', got '%s'", expectedPath, rendered[1].Path())
+	}
+
+	rendered, err = RenderConfig(config, "10.0.0.1", "keepalived")
+	if err != nil || len(rendered) != 1 || rendered[0].Host != "10.0.0.1" {
+		t.Errorf("Expected only the template of 10.0.0.1, got %v %v", rendered, err)
+	}
+
+	if _, err := RenderConfig(config, "10.0.0.9", ""); err == nil {
+		t.Errorf("Expected error for an unknown host")
+	}
+	if _, err := RenderConfig(config, "", "haproxy"); err == nil {
+		t.Errorf("Expected error for an unknown template")
+	}
+}
+
+func TestDiffRendered(t *testing.T) {
+	config := renderTestConfig(t)
+	dir := t.TempDir()
+
+	rendered, err := RenderConfig(config, "", "")
+	if err != nil {
+		t.Fatalf("RenderConfig failed: %v", err)
+	}
+	if err := WriteRendered(dir, rendered); err != nil {
+		t.Fatalf("WriteRendered failed: %v", err)
+	}
+
+	var out bytes.Buffer
+	changed, err := DiffRendered(&out, dir, rendered, "", "")
+	if err != nil || changed || out.Len() != 0 {
+		t.Errorf("Expected no diff against the same render, got %v %v '%s'", changed, err, out.String())
+	}
+
+	config.Hosts[0].Configuration[0].Data = map[string]interface{}{"state": "BACKUP"}
+	rendered, err = RenderConfig(config, "", "")
+	if err != nil {
+		t.Fatalf("RenderConfig failed: %v", err)
+	}
+	changed, err = DiffRendered(&out, dir, rendered, "", "")
+	if err != nil || !changed {
+		t.Fatalf("Expected a diff, got %v %v", changed, err)
+	}
+	if !strings.Contains(out.String(), "-state MASTER on 10.0.0.1\n+state BACKUP on 10.0.0.1\n") {
+		t.Errorf("Unexpected diff '%s'", out.String())
+	}
+	if strings.Contains(out.String(), "10.0.0.2") {
+		t.Errorf("Expected no diff for the unchanged host, got '%s'", out.String())
+	}
+}
+
+func TestDiffRenderedRemovedOutputs(t *testing.T) {
+	config := renderTestConfig(t)
+	dir := t.TempDir()
+
+	rendered, err := RenderConfig(config, "", "")
+	if err != nil {
+		t.Fatalf("RenderConfig failed: %v", err)
+	}
+	if err := WriteRendered(dir, rendered); err != nil {
+		t.Fatalf("WriteRendered failed: %v", err)
+	}
+
+	// The template of the second host is removed from the config
+	config.Hosts[1].Configuration = nil
+	rendered, err = RenderConfig(config, "", "")
+	if err != nil {
+		t.Fatalf("RenderConfig failed: %v", err)
+	}
+
+	var out bytes.Buffer
+	changed, err := DiffRendered(&out, dir, rendered, "", "")
+	if err != nil || !changed {
+		t.Fatalf("Expected a diff, got %v %v", changed, err)
+	}
+	expected := "--- a/10.0.0.2/etc/keepalived/keepalived.conf\n+++ b/10.0.0.2/etc/keepalived/keepalived.conf\n"
+	if !strings.Contains(out.String(), expected) || !strings.Contains(out.String(), "-state MASTER on 10.0.0.2\n") {
+		t.Errorf("Expected the output of 10.0.0.2 as removed, got '%s'", out.String())
+	}
+
+	tests := []struct {
+		name           string
+		hostFilter     string
+		templateFilter string
+	}{
+		{"other host", "10.0.0.1", ""},
+		{"single template", "", "keepalived"},
+	}
+	for _, test := range tests {
+		filtered, err := RenderConfig(config, test.hostFilter, test.templateFilter)
+		if err != nil {
+			t.Fatalf("RenderConfig failed: %v", err)
+		}
+		out.Reset()
+		changed, err := DiffRendered(&out, dir, filtered, test.hostFilter, test.templateFilter)
+		if err != nil || changed || out.Len() != 0 {
+			t.Errorf("%s: expected no removed outputs, got %v %v '%s'", test.name, changed, err, out.String())
+		}
+	}
+}
@@ -8,7 +8,7 @@ import (
 
 	"steward/pkg/common"
 	"steward/pkg/exec"
-	"steward/pkg/pkgman"
+	"steward/pkg/facts"
 	"steward/utils"
 )
 
@@ -47,7 +47,10 @@ func DisplayProgress(totalTasks int, completedTasks int, tasks []TaskStatus, mu
 	writer.Flush()
 }
 
-func ApplyConfigWithProgress(config *common.Config) *common.Config {
+// ApplyConfigWithProgress applies the configuration to all hosts and returns the
+// updated lockfile. Packages without a version are pinned to the version in lock
+// unless update is set. Hosts which fail keep their previous lock entries.
+func ApplyConfigWithProgress(config *common.Config, lock *common.LockFile, update bool) *common.LockFile {
 	// Initialize task statuses
 	var tasks []TaskStatus
 	for _, host := range config.Hosts {
@@ -84,6 +87,18 @@ func ApplyConfigWithProgress(config *common.Config) *common.Config {
 	var mu sync.Mutex
 	var wg sync.WaitGroup
 
+	// Templates see the inventory as configured, facts of other hosts are detected concurrently
+	inventory := make([]common.Host, len(config.Hosts))
+	copy(inventory, config.Hosts)
+
+	// Start from the previous lock of the configured hosts, removed hosts are dropped
+	newLock := common.NewLockFile()
+	for _, host := range config.Hosts {
+		if hostLock := lock.Host(host.Host); hostLock != nil {
+			newLock.SetHost(host.Host, hostLock)
+		}
+	}
+
 	totalAllHostsTasks := 0
 	for _, task := range tasks {
 		totalAllHostsTasks += task.TotalTasks
@@ -101,12 +116,14 @@ func ApplyConfigWithProgress(config *common.Config) *common.Config {
 
 			completedAppTasks := 0
 			completedConfigTasks := 0
+			// configuration files which were actually uploaded
+			changedConfigTasks := 0
 			completedCommandTasks := 0
 
 			logger.Infof("Starting tasks for host: %s", host.Host)
 
 			// SSH client configuration
-			sshClient, err := exec.SetupSSHClient(host.Host, host.Port, host.User, host.Password, host.SSHKey)
+			sshClient, err := exec.SetupSSHClient(host.SSHOptions())
 			if err != nil {
 				mu.Lock()
 				logger.Errorf("Error setting up SSH client for host %s: %v", host.Host, err)
@@ -116,266 +133,94 @@ func ApplyConfigWithProgress(config *common.Config) *common.Config {
 			}
 			defer sshClient.Close()
 
-			// Initialize apt package manager
-			aptman := pkgman.NewAptManager(sshClient)
-			tasks[taskIndex].Status = "In Progress"
-			DisplayProgress(totalAllHostsTasks, completedTotalTasks, tasks, &mu)
-
-			err = aptman.UpdateRepo(host.Password)
+			// Detect the remote OS and its default package manager
+			hostFacts, err := facts.Gather(sshClient)
 			if err != nil {
 				mu.Lock()
-				logger.Errorf("Error updating apt repository on host %s: %v", host.Host, err)
-				tasks[taskIndex].Status = "Error"
+				logger.Warnf("Error detecting facts of host %s, falling back to %s: %v", host.Host, fallbackManager, err)
 				mu.Unlock()
-				return
 			}
 			mu.Lock()
-			logger.Infof("Updated apt repository on host %s", host.Host)
+			config.Hosts[taskIndex].Facts = hostFacts
 			mu.Unlock()
 
-			// Install common core packages
-			for pkgIndex, pkg := range config.Common.Application.Core {
-				fullPkgName := ""
-				if pkg.Version != "" {
-					fullPkgName = fmt.Sprintf("%s=%s", pkg.Name, pkg.Version)
-				} else {
-					fullPkgName = pkg.Name
-				}
-
-				err := aptman.InstallPackage(host.Password, fullPkgName)
-				if err != nil {
-					mu.Lock()
-					logger.Errorf("Error installing package %s on host %s: %v", pkg, host.Host, err)
-					tasks[taskIndex].Status = "Error"
-					mu.Unlock()
-					return
-				}
-				mu.Lock()
-				appVersion, err := aptman.FetchInstalledVersion(pkg.Name)
-				if err != nil {
-					logger.Errorf("Error fetching installed version of package %s on host %s: %v", pkg, host.Host, err)
-					tasks[taskIndex].Status = "Error"
-					return
-				}
-
-				// replace app name in config with app name and version
-				config.Common.Application.Core[pkgIndex].Version = appVersion
-				logger.Infof("Installed package %s on host %s", pkg, host.Host)
-				mu.Unlock()
+			managers := newHostManagers(sshClient, host.Become(), hostFacts)
+			tasks[taskIndex].Status = "In Progress"
+			DisplayProgress(totalAllHostsTasks, completedTotalTasks, tasks, &mu)
 
-				// update progress
-				completedAppTasks++
-				completedTotalTasks++
-				tasks[taskIndex].Application = fmt.Sprintf("%d/%d", completedAppTasks, tasks[taskIndex].AppTasks)
-				tasks[taskIndex].Status = "In Progress"
-				DisplayProgress(totalAllHostsTasks, completedTotalTasks, tasks, &mu)
+			// Core packages are converged first, external repositories usually need curl and gpg
+			var coreApps, externalApps []appEntry
+			for _, pkg := range config.Common.Application.Core {
+				coreApps = append(coreApps, coreAppEntry(pkg))
+			}
+			for _, pkg := range host.Application.Core {
+				coreApps = append(coreApps, coreAppEntry(pkg))
+			}
+			for _, pkg := range config.Common.Application.External {
+				externalApps = append(externalApps, externalAppEntry(pkg))
+			}
+			for _, pkg := range host.Application.External {
+				externalApps = append(externalApps, externalAppEntry(pkg))
 			}
 
-			// Install host specific core packages
-			for pkgIndex, pkg := range host.Application.Core {
-				fullPkgName := ""
-				if pkg.Version != "" {
-					fullPkgName = fmt.Sprintf("%s=%s", pkg.Name, pkg.Version)
-				} else {
-					fullPkgName = pkg.Name
-				}
-				err := aptman.InstallPackage(host.Password, fullPkgName)
-				if err != nil {
-					mu.Lock()
-					logger.Errorf("Error installing package %s on host %s: %v", pkg, host.Host, err)
-					tasks[taskIndex].Status = "Error"
-					mu.Unlock()
-					return
-				}
-				mu.Lock()
-				appVersion, err := aptman.FetchInstalledVersion(pkg.Name)
-				if err != nil {
-					logger.Errorf("Error fetching installed version of package %s on host %s: %v", pkg, host.Host, err)
-					tasks[taskIndex].Status = "Error"
-					return
-				}
-				// replace app name in config with app name and version
-				config.Hosts[i].Application.Core[pkgIndex].Version = appVersion
-				// config.Common.Application.Core[pkg] = appVersion
-				logger.Infof("Installed package %s on host %s", pkg, host.Host)
-				mu.Unlock()
-
-				// update progress
-				completedAppTasks++
-				completedTotalTasks++
-				tasks[taskIndex].Application = fmt.Sprintf("%d/%d", completedAppTasks, tasks[taskIndex].AppTasks)
-				tasks[taskIndex].Status = "In Progress"
-				DisplayProgress(totalAllHostsTasks, completedTotalTasks, tasks, &mu)
+			// Versions are pinned to the previous lock unless the lock is being updated
+			var locked *common.HostLock
+			if !update {
+				locked = lock.Host(host.Host)
 			}
+			hostLock := common.NewHostLock()
 
-			// Install common external packages
-			for pkgIndex, pkg := range config.Common.Application.External {
-
-				// Install GPG key skip if empty
-				if pkg.GPGKeyURL != "" {
-					err := aptman.InstallGPGKey(host.Password, pkg.Name, pkg.GPGKeyURL)
-					if err != nil {
-						mu.Lock()
-						logger.Errorf("Error installing GPG key %s on host %s: %v", pkg.Name, host.Host, err)
-						tasks[taskIndex].Status = "Error"
-						mu.Unlock()
-						return
-					}
+			for _, apps := range [][]appEntry{coreApps, externalApps} {
+				err := convergeApps(managers, apps, locked, func(app appEntry, pkg common.PackageLock) {
 					mu.Lock()
-					logger.Infof("Installed GPG key %s on host %s", pkg.Name, host.Host)
-					mu.Unlock()
-				}
-
-				// Install repo skip if empty
-				if pkg.Repo != "" {
-					err := aptman.AddRepository(host.Password, pkg.Name, pkg.Repo)
-					if err != nil {
-						mu.Lock()
-						logger.Errorf("Error adding repo %s on host %s: %v", pkg.Name, host.Host, err)
-						tasks[taskIndex].Status = "Error"
-						mu.Unlock()
-						return
+					// absent packages are dropped from the lock
+					if pkg.Version != "" {
+						hostLock.SetPackage(app.Name, pkg)
 					}
-					mu.Lock()
-					logger.Infof("Added repo %s on host %s", pkg.Name, host.Host)
+					logger.Infof("Applied package %s (%s) on host %s", app.Name, packageState(app.State), host.Host)
+					completedAppTasks++
+					completedTotalTasks++
+					tasks[taskIndex].Application = fmt.Sprintf("%d/%d", completedAppTasks, tasks[taskIndex].AppTasks)
+					tasks[taskIndex].Status = "In Progress"
+					DisplayProgress(totalAllHostsTasks, completedTotalTasks, tasks, &mu)
 					mu.Unlock()
-				}
-
-				// Install packages
-				fullPkgName := ""
-				if pkg.Version != "" {
-					fullPkgName = fmt.Sprintf("%s=%s", pkg.Name, pkg.Version)
-				} else {
-					fullPkgName = pkg.Name
-				}
-
-				err := aptman.InstallPackage(host.Password, fullPkgName)
+				})
 				if err != nil {
 					mu.Lock()
-					logger.Errorf("Error installing package %s on host %s: %v", pkg, host.Host, err)
+					logger.Errorf("Error applying packages on host %s: %v", host.Host, err)
 					tasks[taskIndex].Status = "Error"
 					mu.Unlock()
 					return
 				}
-				mu.Lock()
-				appVersion, err := aptman.FetchInstalledVersion(pkg.Name)
-				if err != nil {
-					logger.Errorf("Error fetching installed version of package %s on host %s: %v", pkg, host.Host, err)
-					tasks[taskIndex].Status = "Error"
-					return
-				}
-
-				// replace app name in config with app name and version
-				config.Common.Application.Core[pkgIndex].Version = appVersion
-				logger.Infof("Installed package %s on host %s", pkg, host.Host)
-
-				// update progress
-				completedAppTasks++
-				completedTotalTasks++
-				tasks[taskIndex].Application = fmt.Sprintf("%d/%d", completedAppTasks, tasks[taskIndex].AppTasks)
-				tasks[taskIndex].Status = "In Progress"
-				DisplayProgress(totalAllHostsTasks, completedTotalTasks, tasks, &mu)
-				mu.Unlock()
-
-				// for pkgIndex, pkg := range app {
-				// 	fullPkgName := ""
-				// 	if ver != "" {
-				// 		fullPkgName = fmt.Sprintf("%s=%s", pkg, ver)
-				// 	} else {
-				// 		fullPkgName = pkg
-				// 	}
-				// 	err := aptman.InstallPackage(host.Password, fullPkgName)
-				// 	if err != nil {
-				// 		mu.Lock()
-				// 		logger.Errorf("Error installing package %s on host %s: %v", pkg, host.Host, err)
-				// 		tasks[taskIndex].Status = "Error"
-				// 		mu.Unlock()
-				// 		return
-				// 	}
-				// 	mu.Lock()
-				// 	appVersion, err := aptman.FetchInstalledVersion(pkg)
-				// 	if err != nil {
-				// 		logger.Errorf("Error fetching installed version of package %s on host %s: %v", pkg, host.Host, err)
-				// 		tasks[taskIndex].Status = "Error"
-				// 		return
-				// 	}
-				// 	// replace app name in config with app name and version
-				// 	config.Common.Application.External[0].Packages[pkg] = appVersion
-				// 	logger.Infof("Installed package %s on host %s", pkg, host.Host)
-				// 	mu.Unlock()
-
 			}
-			// Install host-specific external packages
-			for pkgIndex, pkg := range host.Application.External {
-				// Install GPG key skip if empty
-				if pkg.GPGKeyURL != "" {
-					err := aptman.InstallGPGKey(host.Password, pkg.Name, pkg.GPGKeyURL)
-					if err != nil {
-						mu.Lock()
-						logger.Errorf("Error installing GPG key %s on host %s: %v", pkg.Name, host.Host, err)
-						tasks[taskIndex].Status = "Error"
-						mu.Unlock()
-						return
-					}
-					mu.Lock()
-					logger.Infof("Installed GPG key %s on host %s", pkg.Name, host.Host)
-					mu.Unlock()
-				}
-				// Install repo skip if empty
-				if pkg.Repo != "" {
-					err := aptman.AddRepository(host.Password, pkg.Name, pkg.Repo)
-					if err != nil {
-						mu.Lock()
-						logger.Errorf("Error adding repo %s on host %s: %v", pkg.Name, host.Host, err)
-						tasks[taskIndex].Status = "Error"
-						mu.Unlock()
-						return
-					}
-					mu.Lock()
-					logger.Infof("Added repo %s on host %s", pkg.Name, host.Host)
-					mu.Unlock()
-				}
-				// Install packages
-				fullPkgName := ""
-				if pkg.Version != "" {
-					fullPkgName = fmt.Sprintf("%s=%s", pkg.Name, pkg.Version)
-				} else {
-					fullPkgName = pkg.Name
-				}
-
-				err := aptman.InstallPackage(host.Password, fullPkgName)
-				if err != nil {
-					mu.Lock()
-					logger.Errorf("Error installing package %s on host %s: %v", pkg, host.Host, err)
-					tasks[taskIndex].Status = "Error"
-					mu.Unlock()
-					return
-				}
-				mu.Lock()
-				appVersion, err := aptman.FetchInstalledVersion(pkg.Name)
-				if err != nil {
-					logger.Errorf("Error fetching installed version of package %s on host %s: %v", pkg, host.Host, err)
-					tasks[taskIndex].Status = "Error"
-					return
-				}
 
-				// replace app name in config with app name and version
-				config.Hosts[i].Application.External[pkgIndex].Version = appVersion
-				logger.Infof("Installed package %s on host %s", pkg, host.Host)
+			// Common templates and commands come before the host-specific ones
+			var templates []common.ConfigurationTemplate
+			templates = append(templates, config.Common.Configuration...)
+			templates = append(templates, host.Configuration...)
+			var commands []common.Command
+			commands = append(commands, config.Common.Commands...)
+			commands = append(commands, host.Commands...)
 
-				// update progress
-				completedAppTasks++
-				completedTotalTasks++
-				tasks[taskIndex].Application = fmt.Sprintf("%d/%d", completedAppTasks, tasks[taskIndex].AppTasks)
-				tasks[taskIndex].Status = "In Progress"
-				DisplayProgress(totalAllHostsTasks, completedTotalTasks, tasks, &mu)
+			// Commands notified by templates only run when one of the templates changed
+			always, handlers, err := splitCommands(templates, commands)
+			if err != nil {
+				mu.Lock()
+				logger.Errorf("Error in commands of host %s: %v", host.Host, err)
+				tasks[taskIndex].Status = "Error"
 				mu.Unlock()
-
+				return
 			}
 
-			// Generate and transfer common configuration templates
-			for _, template := range config.Common.Configuration {
-				err := common.GenerateConfig(template.TemplateFile, template.OutputFile, template.Data)
+			// Generate and transfer configuration templates
+			changedTemplates := make(map[string]bool)
+			hostWithFacts := host
+			hostWithFacts.Facts = hostFacts
+			for _, template := range templates {
+				// Each host renders its own copy of common templates
+				outputFile := common.HostOutputFile(template.OutputFile, host.Host)
+				context := common.NewTemplateContext(template.Data, hostWithFacts, inventory)
+				err := common.GenerateConfig(template.TemplateFile, outputFile, context)
 				if err != nil {
 					mu.Lock()
 					logger.Errorf("Error generating config for template %s on host %s: %v", template.Name, host.Host, err)
@@ -383,67 +228,51 @@ func ApplyConfigWithProgress(config *common.Config) *common.Config {
 					mu.Unlock()
 					return
 				}
+				var changed bool
 				if template.Sudo {
-					err = exec.TransferFileWithRoot(sshClient, template.OutputFile, template.RemoteFile, host.Password)
+					changed, err = exec.TransferFileWithRoot(sshClient, outputFile, template.RemoteFile, host.Become(), templateFileOptions(template))
 				} else {
-					err = exec.TransferFile(sshClient, template.OutputFile, template.RemoteFile)
+					changed, err = exec.TransferFile(sshClient, outputFile, template.RemoteFile, templateFileOptions(template))
 				}
 				if err != nil {
 					mu.Lock()
-					logger.Errorf("Error transferring file %s to host %s: %v", template.OutputFile, host.Host, err)
+					logger.Errorf("Error transferring file %s to host %s: %v", outputFile, host.Host, err)
 					tasks[taskIndex].Status = "Error"
 					mu.Unlock()
 					return
 				}
-				mu.Lock()
-				logger.Infof("Transferred file %s to host %s", template.OutputFile, host.Host)
-				mu.Unlock()
-
-				completedConfigTasks++
-				completedTotalTasks++
-				tasks[taskIndex].Configuration = fmt.Sprintf("%d/%d", completedConfigTasks, tasks[taskIndex].ConfigTasks)
-				tasks[taskIndex].Status = "In Progress"
-				DisplayProgress(totalAllHostsTasks, completedTotalTasks, tasks, &mu)
-			}
-
-			// Generate and transfer host-specific configuration templates
-			for _, template := range host.Configuration {
-				err := common.GenerateConfig(template.TemplateFile, template.OutputFile, template.Data)
+				outputHash, err := common.HashFile(outputFile)
 				if err != nil {
 					mu.Lock()
-					logger.Errorf("Error generating config for template %s on host %s: %v", template.Name, host.Host, err)
+					logger.Errorf("Error hashing file %s for host %s: %v", outputFile, host.Host, err)
 					tasks[taskIndex].Status = "Error"
 					mu.Unlock()
 					return
 				}
-				if template.Sudo {
-					err = exec.TransferFileWithRoot(sshClient, template.OutputFile, template.RemoteFile, host.Password)
+				mu.Lock()
+				hostLock.Templates[template.Name] = common.TemplateLock{RemoteFile: template.RemoteFile, SHA256: outputHash}
+				if changed {
+					changedTemplates[template.Name] = true
+					changedConfigTasks++
+					logger.Infof("Transferred file %s to host %s", outputFile, host.Host)
 				} else {
-					err = exec.TransferFile(sshClient, template.OutputFile, template.RemoteFile)
+					logger.Infof("File %s unchanged on host %s", template.RemoteFile, host.Host)
 				}
-				if err != nil {
-					mu.Lock()
-					logger.Errorf("Error transferring file %s to host %s: %v", template.OutputFile, host.Host, err)
-					tasks[taskIndex].Status = "Error"
-					mu.Unlock()
-					return
-				}
-				mu.Lock()
-				logger.Infof("Transferred file %s to host %s", template.OutputFile, host.Host)
 				mu.Unlock()
 
 				// update progress
 				completedConfigTasks++
 				completedTotalTasks++
-				tasks[taskIndex].Configuration = fmt.Sprintf("%d/%d", completedConfigTasks, tasks[taskIndex].ConfigTasks)
+				tasks[taskIndex].Configuration = fmt.Sprintf("%d/%d (%d changed)", completedConfigTasks, tasks[taskIndex].ConfigTasks, changedConfigTasks)
 				tasks[taskIndex].Status = "In Progress"
 				DisplayProgress(totalAllHostsTasks, completedTotalTasks, tasks, &mu)
 			}
 
-			// Execute common commands
-			for _, command := range config.Common.Commands {
+			// Execute the commands which run on every apply, then the notified handlers
+			triggered := triggeredHandlers(templates, handlers, changedTemplates)
+			for _, command := range append(always, triggered...) {
 				if command.Sudo {
-					err = exec.RunRemoteCommandWithSudoValidation(sshClient, fmt.Sprintf("sudo %s", command.Command), command.ExpectedOutput, exec.LazyMatch, host.Password)
+					err = exec.RunRemoteCommandWithBecomeValidation(sshClient, command.Command, command.ExpectedOutput, exec.LazyMatch, host.Become())
 				} else {
 					err = exec.RunRemoteCommandWithValidation(sshClient, command.Command, command.ExpectedOutput, exec.LazyMatch)
 				}
@@ -458,6 +287,7 @@ func ApplyConfigWithProgress(config *common.Config) *common.Config {
 				logger.Infof("Executed command %s on host %s", command.Name, host.Host)
 				mu.Unlock()
 
+				// update progress
 				completedCommandTasks++
 				completedTotalTasks++
 				tasks[taskIndex].Command = fmt.Sprintf("%d/%d", completedCommandTasks, tasks[taskIndex].CommandTasks)
@@ -465,34 +295,21 @@ func ApplyConfigWithProgress(config *common.Config) *common.Config {
 				DisplayProgress(totalAllHostsTasks, completedTotalTasks, tasks, &mu)
 			}
 
-			// Execute host-specific commands
-			for _, command := range host.Commands {
-				if command.Sudo {
-					err = exec.RunRemoteCommandWithSudoValidation(sshClient, fmt.Sprintf("sudo %s", command.Command), command.ExpectedOutput, exec.LazyMatch, host.Password)
-				} else {
-					err = exec.RunRemoteCommandWithValidation(sshClient, command.Command, command.ExpectedOutput, exec.LazyMatch)
-				}
-				if err != nil {
-					mu.Lock()
-					logger.Errorf("Error executing command %s on host %s: %v", command.Name, host.Host, err)
-					tasks[taskIndex].Status = "Error"
-					mu.Unlock()
-					return
-				}
+			// Handlers which were not notified are skipped, they still count as done
+			if skipped := len(handlers) - len(triggered); skipped > 0 {
 				mu.Lock()
-				logger.Infof("Executed command %s on host %s", command.Name, host.Host)
-				mu.Unlock()
-
-				// update progress
-				completedCommandTasks++
-				completedTotalTasks++
+				logger.Infof("Skipped %d notified commands on host %s, no notifying template changed", skipped, host.Host)
+				completedCommandTasks += skipped
+				completedTotalTasks += skipped
 				tasks[taskIndex].Command = fmt.Sprintf("%d/%d", completedCommandTasks, tasks[taskIndex].CommandTasks)
-				tasks[taskIndex].Status = "In Progress"
-				DisplayProgress(totalAllHostsTasks, completedTotalTasks, tasks, &mu)
+				mu.Unlock()
 			}
 
+			mu.Lock()
+			newLock.SetHost(host.Host, hostLock)
 			tasks[taskIndex].Status = "Completed"
 			DisplayProgress(totalAllHostsTasks, completedTotalTasks, tasks, &mu)
+			mu.Unlock()
 		}(i, host)
 	}
 
@@ -501,5 +318,16 @@ func ApplyConfigWithProgress(config *common.Config) *common.Config {
 
 	// Final display
 	DisplayProgress(totalAllHostsTasks, completedTotalTasks, tasks, &mu)
-	return config
+	return newLock
+}
+
+// templateFileOptions returns the ownership, mode, backup and validation options of a template
+func templateFileOptions(template common.ConfigurationTemplate) exec.FileOptions {
+	return exec.FileOptions{
+		Owner:    template.Owner,
+		Group:    template.Group,
+		Mode:     template.Mode,
+		Backup:   template.Backup,
+		Validate: template.Validate,
+	}
 }
@@ -0,0 +1,202 @@
+package run
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"text/tabwriter"
+
+	"steward/pkg/common"
+	"steward/pkg/exec"
+	"steward/pkg/facts"
+)
+
+// FileChange is a change apply makes to a remote file
+type FileChange struct {
+	Name       string `json:"name"`
+	RemoteFile string `json:"remote_file"`
+	Action     string `json:"action"`
+}
+
+// HostPlan lists the changes apply would make on a host
+type HostPlan struct {
+	Host     string          `json:"host"`
+	Error    string          `json:"error,omitempty"`
+	Packages []PackageChange `json:"packages"`
+	Files    []FileChange    `json:"files"`
+	Commands []string        `json:"commands"`
+}
+
+// HasChanges reports whether apply would change anything on the host
+func (p HostPlan) HasChanges() bool {
+	return len(p.Packages) > 0 || len(p.Files) > 0 || len(p.Commands) > 0
+}
+
+// PlanConfig connects to each host and compares the desired state of the
+// configuration with the actual state, without changing the hosts. Packages
+// without a version are compared with the version in lock unless update is set.
+func PlanConfig(config *common.Config, lock *common.LockFile, update bool) []HostPlan {
+	plans := make([]HostPlan, len(config.Hosts))
+	inventory := make([]common.Host, len(config.Hosts))
+	copy(inventory, config.Hosts)
+
+	var wg sync.WaitGroup
+	for i, host := range config.Hosts {
+		wg.Add(1)
+		go func(planIndex int, host common.Host) {
+			defer wg.Done()
+
+			var locked *common.HostLock
+			if !update {
+				locked = lock.Host(host.Host)
+			}
+			plan, err := planHost(config, host, inventory, locked)
+			if err != nil {
+				logger.Errorf("Error planning host %s: %v", host.Host, err)
+				plan.Error = err.Error()
+			}
+			plans[planIndex] = plan
+		}(i, host)
+	}
+	wg.Wait()
+
+	return plans
+}
+
+// planHost computes the plan of a single host
+func planHost(config *common.Config, host common.Host, inventory []common.Host, locked *common.HostLock) (HostPlan, error) {
+	plan := HostPlan{Host: host.Host}
+
+	sshClient, err := exec.SetupSSHClient(host.SSHOptions())
+	if err != nil {
+		return plan, err
+	}
+	defer sshClient.Close()
+
+	hostFacts, err := facts.Gather(sshClient)
+	if err != nil {
+		logger.Warnf("Error detecting facts of host %s, falling back to %s: %v", host.Host, fallbackManager, err)
+	}
+
+	// Refreshing the repository index would change the host
+	managers := newHostManagers(sshClient, host.Become(), hostFacts)
+	managers.refresh = false
+
+	var apps []appEntry
+	for _, pkg := range config.Common.Application.Core {
+		apps = append(apps, coreAppEntry(pkg))
+	}
+	for _, pkg := range host.Application.Core {
+		apps = append(apps, coreAppEntry(pkg))
+	}
+	for _, pkg := range config.Common.Application.External {
+		apps = append(apps, externalAppEntry(pkg))
+	}
+	for _, pkg := range host.Application.External {
+		apps = append(apps, externalAppEntry(pkg))
+	}
+	plan.Packages, err = planApps(managers, apps, locked)
+	if err != nil {
+		return plan, err
+	}
+
+	var templates []common.ConfigurationTemplate
+	templates = append(templates, config.Common.Configuration...)
+	templates = append(templates, host.Configuration...)
+	hostWithFacts := host
+	hostWithFacts.Facts = hostFacts
+	for _, template := range templates {
+		context := common.NewTemplateContext(template.Data, hostWithFacts, inventory)
+		rendered, err := common.RenderTemplate(template.TemplateFile, context)
+		if err != nil {
+			return plan, fmt.Errorf("failed to render template %s: %w", template.Name, err)
+		}
+		renderedHash := sha256.Sum256(rendered)
+
+		remoteHash, err := exec.RemoteFileSHA256(sshClient, template.RemoteFile, template.Sudo, host.Become())
+		if err != nil {
+			return plan, err
+		}
+
+		switch remoteHash {
+		case hex.EncodeToString(renderedHash[:]):
+			// Apply fixes the owner, group and mode of unchanged files
+			differ, err := exec.RemoteAttributesDiffer(sshClient, template.RemoteFile, templateFileOptions(template), template.Sudo, host.Become())
+			if err != nil {
+				return plan, err
+			}
+			if differ {
+				plan.Files = append(plan.Files, FileChange{Name: template.Name, RemoteFile: template.RemoteFile, Action: "attributes"})
+			}
+		case "":
+			plan.Files = append(plan.Files, FileChange{Name: template.Name, RemoteFile: template.RemoteFile, Action: "create"})
+		default:
+			plan.Files = append(plan.Files, FileChange{Name: template.Name, RemoteFile: template.RemoteFile, Action: "update"})
+		}
+	}
+
+	var commands []common.Command
+	commands = append(commands, config.Common.Commands...)
+	commands = append(commands, host.Commands...)
+	always, handlers, err := splitCommands(templates, commands)
+	if err != nil {
+		return plan, err
+	}
+
+	// Commands are not idempotent, they always run, handlers only when a notifying file changes
+	changed := make(map[string]bool)
+	for _, file := range plan.Files {
+		changed[file.Name] = true
+	}
+	for _, command := range append(always, triggeredHandlers(templates, handlers, changed)...) {
+		plan.Commands = append(plan.Commands, command.Name)
+	}
+
+	return plan, nil
+}
+
+// PrintPlan writes the plans as a table
+func PrintPlan(w io.Writer, plans []HostPlan) error {
+	writer := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(writer, "HOST\tTYPE\tNAME\tACTION\tCURRENT\tDESIRED\n")
+	for _, plan := range plans {
+		if plan.Error != "" {
+			fmt.Fprintf(writer, "%s\t-\t-\terror\t%s\t\n", plan.Host, plan.Error)
+			continue
+		}
+		if !plan.HasChanges() {
+			fmt.Fprintf(writer, "%s\t-\t-\tno changes\t\t\n", plan.Host)
+			continue
+		}
+		for _, pkg := range plan.Packages {
+			fmt.Fprintf(writer, "%s\tpackage (%s)\t%s\t%s\t%s\t%s\n", plan.Host, pkg.Manager, pkg.Name, pkg.Action, orDash(pkg.Current), orDash(pkg.Desired))
+		}
+		for _, file := range plan.Files {
+			fmt.Fprintf(writer, "%s\tfile\t%s\t%s\t\t%s\n", plan.Host, file.Name, file.Action, file.RemoteFile)
+		}
+		for _, command := range plan.Commands {
+			fmt.Fprintf(writer, "%s\tcommand\t%s\twill run\t\t\n", plan.Host, command)
+		}
+	}
+
+	return writer.Flush()
+}
+
+// PrintPlanJSON writes the plans as indented JSON
+func PrintPlanJSON(w io.Writer, plans []HostPlan) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(plans)
+}
+
+// orDash returns "-" for empty table cells
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+)
+
+// redactedText replaces secrets in logs
+const redactedText = "[REDACTED]"
+
+// secrets holds the values redacted from all logs
+var secrets = struct {
+	sync.RWMutex
+	values []string
+}{}
+
+// RegisterSecret redacts value from everything logged from now on, by every
+// logger created with SetupLogging
+func RegisterSecret(value string) {
+	if value == "" {
+		return
+	}
+	forms := []string{value}
+	// The JSON log encoder escapes quotes, backslashes and control characters
+	if encoded, err := json.Marshal(value); err == nil {
+		if escaped := string(encoded[1 : len(encoded)-1]); escaped != value {
+			forms = append(forms, escaped)
+		}
+	}
+
+	secrets.Lock()
+	defer secrets.Unlock()
+	for _, form := range forms {
+		known := false
+		for _, existing := range secrets.values {
+			if existing == form {
+				known = true
+				break
+			}
+		}
+		if !known {
+			secrets.values = append(secrets.values, form)
+		}
+	}
+}
+
+// Redact replaces the registered secrets in s
+func Redact(s string) string {
+	secrets.RLock()
+	defer secrets.RUnlock()
+	for _, value := range secrets.values {
+		s = strings.ReplaceAll(s, value, redactedText)
+	}
+	return s
+}
+
+// redactingWriter redacts registered secrets before writing to w. Log
+// entries are written whole, so secrets are never split across writes.
+type redactingWriter struct {
+	w io.Writer
+}
+
+// NewRedactingWriter returns a writer which redacts registered secrets
+func NewRedactingWriter(w io.Writer) io.Writer {
+	return &redactingWriter{w: w}
+}
+
+func (r *redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.w, Redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,28 @@
+package utils
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRedactingWriter(t *testing.T) {
+	RegisterSecret("hunter2")
+	RegisterSecret(`quo"ted`)
+	RegisterSecret("")
+
+	var out bytes.Buffer
+	w := NewRedactingWriter(&out)
+	line := `{"msg":"password hunter2 and quo\"ted"}` + "\n"
+	n, err := w.Write([]byte(line))
+	if err != nil || n != len(line) {
+		t.Fatalf("Expected %d bytes written, got %d, %v", len(line), n, err)
+	}
+
+	expected := `{"msg":"password [REDACTED] and [REDACTED]"}` + "\n"
+	if out.String() != expected {
+		t.Errorf("Expected %s, got %s", expected, out.String())
+	}
+	if Redact("nothing secret") != "nothing secret" {
+		t.Errorf("Expected text without secrets to be unchanged")
+	}
+}
@@ -22,17 +22,17 @@ func SetupLogging(verbose bool) *zap.SugaredLogger {
         panic("Failed to open log file: " + err.Error())
     }
 
-    // Create a core for logging to a file
+    // Create a core for logging to a file, secrets are redacted from all logs
     fileCore := zapcore.NewCore(
         zapcore.NewJSONEncoder(zapConfig.EncoderConfig),
-        zapcore.AddSync(logFile),
+        zapcore.AddSync(NewRedactingWriter(logFile)),
         zapConfig.Level,
     )
 
     // Create a core for logging to the console
     consoleCore := zapcore.NewCore(
         zapcore.NewConsoleEncoder(zapConfig.EncoderConfig),
-        zapcore.AddSync(os.Stdout),
+        zapcore.AddSync(NewRedactingWriter(os.Stdout)),
         zapConfig.Level,
     )
 